@@ -8,8 +8,10 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-courier/snowflakeid v1.2.1
 	github.com/go-logr/logr v1.2.3
+	github.com/google/btree v1.1.2
 	github.com/octohelm/x v0.0.0-20220702024522-85805599670c
 	github.com/pkg/errors v0.9.1
+	go.etcd.io/bbolt v1.3.6
 )
 
 require (
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+
+	"github.com/octohelm/kiwidb/internal/tree"
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/pkg/errors"
+)
+
+const (
+	backupFormat  = "kiwidb.backup"
+	backupVersion = 1
+)
+
+// backupHeader starts the backup, followed by pairs of key and value,
+// an empty key marks the end, followed by backupTrailer.
+type backupHeader struct {
+	Format   string `msgp:"format"`
+	Version  int    `msgp:"version"`
+	Sequence uint64 `msgp:"sequence"`
+}
+
+type backupTrailer struct {
+	Count uint64 `msgp:"count"`
+}
+
+// keys of all namespaces, including catalog, tables and indexes.
+func backupRange() (start []byte, end []byte) {
+	return tree.NewNamespacedKey(0).Bytes(), tree.NewNamespacedKey(math.MaxUint64).Bytes()
+}
+
+// Backup writes keys and values of all namespaces from a consistent snapshot into w.
+func (d *database) Backup(ctx context.Context, w io.Writer) error {
+	return d.View(ctx, func(tx Transaction) error {
+		bw := bufio.NewWriter(w)
+		enc := msgp.NewEncoder(bw)
+
+		if err := enc.Encode(&backupHeader{
+			Format:   backupFormat,
+			Version:  backupVersion,
+			Sequence: tx.Sequence(),
+		}); err != nil {
+			return err
+		}
+
+		it := tx.Session().Iterator(backupRange())
+		defer it.Close()
+
+		count := uint64(0)
+
+		for it.First(); it.Valid(); it.Next() {
+			if count%kv.CheckContextInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			if err := enc.Encode(it.Key()); err != nil {
+				return err
+			}
+			if err := enc.Encode(it.Value()); err != nil {
+				return err
+			}
+			count++
+		}
+		if err := it.Error(); err != nil {
+			return err
+		}
+
+		if err := enc.Encode([]byte(nil)); err != nil {
+			return err
+		}
+		if err := enc.Encode(&backupTrailer{Count: count}); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+}
+
+// Restore writes keys and values from r written by Backup into the store in one transaction,
+// the store must be empty.
+// Entries of indexes are restored as written, not rebuilt, so they are of index schemas in the backup.
+// Tables cached by the catalog are dropped after restored, then loaded from the catalog restored.
+func (d *database) Restore(ctx context.Context, r io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dec := msgp.NewDecoder(bufio.NewReader(r))
+
+	header := &backupHeader{}
+	if err := dec.Decode(header); err != nil {
+		return errors.Wrap(err, "invalid backup")
+	}
+	if header.Format != backupFormat {
+		return errors.Errorf("invalid backup format %q", header.Format)
+	}
+	if header.Version != backupVersion {
+		return errors.Errorf("unsupported backup version %d", header.Version)
+	}
+
+	return d.update(func(tx Transaction) error {
+		it := tx.Session().Iterator(backupRange())
+		notEmpty := it.First()
+		if err := it.Close(); err != nil {
+			return err
+		}
+		if notEmpty {
+			return errors.New("restore into store not empty")
+		}
+
+		count := uint64(0)
+
+		for {
+			if count%kv.CheckContextInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+
+			var key, value []byte
+			if err := dec.Decode(&key); err != nil {
+				return errors.Wrap(err, "invalid backup")
+			}
+			if len(key) == 0 {
+				break
+			}
+			if err := dec.Decode(&value); err != nil {
+				return errors.Wrap(err, "invalid backup")
+			}
+			if err := tx.Session().Put(key, value); err != nil {
+				return err
+			}
+			count++
+		}
+
+		trailer := &backupTrailer{}
+		if err := dec.Decode(trailer); err != nil {
+			return errors.Wrap(err, "invalid backup")
+		}
+		if trailer.Count != count {
+			return errors.Errorf("incomplete backup, %d of %d keys restored", count, trailer.Count)
+		}
+
+		tx.On(TransactionEventCommit, d.catalog.reset)
+
+		return ctx.Err()
+	})
+}
@@ -3,119 +3,627 @@ package database
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 
+	"github.com/octohelm/kiwidb/internal/tree"
 	"github.com/octohelm/kiwidb/pkg/dberr"
 	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
 	"github.com/octohelm/kiwidb/pkg/schema"
+	"github.com/pkg/errors"
 )
 
+// namespace of catalog version, which is increased for every schema change.
+const catalogVersionNamespace tree.Namespace = 4
+
+var catalogVersionKey = tree.NewKey("version")
+
 var (
 	tsOfTableSchema *schema.TableSchema
 	tsOfIndexSchema *schema.TableSchema
 )
 
 func init() {
-	tsOfTableSchema, _ = schema.TableSchemaFor(&schema.TableSchema{
-		PKey: schema.PKey{
-			ID: 0,
-		},
+	// catalog tables and their indexes use reserved namespaces,
+	// ids generated by id.Gen will never collide with them.
+	tsOfTableSchema = mustCatalogTableSchema(&schema.TableSchema{}, 0, map[string]uint64{
+		"name": 2,
 	})
-	_ = tsOfTableSchema.Init()
-
-	tsOfIndexSchema, _ = schema.TableSchemaFor(&schema.IndexSchema{
-		PKey: schema.PKey{
-			ID: 1,
-		},
+	tsOfIndexSchema = mustCatalogTableSchema(&schema.IndexSchema{}, 1, map[string]uint64{
+		"owner": 3,
 	})
-	_ = tsOfIndexSchema.Init()
+}
+
+func mustCatalogTableSchema(model any, id uint64, indexIDs map[string]uint64) *schema.TableSchema {
+	ts, err := schema.TableSchemaFor(model)
+	if err != nil {
+		panic(err)
+	}
+	if err := ts.Init(); err != nil {
+		panic(err)
+	}
+	ts.SetPrimaryKey(id)
+	for name, is := range ts.IndexSchemas {
+		is.Owner = schema.SFID(id)
+		is.SetPrimaryKey(indexIDs[name])
+	}
+	return ts
 }
 
 type catalog struct {
 	tables sync.Map // map[reflect.Type]*schema.TableSchema
 	db     *database
+
+	// version of catalog which cached tables loaded from
+	version uint64
+	mu      sync.Mutex
+	// 1 once layout of the stored catalog checked
+	layoutChecked uint32
 }
 
-func (c *catalog) TableSchema(model any) (*schema.TableSchema, error) {
+// TableSchema returns schema of model as the catalog visible to tx.
+// Table is synced with schema of model when changed, in its own transaction before the catalog version loaded by tx,
+// so tx would not conflict with syncing by itself.
+// Read-only tx never syncs tables, which would never be visible to it, unless the table not stored yet.
+func (c *catalog) TableSchema(ctx context.Context, tx Transaction, model any) (*schema.TableSchema, error) {
 	ts, err := schema.TableSchemaFor(model)
 	if err != nil {
 		return nil, err
 	}
 
-	if stored, ok := c.tables.Load(ts.Type); ok {
-		return stored.(*schema.TableSchema), nil
+	readOnly := isReadOnly(tx)
+
+	_, cached := c.tables.Load(ts.Type)
+	if !cached && !readOnly {
+		if err := c.syncTable(ctx, ts); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := ts.Init(); err != nil {
+	current, err := c.refresh(tx)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := c.syncTable(context.Background(), ts); err != nil {
-		return nil, err
+	if current {
+		if stored, ok := c.tables.Load(ts.Type); ok {
+			return stored.(*schema.TableSchema), nil
+		}
+	}
+
+	if readOnly || !current {
+		// tx reads catalog older than cached, like read-only transaction pinned to sequence before.
+		return c.storedTableSchema(ctx, tx, ts, current)
+	}
+
+	if cached {
+		// dropped as schemas changed by others.
+		if err := c.syncTable(ctx, ts); err != nil {
+			return nil, err
+		}
+		if current, err = c.refresh(tx); err != nil {
+			return nil, err
+		}
+		if !current {
+			return c.storedTableSchema(ctx, tx, ts, current)
+		}
 	}
 
 	c.tables.Store(ts.Type, ts)
+	return ts, nil
+}
+
+func isReadOnly(tx Transaction) bool {
+	t, ok := tx.(*transaction)
+	return ok && t.readOnly
+}
+
+// storedTableSchema returns ts with ids of the table stored in the catalog visible to tx,
+// which is cached when the catalog is current.
+// When the table not stored or changed in it, ts is synced for ids instead.
+func (c *catalog) storedTableSchema(ctx context.Context, tx Transaction, ts *schema.TableSchema, current bool) (*schema.TableSchema, error) {
+	if err := ts.Init(); err != nil {
+		return nil, err
+	}
 
+	stored, err := c.TableSchemaByName(ctx, tx, ts.Name)
+	if err != nil {
+		if _, ok := dberr.IsNotFoundError(err); !ok {
+			return nil, err
+		}
+	}
+
+	if stored == nil || !isSameTableSchema(stored, ts) {
+		if err := c.syncTable(ctx, ts); err != nil {
+			return nil, err
+		}
+		return ts, nil
+	}
+
+	adoptTableSchema(ts, stored)
+
+	if current {
+		c.tables.Store(ts.Type, ts)
+	}
 	return ts, nil
 }
 
-func (c *catalog) syncTable(ctx context.Context, ts *schema.TableSchema) (err error) {
-	tx := c.db.Begin()
+// adoptTableSchema uses ids of table and indexes stored.
+func adoptTableSchema(ts *schema.TableSchema, stored *schema.TableSchema) {
+	ts.SetPrimaryKey(stored.PrimaryKey())
+	for name := range ts.IndexSchemas {
+		ts.IndexSchemas[name] = stored.IndexSchemas[name]
+	}
+}
+
+func isSameTableSchema(stored *schema.TableSchema, ts *schema.TableSchema) bool {
+	if len(stored.IndexSchemas) != len(ts.IndexSchemas) {
+		return false
+	}
+	for name, is := range ts.IndexSchemas {
+		s, ok := stored.IndexSchemas[name]
+		if !ok || !s.IsEqual(is) {
+			return false
+		}
+	}
+	return true
+}
 
-	defer func() {
+// refresh drops all cached table schemas when the catalog version visible to tx
+// is newer than the one they loaded from, which means schemas changed by others.
+// Returns whether cached table schemas are of the catalog version visible to tx.
+func (c *catalog) refresh(tx Transaction) (bool, error) {
+	v, err := c.versionOfTransaction(tx)
+	if err != nil {
+		return false, err
+	}
+
+	if v == atomic.LoadUint64(&c.version) {
+		return true, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if v > c.version {
+		c.tables.Range(func(k, _ any) bool {
+			c.tables.Delete(k)
+			return true
+		})
+		atomic.StoreUint64(&c.version, v)
+	}
+
+	return v == c.version, nil
+}
+
+// reset drops all cached table schemas with the catalog version they loaded from,
+// like when the whole catalog replaced by Restore.
+func (c *catalog) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tables.Range(func(k, _ any) bool {
+		c.tables.Delete(k)
+		return true
+	})
+	atomic.StoreUint64(&c.version, 0)
+}
+
+// versionOfTransaction returns catalog version visible to tx, which is loaded once by the session of tx.
+func (c *catalog) versionOfTransaction(tx Transaction) (uint64, error) {
+	t, ok := tx.(*transaction)
+	if !ok {
+		return c.versionOf(tx)
+	}
+
+	if t.catalogVersion == nil {
+		v, err := c.versionOf(tx)
 		if err != nil {
-			_ = tx.Rollback()
+			return 0, err
+		}
+		t.catalogVersion = &v
+	}
+
+	return *t.catalogVersion, nil
+}
+
+func (c *catalog) versionOf(tx Transaction) (uint64, error) {
+	raw, err := tree.New(tx.Session(), catalogVersionNamespace).Get(catalogVersionKey)
+	if err != nil {
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return 0, nil
 		}
-	}()
+		return 0, err
+	}
+	var v uint64
+	if err := msgp.Unmarshal(raw, &v); err != nil {
+		return 0, errors.Wrap(err, "invalid catalog version")
+	}
+	return v, nil
+}
 
-	schemaTable, err := NewTable(tx, tsOfTableSchema)
+// bumpVersion increases catalog version in tx.
+// When nobody else changed the catalog in the meantime, the cached tables are still valid after commit.
+func (c *catalog) bumpVersion(tx Transaction) error {
+	v, err := c.versionOf(tx)
 	if err != nil {
 		return err
 	}
 
-	tableNameIndex := NewIndex(tx, tsOfTableSchema.IndexSchema("name"))
-	exists, tableIDKey, err := tableNameIndex.Exists(ctx, []any{ts.Name})
+	raw, err := msgp.Marshal(v + 1)
 	if err != nil {
 		return err
 	}
 
-	d := DocumentFrom(ts)
+	if err := tree.New(tx.Session(), catalogVersionNamespace).Put(catalogVersionKey, raw); err != nil {
+		return err
+	}
+
+	tx.On(TransactionEventCommit, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.version == v {
+			atomic.StoreUint64(&c.version, v+1)
+		}
+	})
+
+	return nil
+}
+
+// TableSchemaByName loads table schema with its index schemas from the persisted catalog.
+// The returned schema has no Go type, documents of the table should be handled as map[string]any.
+func (c *catalog) TableSchemaByName(ctx context.Context, tx Transaction, name string) (*schema.TableSchema, error) {
+	tableID, exists, err := c.lookup(ctx, tx, tsOfTableSchema, "name", name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &dberr.NotFoundError{Name: name}
+	}
+
+	ts := &schema.TableSchema{}
+	if err := c.get(ctx, tx, tsOfTableSchema, tableID, ts); err != nil {
+		return nil, err
+	}
 
+	indexSchemas, err := c.indexSchemasOf(ctx, tx, tableID)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexSchemas) > 0 {
+		ts.IndexSchemas = indexSchemas
+	}
+
+	return ts, nil
+}
+
+// DropTable removes the table with all its indexes, both catalog rows and data.
+func (c *catalog) DropTable(ctx context.Context, tx Transaction, name string) error {
+	ts, err := c.TableSchemaByName(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+
+	t, err := NewTable(tx, ts)
+	if err != nil {
+		return err
+	}
+
+	if err := t.Truncate(ctx); err != nil {
+		return err
+	}
+
+	for k := range ts.IndexSchemas {
+		if err := c.delete(ctx, tx, tsOfIndexSchema, DocumentFrom(ts.IndexSchemas[k])); err != nil {
+			return err
+		}
+	}
+
+	if err := c.delete(ctx, tx, tsOfTableSchema, DocumentFrom(ts)); err != nil {
+		return err
+	}
+
+	if err := c.bumpVersion(tx); err != nil {
+		return err
+	}
+
+	c.invalidateOnCommit(tx, name)
+
+	return nil
+}
+
+// RenameTable changes the name of table, the namespaces of table and its indexes are kept.
+func (c *catalog) RenameTable(ctx context.Context, tx Transaction, name string, newName string) error {
+	_, exists, err := c.lookup(ctx, tx, tsOfTableSchema, "name", newName)
+	if err != nil {
+		return err
+	}
 	if exists {
-		tableID := tableIDKey.Values()[0].(uint64)
-		d.SetPrimaryKey(tableID)
+		return &dberr.ConflictError{Name: newName}
 	}
 
-	key, d, err := schemaTable.Insert(ctx, d)
+	tableID, exists, err := c.lookup(ctx, tx, tsOfTableSchema, "name", name)
 	if err != nil {
-		ce, conflict := dberr.IsConflictError(err)
-		if !conflict {
+		return err
+	}
+	if !exists {
+		return &dberr.NotFoundError{Name: name}
+	}
+
+	ts := &schema.TableSchema{}
+	if err := c.get(ctx, tx, tsOfTableSchema, tableID, ts); err != nil {
+		return err
+	}
+
+	if err := c.delete(ctx, tx, tsOfTableSchema, DocumentFrom(ts)); err != nil {
+		return err
+	}
+
+	ts.Name = newName
+
+	if err := c.put(ctx, tx, tsOfTableSchema, DocumentFrom(ts)); err != nil {
+		return err
+	}
+
+	if err := c.bumpVersion(tx); err != nil {
+		return err
+	}
+
+	c.invalidateOnCommit(tx, name, newName)
+
+	return nil
+}
+
+// TruncateTable removes all documents of table and entries of its indexes.
+func (c *catalog) TruncateTable(ctx context.Context, tx Transaction, name string) error {
+	ts, err := c.TableSchemaByName(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+
+	t, err := NewTable(tx, ts)
+	if err != nil {
+		return err
+	}
+
+	return t.Truncate(ctx)
+}
+
+// invalidateOnCommit drops cached table schemas of names once tx committed.
+func (c *catalog) invalidateOnCommit(tx Transaction, names ...string) {
+	tx.On(TransactionEventCommit, func() {
+		c.tables.Range(func(k, v any) bool {
+			for _, name := range names {
+				if v.(*schema.TableSchema).Name == name {
+					c.tables.Delete(k)
+				}
+			}
+			return true
+		})
+	})
+}
+
+// syncTable stores table schema with its indexes when changed,
+// retried when conflicted with others syncing the same table.
+func (c *catalog) syncTable(ctx context.Context, ts *schema.TableSchema) error {
+	if err := ts.Init(); err != nil {
+		return err
+	}
+
+	return c.db.Update(ctx, func(tx Transaction) error {
+		stored, err := c.TableSchemaByName(ctx, tx, ts.Name)
+		if err != nil {
+			if _, ok := dberr.IsNotFoundError(err); !ok {
+				return err
+			}
+		}
+
+		if stored != nil && isSameTableSchema(stored, ts) {
+			adoptTableSchema(ts, stored)
+			return nil
+		}
+
+		return c.putTableSchema(ctx, tx, ts)
+	})
+}
+
+func (c *catalog) putTableSchema(ctx context.Context, tx Transaction, ts *schema.TableSchema) error {
+	tableID, exists, err := c.lookup(ctx, tx, tsOfTableSchema, "name", ts.Name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		ts.SetPrimaryKey(tableID)
+	}
+
+	if err := c.put(ctx, tx, tsOfTableSchema, DocumentFrom(ts)); err != nil {
+		return err
+	}
+
+	stored, err := c.indexSchemasOf(ctx, tx, ts.PrimaryKey())
+	if err != nil {
+		return err
+	}
+
+	for name := range ts.IndexSchemas {
+		is := ts.IndexSchemas[name]
+		is.Owner = ts.ID
+
+		// entries of index should be built for documents exist,
+		// when index added to existing table or changed.
+		backfill := exists
+
+		// keep namespace of index when already exists.
+		if s, ok := stored[name]; ok {
+			is.SetPrimaryKey(s.PrimaryKey())
+			backfill = !s.IsEqual(is)
+		}
+
+		if err := c.put(ctx, tx, tsOfIndexSchema, DocumentFrom(is)); err != nil {
+			return err
+		}
+
+		if backfill {
+			if err := c.backfillIndex(ctx, tx, ts, is); err != nil {
+				return err
+			}
+		}
+	}
+
+	// drop entries of indexes removed from table.
+	for name := range stored {
+		if _, ok := ts.IndexSchemas[name]; ok {
+			continue
+		}
+		if err := NewIndex(tx, stored[name]).Truncate(ctx); err != nil {
 			return err
 		}
-		if err := schemaTable.Replace(ctx, ce.Key, d); err != nil {
+		if err := c.delete(ctx, tx, tsOfIndexSchema, DocumentFrom(stored[name])); err != nil {
 			return err
 		}
 	}
 
-	// sync indexes
-	for k := range tsOfTableSchema.IndexSchemas {
-		is := tsOfTableSchema.IndexSchemas[k]
-		idx := NewIndex(tx, is)
+	return c.bumpVersion(tx)
+}
 
-		values := make([]any, len(is.Paths))
+// backfillIndex rebuilds entries of index for all documents of table.
+func (c *catalog) backfillIndex(ctx context.Context, tx Transaction, ts *schema.TableSchema, is *schema.IndexSchema) error {
+	idx := NewIndex(tx, is)
 
-		for i := range is.Paths {
-			v, err := d.Field(is.Paths[i]...)
-			if err != nil {
+	if err := idx.Truncate(ctx); err != nil {
+		return err
+	}
+
+	t, err := NewTable(tx, ts)
+	if err != nil {
+		return err
+	}
+
+	return t.Range(ctx, nil, false, func(key tree.Key, d Document) error {
+		entries, err := indexValuesOf(is, d)
+		if err != nil {
+			return err
+		}
+
+		// key of range contains namespace of table
+		pk := tree.NewKey(key.Values()...)
+
+		for i := range entries {
+			if err := idx.Set(ctx, entries[i], pk); err != nil {
 				return err
 			}
-			raw, _ := v.Marshal()
-			values[i] = msgp.Encoded(raw)
 		}
+		return nil
+	})
+}
+
+func (c *catalog) indexSchemasOf(ctx context.Context, tx Transaction, tableID uint64) (map[string]*schema.IndexSchema, error) {
+	indexSchemas := map[string]*schema.IndexSchema{}
+
+	ownerIndex := NewIndex(tx, tsOfIndexSchema.IndexSchema("owner"))
+	owner := tree.NewKey(tableID)
+
+	err := ownerIndex.Range(ctx, tree.NewRange(owner, owner, false), false, func(key tree.Key) error {
+		is := &schema.IndexSchema{}
+		if err := c.get(ctx, tx, tsOfIndexSchema, key.Values()[0].(uint64), is); err != nil {
+			return err
+		}
+		indexSchemas[is.Name] = is
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return indexSchemas, nil
+}
+
+// lookup returns the primary key of catalog row by value of unique index
+func (c *catalog) lookup(ctx context.Context, tx Transaction, ts *schema.TableSchema, indexName string, values ...any) (uint64, bool, error) {
+	if err := c.checkLayout(); err != nil {
+		return 0, false, err
+	}
+
+	idx := NewIndex(tx, ts.IndexSchema(indexName))
+	exists, key, err := idx.Exists(ctx, values)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+	return key.Values()[0].(uint64), true, nil
+}
+
+func (c *catalog) get(ctx context.Context, tx Transaction, ts *schema.TableSchema, id uint64, target any) error {
+	t, err := NewTable(tx, ts)
+	if err != nil {
+		return err
+	}
+	d, err := t.Get(ctx, tree.NewKey(id))
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(d.Unmarshal(target), "invalid catalog row of %s", ts.Name)
+}
 
-		if err := idx.Set(ctx, values, key); err != nil {
+// put inserts or replaces catalog row, indexes are synced by table
+func (c *catalog) put(ctx context.Context, tx Transaction, ts *schema.TableSchema, d Document) error {
+	t, err := NewTable(tx, ts)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := t.Insert(ctx, d); err != nil {
+		ce, conflict := dberr.IsConflictError(err)
+		if !conflict {
 			return err
 		}
+		return t.Replace(ctx, ce.Key, d)
 	}
 
-	return tx.Commit()
+	return nil
+}
+
+// delete removes catalog row with its index entries
+func (c *catalog) delete(ctx context.Context, tx Transaction, ts *schema.TableSchema, d Document) error {
+	t, err := NewTable(tx, ts)
+	if err != nil {
+		return err
+	}
+	return t.Delete(ctx, tree.NewKey(d.PrimaryKey()))
+}
+
+// checkLayout refuses the catalog stored before indexes of catalog moved into namespaces of their own,
+// the name index of tables was in namespace 0 with table schemas then, mixed with entries of all indexes of tables,
+// which could not be migrated.
+// It is checked in a snapshot session of its own, so transactions never conflict with it.
+func (c *catalog) checkLayout() error {
+	if atomic.LoadUint32(&c.layoutChecked) == 1 {
+		return nil
+	}
+
+	s := c.db.store.NewSnapshotSession(c.db.name)
+	defer s.Close()
+
+	tablesStored, err := isNamespaceStored(s, tree.Namespace(tsOfTableSchema.PrimaryKey()))
+	if err != nil {
+		return err
+	}
+	namesStored, err := isNamespaceStored(s, tree.Namespace(tsOfTableSchema.IndexSchema("name").PrimaryKey()))
+	if err != nil {
+		return err
+	}
+	if tablesStored && !namesStored {
+		return errors.New("unsupported catalog layout, tables stored with the name index in namespace 0, data should be imported into a new store")
+	}
+
+	atomic.StoreUint32(&c.layoutChecked, 1)
+	return nil
+}
+
+func isNamespaceStored(s kv.Session, ns tree.Namespace) (bool, error) {
+	it := s.Iterator(tree.NewNamespacedKey(ns).Bytes(), tree.NewNamespacedKey(ns+1).Bytes())
+	defer it.Close()
+
+	stored := it.First()
+	return stored, it.Error()
 }
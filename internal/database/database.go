@@ -3,15 +3,37 @@ package database
 import (
 	"context"
 	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/octohelm/kiwidb/pkg/dberr"
 	"github.com/octohelm/kiwidb/pkg/id"
 	"github.com/octohelm/kiwidb/pkg/kv"
 )
 
 type Database interface {
 	Execute(ctx context.Context, op Operator) error
-	Table(tx Transaction, model any) (Table, error)
-	Index(tx Transaction, model any, name string) (Index, error)
+	// Table opens table of model, the table is created or synced with schema of model when changed,
+	// and indexes added are backfilled, which stop once ctx done.
+	Table(ctx context.Context, tx Transaction, model any) (Table, error)
+	TableByName(ctx context.Context, tx Transaction, name string) (Table, error)
+	DropTable(ctx context.Context, tx Transaction, name string) error
+	RenameTable(ctx context.Context, tx Transaction, name string, newName string) error
+	TruncateTable(ctx context.Context, tx Transaction, name string) error
+	Index(ctx context.Context, tx Transaction, model any, name string) (Index, error)
 	Begin(optFns ...TransactionOptionFunc) Transaction
+	// BeginAt starts read-only transaction pinned to the commit sequence returned by Transaction.Sequence.
+	BeginAt(seq uint64) (Transaction, error)
+	Update(ctx context.Context, fn func(tx Transaction) error) error
+	View(ctx context.Context, fn func(tx Transaction) error) error
+	ViewAt(ctx context.Context, seq uint64, fn func(tx Transaction) error) error
+	// Sync persists changes of all transactions committed, including ones with kv.DurabilityNoSync.
+	Sync() error
+	// Backup writes all data, including catalog, tables and indexes, from a consistent snapshot into w.
+	Backup(ctx context.Context, w io.Writer) error
+	// Restore rebuilds data written by Backup into the empty store.
+	Restore(ctx context.Context, r io.Reader) error
 }
 
 func New(dbName string, s kv.Store, gen id.Gen) Database {
@@ -42,17 +64,17 @@ func (d *databaseTx) String() string {
 }
 
 func (d *databaseTx) Iterate(in State, next func(state State) error) error {
-	tx := d.db.Begin()
+	return d.db.Update(in.Context(), func(tx Transaction) error {
+		in.SetTx(tx)
+		in.SetDatabase(d.db)
 
-	in.SetTx(tx)
-	in.SetDatabase(d.db)
+		if err := next(in); err != nil {
+			return err
+		}
 
-	if err := next(in); err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-
-	return tx.Commit()
+		// rollback when deadline exceeded or canceled before commit
+		return in.Context().Err()
+	})
 }
 
 func (d *database) Execute(ctx context.Context, op Operator) (err error) {
@@ -67,16 +89,132 @@ func (d *database) Begin(optFns ...TransactionOptionFunc) Transaction {
 	return NewTransaction(d.name, d.store, d.gen, optFns...)
 }
 
-func (d *database) Table(tx Transaction, model any) (Table, error) {
-	s, err := d.catalog.TableSchema(model)
+func (d *database) Sync() error {
+	return d.store.Sync()
+}
+
+func (d *database) BeginAt(seq uint64) (Transaction, error) {
+	return NewTransactionAt(d.name, d.store, d.gen, seq)
+}
+
+const (
+	maxUpdateAttempts = 10
+	minRetryBackoff   = 2 * time.Millisecond
+	maxRetryBackoff   = 200 * time.Millisecond
+)
+
+// Update runs fn in a writable transaction, commits when fn returns nil, otherwise rollback.
+// The whole transaction is retried with backoff when it failed by retryable errors like conflicts,
+// so fn may be called multiple times, and only hooks of the final attempt committed would be called.
+func (d *database) Update(ctx context.Context, fn func(tx Transaction) error) error {
+	backoff := minRetryBackoff
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := d.update(fn)
+		if err == nil || !dberr.IsRetryable(err) || attempt >= maxUpdateAttempts {
+			return err
+		}
+
+		// full jitter to spread conflicting transactions
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff)) + 1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func (d *database) update(fn func(tx Transaction) error) error {
+	tx := d.Begin()
+
+	defer func() {
+		if r := recover(); r != nil {
+			_ = tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// View runs fn in a read-only transaction.
+func (d *database) View(ctx context.Context, fn func(tx Transaction) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tx := d.Begin(TransactionReadOnly())
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	return fn(tx)
+}
+
+// ViewAt runs fn in a read-only transaction pinned to the commit sequence.
+func (d *database) ViewAt(ctx context.Context, seq uint64, fn func(tx Transaction) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tx, err := d.BeginAt(seq)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	return fn(tx)
+}
+
+func (d *database) Table(ctx context.Context, tx Transaction, model any) (Table, error) {
+	s, err := d.catalog.TableSchema(ctx, tx, model)
+	if err != nil {
+		return nil, err
+	}
+	return NewTable(tx, s)
+}
+
+// TableByName opens table by the name stored in catalog.
+// Documents of the table could be read or written as map[string]any.
+func (d *database) TableByName(ctx context.Context, tx Transaction, name string) (Table, error) {
+	s, err := d.catalog.TableSchemaByName(ctx, tx, name)
 	if err != nil {
 		return nil, err
 	}
 	return NewTable(tx, s)
 }
 
-func (d *database) Index(tx Transaction, model any, name string) (Index, error) {
-	s, err := d.catalog.TableSchema(model)
+func (d *database) DropTable(ctx context.Context, tx Transaction, name string) error {
+	return d.catalog.DropTable(ctx, tx, name)
+}
+
+func (d *database) RenameTable(ctx context.Context, tx Transaction, name string, newName string) error {
+	return d.catalog.RenameTable(ctx, tx, name, newName)
+}
+
+func (d *database) TruncateTable(ctx context.Context, tx Transaction, name string) error {
+	return d.catalog.TruncateTable(ctx, tx, name)
+}
+
+func (d *database) Index(ctx context.Context, tx Transaction, model any, name string) (Index, error) {
+	s, err := d.catalog.TableSchema(ctx, tx, model)
 	if err != nil {
 		return nil, err
 	}
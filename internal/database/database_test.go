@@ -1,10 +1,19 @@
 package database_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/octohelm/kiwidb/pkg/dberr"
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/octohelm/kiwidb/pkg/kv/pebble"
 	"github.com/octohelm/kiwidb/pkg/schema"
 
 	"github.com/octohelm/kiwidb/internal/database"
@@ -20,11 +29,17 @@ type User struct {
 	Name string `msgp:"name" json:"name"`
 }
 
+func (User) Indexes() map[string]schema.IndexType {
+	return map[string]schema.IndexType{
+		"name": schema.UniqueIndex,
+	}
+}
+
 func TestDatabase(t *testing.T) {
 	t.Run("InsertUser", func(t *testing.T) {
 		db := testutil.NewDatabase(t, "test")
 		tx := db.Begin()
-		tableUser, err := db.Table(tx, &User{})
+		tableUser, err := db.Table(context.Background(), tx, &User{})
 		Expect(t, err, Be[error](nil))
 
 		for i := 0; i < 100; i++ {
@@ -40,8 +55,9 @@ func TestDatabase(t *testing.T) {
 
 		t.Run("Table Range", func(t *testing.T) {
 			tx := db.Begin(database.TransactionReadOnly())
+			defer tx.Rollback()
 
-			tUser, err := db.Table(tx, &User{})
+			tUser, err := db.Table(context.Background(), tx, &User{})
 			Expect(t, err, Be[error](nil))
 
 			ids := make([]uint64, 0)
@@ -52,6 +68,1427 @@ func TestDatabase(t *testing.T) {
 			Expect(t, err, Be[error](nil))
 			Expect(t, len(ids), Be(100))
 		})
+
+		t.Run("Table by name", func(t *testing.T) {
+			tx := db.Begin()
+
+			tUser, err := db.TableByName(context.Background(), tx, "User")
+			Expect(t, err, Be[error](nil))
+			Expect(t, tUser.Schema().PrimaryKey(), Be(tableUser.Schema().PrimaryKey()))
+			Expect(t, tUser.Schema().IndexSchema("name").PrimaryKey(), Be(tableUser.Schema().IndexSchema("name").PrimaryKey()))
+
+			key, _, err := tUser.Insert(context.Background(), database.DocumentFrom(map[string]any{
+				"name": "from map",
+			}))
+			Expect(t, err, Be[error](nil))
+
+			d, err := tUser.Get(context.Background(), key)
+			Expect(t, err, Be[error](nil))
+
+			usr := &User{}
+			err = d.Unmarshal(usr)
+			Expect(t, err, Be[error](nil))
+			Expect(t, usr.PrimaryKey(), Be(key.Values()[0].(uint64)))
+			Expect(t, usr.Name, Be("from map"))
+
+			err = tx.Commit()
+			Expect(t, err, Be[error](nil))
+
+			t.Run("unknown table", func(t *testing.T) {
+				tx := db.Begin(database.TransactionReadOnly())
+				defer tx.Rollback()
+
+				_, err := db.TableByName(context.Background(), tx, "Unknown")
+				_, ok := dberr.IsNotFoundError(err)
+				Expect(t, ok, Be(true))
+			})
+
+			t.Run("catalog with name index in namespace 0 refused", func(t *testing.T) {
+				s := testutil.NewStore(t)
+
+				// layout before, the name index of tables in namespace of table schemas.
+				sess := s.NewBatchSession("test")
+				raw, err := msgp.Marshal(map[string]any{"id": uint64(1), "name": "User"})
+				Expect(t, err, Be[error](nil))
+				Expect(t, tree.New(sess, 0).Put(tree.NewKey(uint64(1)), raw), Be[error](nil))
+				Expect(t, tree.New(sess, 0).Put(tree.NewKey("User", tree.NewKey(uint64(1)).Bytes()), nil), Be[error](nil))
+				Expect(t, sess.Commit(), Be[error](nil))
+
+				legacy := database.New("test", s, testutil.NewIDGen(t))
+
+				err = legacy.View(context.Background(), func(tx database.Transaction) error {
+					_, err := legacy.TableByName(context.Background(), tx, "User")
+					return err
+				})
+				Expect(t, err, Not(Be[error](nil)))
+				_, ok := dberr.IsNotFoundError(err)
+				Expect(t, ok, Be(false))
+
+				err = legacy.Update(context.Background(), func(tx database.Transaction) error {
+					_, err := legacy.Table(context.Background(), tx, &User{})
+					return err
+				})
+				Expect(t, err, Not(Be[error](nil)))
+			})
+		})
+	})
+
+}
+
+func TestDatabaseTableOperations(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	insertUsers := func(t *testing.T, n int) {
+		tx := db.Begin()
+		tableUser, err := db.Table(context.Background(), tx, &User{})
+		Expect(t, err, Be[error](nil))
+
+		for i := 0; i < n; i++ {
+			_, _, err := tableUser.Insert(context.Background(), database.DocumentFrom(&User{
+				Name: fmt.Sprintf("test - %d", i),
+			}))
+			Expect(t, err, Be[error](nil))
+		}
+
+		err = tx.Commit()
+		Expect(t, err, Be[error](nil))
+	}
+
+	countOf := func(t *testing.T, name string) int {
+		tx := db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		tbl, err := db.TableByName(context.Background(), tx, name)
+		Expect(t, err, Be[error](nil))
+
+		n := 0
+		err = tbl.Range(context.Background(), nil, false, func(key tree.Key, d database.Document) error {
+			n++
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+		return n
+	}
+
+	insertUsers(t, 10)
+
+	t.Run("TruncateTable rolled back", func(t *testing.T) {
+		tx := db.Begin()
+		err := db.TruncateTable(context.Background(), tx, "User")
+		Expect(t, err, Be[error](nil))
+		Expect(t, tx.Rollback(), Be[error](nil))
+
+		Expect(t, countOf(t, "User"), Be(10))
+	})
+
+	t.Run("TruncateTable with context canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		tx := db.Begin()
+		defer tx.Rollback()
+
+		err := db.TruncateTable(ctx, tx, "User")
+		Expect(t, errors.Is(err, context.Canceled), Be(true))
+	})
+
+	t.Run("TruncateTable", func(t *testing.T) {
+		tx := db.Begin()
+		err := db.TruncateTable(context.Background(), tx, "User")
+		Expect(t, err, Be[error](nil))
+		err = tx.Commit()
+		Expect(t, err, Be[error](nil))
+
+		Expect(t, countOf(t, "User"), Be(0))
+	})
+
+	t.Run("RenameTable", func(t *testing.T) {
+		insertUsers(t, 3)
+
+		tx := db.Begin()
+		err := db.RenameTable(context.Background(), tx, "User", "Member")
+		Expect(t, err, Be[error](nil))
+		err = tx.Commit()
+		Expect(t, err, Be[error](nil))
+
+		Expect(t, countOf(t, "Member"), Be(3))
+
+		t.Run("old name is gone", func(t *testing.T) {
+			tx := db.Begin(database.TransactionReadOnly())
+			defer tx.Rollback()
+
+			_, err := db.TableByName(context.Background(), tx, "User")
+			_, ok := dberr.IsNotFoundError(err)
+			Expect(t, ok, Be(true))
+		})
+
+		t.Run("could not rename to exists name", func(t *testing.T) {
+			insertUsers(t, 1)
+
+			tx := db.Begin()
+			defer tx.Rollback()
+
+			err := db.RenameTable(context.Background(), tx, "Member", "User")
+			_, ok := dberr.IsConflictError(err)
+			Expect(t, ok, Be(true))
+		})
+	})
+
+	t.Run("DropTable", func(t *testing.T) {
+		tx := db.Begin()
+		err := db.DropTable(context.Background(), tx, "Member")
+		Expect(t, err, Be[error](nil))
+		err = tx.Commit()
+		Expect(t, err, Be[error](nil))
+
+		tx = db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		_, err = db.TableByName(context.Background(), tx, "Member")
+		_, ok := dberr.IsNotFoundError(err)
+		Expect(t, ok, Be(true))
+	})
+
+	t.Run("rollback keeps table", func(t *testing.T) {
+		tx := db.Begin()
+		err := db.DropTable(context.Background(), tx, "User")
+		Expect(t, err, Be[error](nil))
+		err = tx.Rollback()
+		Expect(t, err, Be[error](nil))
+
+		Expect(t, countOf(t, "User"), Be(1))
+	})
+}
+
+func TestCatalogSharedStore(t *testing.T) {
+	s := testutil.NewStore(t)
+	idgen := testutil.NewIDGen(t)
+
+	db1 := database.New("test", s, idgen)
+	db2 := database.New("test", s, idgen)
+
+	tableIDOf := func(t *testing.T, db database.Database) uint64 {
+		tx := db.Begin()
+		tbl, err := db.Table(context.Background(), tx, &User{})
+		Expect(t, err, Be[error](nil))
+		err = tx.Commit()
+		Expect(t, err, Be[error](nil))
+		return tbl.Schema().PrimaryKey()
+	}
+
+	tableID := tableIDOf(t, db1)
+	Expect(t, tableIDOf(t, db2), Be(tableID))
+
+	t.Run("tables synced by databases concurrently", func(t *testing.T) {
+		workers := 16
+
+		wg := &sync.WaitGroup{}
+		start := make(chan struct{})
+		errs := make(chan error, workers)
+		tableIDs := make(chan uint64, workers)
+
+		for i := 0; i < workers; i++ {
+			db := database.New("test", s, idgen)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				<-start
+
+				tx := db.Begin()
+				tbl, err := db.Table(context.Background(), tx, &Article{})
+				if err != nil {
+					_ = tx.Rollback()
+					errs <- err
+					return
+				}
+				if err := tx.Commit(); err != nil {
+					errs <- err
+					return
+				}
+				tableIDs <- tbl.Schema().PrimaryKey()
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+		close(errs)
+		close(tableIDs)
+
+		for err := range errs {
+			Expect(t, err, Be[error](nil))
+		}
+
+		articleTableID := uint64(0)
+		for id := range tableIDs {
+			if articleTableID == 0 {
+				articleTableID = id
+			}
+			Expect(t, id, Be(articleTableID))
+		}
+	})
+
+	t.Run("schemas should be of the catalog visible to transaction", func(t *testing.T) {
+		tx := db1.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		tableIDIn := func(t *testing.T) uint64 {
+			tbl, err := db1.Table(context.Background(), tx, &User{})
+			Expect(t, err, Be[error](nil))
+			return tbl.Schema().PrimaryKey()
+		}
+
+		Expect(t, tableIDIn(t), Be(tableID))
+
+		wtx := db2.Begin()
+		err := db2.DropTable(context.Background(), wtx, "User")
+		Expect(t, err, Be[error](nil))
+		err = wtx.Commit()
+		Expect(t, err, Be[error](nil))
+
+		recreatedTableID := tableIDOf(t, db2)
+		Expect(t, recreatedTableID, Not(Be(tableID)))
+
+		Expect(t, tableIDIn(t), Be(tableID))
+		Expect(t, tableIDOf(t, db1), Be(recreatedTableID))
+
+		lastSequence := func() uint64 {
+			r := s.NewSnapshotSession("test")
+			defer r.Close()
+			return r.Sequence()
+		}
+
+		// tx older than tables cached never syncs them, which commits.
+		seq := lastSequence()
+		Expect(t, tableIDIn(t), Be(tableID))
+		Expect(t, tableIDIn(t), Be(tableID))
+		Expect(t, lastSequence(), Be(seq))
+
+		tableID = recreatedTableID
+	})
+
+	t.Run("When table dropped by another database", func(t *testing.T) {
+		tx := db1.Begin()
+		err := db1.DropTable(context.Background(), tx, "User")
+		Expect(t, err, Be[error](nil))
+		err = tx.Commit()
+		Expect(t, err, Be[error](nil))
+
+		recreatedTableID := tableIDOf(t, db1)
+		Expect(t, recreatedTableID, Not(Be(tableID)))
+
+		t.Run("cached schema should be refreshed", func(t *testing.T) {
+			Expect(t, tableIDOf(t, db2), Be(recreatedTableID))
+		})
+	})
+}
+
+type Article struct {
+	schema.PKey
+	Title string   `msgp:"title" json:"title"`
+	Tags  []string `msgp:"tags" json:"tags"`
+}
+
+func (Article) Indexes() map[string]schema.IndexType {
+	return map[string]schema.IndexType{
+		"tags[]": schema.Index,
+	}
+}
+
+func TestMultikeyIndex(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	articles := []*Article{
+		{Title: "a", Tags: []string{"go", "db"}},
+		{Title: "b", Tags: []string{"db"}},
+		{Title: "c", Tags: []string{"go", "go"}},
+		{Title: "d"},
+	}
+
+	tx := db.Begin()
+	tableArticle, err := db.Table(context.Background(), tx, &Article{})
+	Expect(t, err, Be[error](nil))
+	Expect(t, tableArticle.Schema().IndexSchema("tags[]").IsMultikey(), Be(true))
+
+	for i := range articles {
+		_, _, err := tableArticle.Insert(context.Background(), database.DocumentFrom(articles[i]))
+		Expect(t, err, Be[error](nil))
+	}
+	err = tx.Commit()
+	Expect(t, err, Be[error](nil))
+
+	titlesTagged := func(t *testing.T, tag string) []string {
+		tx := db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		tableArticle, err := db.Table(context.Background(), tx, &Article{})
+		Expect(t, err, Be[error](nil))
+		idx, err := db.Index(context.Background(), tx, &Article{}, "tags[]")
+		Expect(t, err, Be[error](nil))
+
+		titles := make([]string, 0)
+		err = idx.Range(context.Background(), tree.NewRange(tree.NewKey(tag), tree.NewKey(tag), false), false, func(key tree.Key) error {
+			d, err := tableArticle.Get(context.Background(), key)
+			if err != nil {
+				return err
+			}
+			a := &Article{}
+			if err := d.Unmarshal(a); err != nil {
+				return err
+			}
+			titles = append(titles, a.Title)
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+		return titles
+	}
+
+	Expect(t, titlesTagged(t, "go"), Equal([]string{"a", "c"}))
+	Expect(t, titlesTagged(t, "db"), Equal([]string{"a", "b"}))
+
+	t.Run("When replace and delete", func(t *testing.T) {
+		tx := db.Begin()
+		tableArticle, err := db.Table(context.Background(), tx, &Article{})
+		Expect(t, err, Be[error](nil))
+
+		a := articles[0]
+		a.Tags = []string{"db"}
+		err = tableArticle.Replace(context.Background(), tree.NewKey(a.PrimaryKey()), database.DocumentFrom(a))
+		Expect(t, err, Be[error](nil))
+
+		err = tableArticle.Delete(context.Background(), tree.NewKey(articles[2].PrimaryKey()))
+		Expect(t, err, Be[error](nil))
+
+		err = tx.Commit()
+		Expect(t, err, Be[error](nil))
+
+		Expect(t, titlesTagged(t, "go"), Equal([]string{}))
+		Expect(t, titlesTagged(t, "db"), Equal([]string{"a", "b"}))
+	})
+}
+
+type Task struct {
+	schema.PKey
+	Owner     string `msgp:"owner" json:"owner"`
+	Status    string `msgp:"status" json:"status"`
+	CreatedAt int64  `msgp:"createdAt" json:"createdAt"`
+}
+
+func (Task) Indexes() map[string]schema.IndexType {
+	return map[string]schema.IndexType{
+		"lower(owner)":         schema.Index,
+		"trunc_day(createdAt)": schema.Index,
+		"owner":                schema.Index,
+	}
+}
+
+func (Task) IndexConditions() map[string][]schema.IndexCondition {
+	return map[string][]schema.IndexCondition{
+		"owner": {
+			schema.Where("status", schema.OpEq, "pending"),
+		},
+	}
+}
+
+func TestPartialAndExpressionIndex(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	day := int64(1656633600) // 2022-07-01T00:00:00Z
+
+	tasks := []*Task{
+		{Owner: "Alice", Status: "pending", CreatedAt: day + 3600},
+		{Owner: "alice", Status: "done", CreatedAt: day + 7200},
+		{Owner: "Bob", Status: "pending", CreatedAt: day + 86400},
+	}
+
+	tx := db.Begin()
+	tableTask, err := db.Table(context.Background(), tx, &Task{})
+	Expect(t, err, Be[error](nil))
+
+	for i := range tasks {
+		_, _, err := tableTask.Insert(context.Background(), database.DocumentFrom(tasks[i]))
+		Expect(t, err, Be[error](nil))
+	}
+	err = tx.Commit()
+	Expect(t, err, Be[error](nil))
+
+	countOf := func(t *testing.T, indexName string, value any) int {
+		tx := db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		idx, err := db.Index(context.Background(), tx, &Task{}, indexName)
+		Expect(t, err, Be[error](nil))
+
+		n := 0
+		err = idx.Range(context.Background(), tree.NewRange(tree.NewKey(value), tree.NewKey(value), false), false, func(key tree.Key) error {
+			n++
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+		return n
+	}
+
+	t.Run("expression index could lookup by normalized value", func(t *testing.T) {
+		Expect(t, countOf(t, "lower(owner)", "ALICE"), Be(2))
+		Expect(t, countOf(t, "trunc_day(createdAt)", day+60), Be(2))
+		Expect(t, countOf(t, "trunc_day(createdAt)", day+86400), Be(1))
+	})
+
+	t.Run("partial index only contains matched documents", func(t *testing.T) {
+		Expect(t, countOf(t, "owner", "Alice"), Be(1))
+		Expect(t, countOf(t, "owner", "alice"), Be(0))
+		Expect(t, countOf(t, "owner", "Bob"), Be(1))
+
+		t.Run("When document not matched any more", func(t *testing.T) {
+			tx := db.Begin()
+			tableTask, err := db.Table(context.Background(), tx, &Task{})
+			Expect(t, err, Be[error](nil))
+
+			task := tasks[0]
+			task.Status = "done"
+			err = tableTask.Replace(context.Background(), tree.NewKey(task.PrimaryKey()), database.DocumentFrom(task))
+			Expect(t, err, Be[error](nil))
+			err = tx.Commit()
+			Expect(t, err, Be[error](nil))
+
+			Expect(t, countOf(t, "owner", "Alice"), Be(0))
+		})
+	})
+}
+
+func TestTransactionConflict(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	usr := &User{Name: "counter"}
+
+	tx := db.Begin()
+	tableUser, err := db.Table(context.Background(), tx, &User{})
+	Expect(t, err, Be[error](nil))
+	key, _, err := tableUser.Insert(context.Background(), database.DocumentFrom(usr))
+	Expect(t, err, Be[error](nil))
+	Expect(t, tx.Commit(), Be[error](nil))
+
+	rename := func(tx database.Transaction, name string) {
+		tableUser, err := db.Table(context.Background(), tx, &User{})
+		Expect(t, err, Be[error](nil))
+
+		d, err := tableUser.Get(context.Background(), key)
+		Expect(t, err, Be[error](nil))
+		u := &User{}
+		Expect(t, d.Unmarshal(u), Be[error](nil))
+
+		u.Name = name
+		err = tableUser.Replace(context.Background(), key, database.DocumentFrom(u))
+		Expect(t, err, Be[error](nil))
+	}
+
+	tx1 := db.Begin()
+	tx2 := db.Begin()
+
+	rename(tx1, "tx1")
+	rename(tx2, "tx2")
+
+	Expect(t, tx2.Commit(), Be[error](nil))
+
+	rolledBack := false
+	tx1.On(database.TransactionEventRollback, func() {
+		rolledBack = true
+	})
+
+	err = tx1.Commit()
+	Expect(t, dberr.IsRetryable(err), Be(true))
+	Expect(t, rolledBack, Be(true))
+}
+
+func TestDatabaseUpdate(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	var key tree.Key
+
+	err := db.Update(context.Background(), func(tx database.Transaction) error {
+		tableUser, err := db.Table(context.Background(), tx, &User{})
+		if err != nil {
+			return err
+		}
+		key, _, err = tableUser.Insert(context.Background(), database.DocumentFrom(&User{Name: "0"}))
+		return err
+	})
+	Expect(t, err, Be[error](nil))
+
+	rename := func(tx database.Transaction, name string) error {
+		tableUser, err := db.Table(context.Background(), tx, &User{})
+		if err != nil {
+			return err
+		}
+		d, err := tableUser.Get(context.Background(), key)
+		if err != nil {
+			return err
+		}
+		u := &User{}
+		if err := d.Unmarshal(u); err != nil {
+			return err
+		}
+		u.Name = name
+		return tableUser.Replace(context.Background(), key, database.DocumentFrom(u))
+	}
+
+	t.Run("retry when conflicted", func(t *testing.T) {
+		attempts := 0
+		committed := 0
+
+		err := db.Update(context.Background(), func(tx database.Transaction) error {
+			attempts++
+
+			tx.On(database.TransactionEventCommit, func() {
+				committed++
+			})
+
+			if err := rename(tx, "1"); err != nil {
+				return err
+			}
+
+			if attempts == 1 {
+				// changed by others before commit
+				return db.Update(context.Background(), func(tx database.Transaction) error {
+					return rename(tx, "2")
+				})
+			}
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+		Expect(t, attempts, Be(2))
+		Expect(t, committed, Be(1))
+
+		err = db.View(context.Background(), func(tx database.Transaction) error {
+			tableUser, err := db.Table(context.Background(), tx, &User{})
+			Expect(t, err, Be[error](nil))
+			d, err := tableUser.Get(context.Background(), key)
+			Expect(t, err, Be[error](nil))
+			u := &User{}
+			Expect(t, d.Unmarshal(u), Be[error](nil))
+			Expect(t, u.Name, Be("1"))
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+	})
+
+	t.Run("not retry when failed by others", func(t *testing.T) {
+		attempts := 0
+		errFailed := errors.New("failed")
+
+		err := db.Update(context.Background(), func(tx database.Transaction) error {
+			attempts++
+			return errFailed
+		})
+		Expect(t, err, Be(errFailed))
+		Expect(t, attempts, Be(1))
+	})
+
+	t.Run("stop when context canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := db.Update(ctx, func(tx database.Transaction) error {
+			return nil
+		})
+		Expect(t, err, Be(context.Canceled))
 	})
+}
 
+func TestTransactionSavepoint(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	ctx := context.Background()
+
+	tx := db.Begin()
+	tableUser, err := db.Table(ctx, tx, &User{})
+	Expect(t, err, Be[error](nil))
+
+	insert := func(name string) tree.Key {
+		key, _, err := tableUser.Insert(ctx, database.DocumentFrom(&User{Name: name}))
+		Expect(t, err, Be[error](nil))
+		return key
+	}
+
+	nameOf := func(tableUser database.Table, key tree.Key) (string, bool) {
+		d, err := tableUser.Get(ctx, key)
+		if err != nil {
+			return "", false
+		}
+		u := &User{}
+		Expect(t, d.Unmarshal(u), Be[error](nil))
+		return u.Name, true
+	}
+
+	k1 := insert("1")
+
+	Expect(t, tx.Savepoint("a"), Be[error](nil))
+
+	k2 := insert("2")
+	Expect(t, tableUser.Replace(ctx, k1, database.DocumentFrom(&User{Name: "1.1"})), Be[error](nil))
+
+	Expect(t, tx.Savepoint("b"), Be[error](nil))
+
+	k3 := insert("3")
+
+	t.Run("rollback to savepoint", func(t *testing.T) {
+		Expect(t, tx.RollbackTo("a"), Be[error](nil))
+
+		name, ok := nameOf(tableUser, k1)
+		Expect(t, ok, Be(true))
+		Expect(t, name, Be("1"))
+
+		_, ok = nameOf(tableUser, k2)
+		Expect(t, ok, Be(false))
+		_, ok = nameOf(tableUser, k3)
+		Expect(t, ok, Be(false))
+
+		t.Run("savepoints created after dropped", func(t *testing.T) {
+			err := tx.RollbackTo("b")
+			_, ok := dberr.IsNotFoundError(err)
+			Expect(t, ok, Be(true))
+		})
+	})
+
+	k4 := insert("4")
+
+	t.Run("release savepoint", func(t *testing.T) {
+		Expect(t, tx.Release("a"), Be[error](nil))
+
+		err := tx.RollbackTo("a")
+		_, ok := dberr.IsNotFoundError(err)
+		Expect(t, ok, Be(true))
+	})
+
+	Expect(t, tx.Commit(), Be[error](nil))
+
+	t.Run("changes kept committed", func(t *testing.T) {
+		tx := db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		tableUser, err := db.Table(ctx, tx, &User{})
+		Expect(t, err, Be[error](nil))
+
+		name, ok := nameOf(tableUser, k1)
+		Expect(t, ok, Be(true))
+		Expect(t, name, Be("1"))
+
+		name, ok = nameOf(tableUser, k4)
+		Expect(t, ok, Be(true))
+		Expect(t, name, Be("4"))
+
+		_, ok = nameOf(tableUser, k2)
+		Expect(t, ok, Be(false))
+
+		t.Run("savepoint of read-only transaction", func(t *testing.T) {
+			Expect(t, tx.Savepoint("a"), Not(Be[error](nil)))
+		})
+	})
+}
+
+func TestTransactionSavepointTruncate(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	ctx := context.Background()
+
+	tx := db.Begin()
+	defer tx.Rollback()
+
+	tableUser, err := db.Table(ctx, tx, &User{})
+	Expect(t, err, Be[error](nil))
+
+	k1, _, err := tableUser.Insert(ctx, database.DocumentFrom(&User{Name: "1"}))
+	Expect(t, err, Be[error](nil))
+
+	Expect(t, tx.Savepoint("sp"), Be[error](nil))
+
+	k2, _, err := tableUser.Insert(ctx, database.DocumentFrom(&User{Name: "2"}))
+	Expect(t, err, Be[error](nil))
+
+	Expect(t, db.TruncateTable(ctx, tx, "User"), Be[error](nil))
+	_, err = tableUser.Get(ctx, k1)
+	Expect(t, err, Not(Be[error](nil)))
+
+	t.Run("rollback to savepoint restores rows and indexes truncated", func(t *testing.T) {
+		Expect(t, tx.RollbackTo("sp"), Be[error](nil))
+
+		_, err := tableUser.Get(ctx, k1)
+		Expect(t, err, Be[error](nil))
+		_, err = tableUser.Get(ctx, k2)
+		Expect(t, err, Not(Be[error](nil)))
+
+		idx, err := db.Index(ctx, tx, &User{}, "name")
+		Expect(t, err, Be[error](nil))
+
+		ok, key, err := idx.Exists(ctx, []any{"1"})
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(true))
+		Expect(t, key.Values(), Equal(k1.Values()))
+
+		ok, _, err = idx.Exists(ctx, []any{"2"})
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(false))
+	})
+}
+
+type Note struct {
+	schema.PKey
+	Title string `msgp:"title" json:"title"`
+}
+
+type NoteWithIndex struct {
+	Note
+}
+
+func (NoteWithIndex) TableName() string {
+	return "Note"
+}
+
+func (NoteWithIndex) Indexes() map[string]schema.IndexType {
+	return map[string]schema.IndexType{
+		"title": schema.Index,
+	}
+}
+
+type NoteWithoutIndex struct {
+	Note
+}
+
+func (NoteWithoutIndex) TableName() string {
+	return "Note"
+}
+
+func TestIndexBackfill(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	ctx := context.Background()
+
+	tx := db.Begin()
+	tableNote, err := db.Table(ctx, tx, &Note{})
+	Expect(t, err, Be[error](nil))
+
+	keys := map[string]tree.Key{}
+	for _, title := range []string{"a", "b", "c"} {
+		key, _, err := tableNote.Insert(ctx, database.DocumentFrom(&Note{Title: title}))
+		Expect(t, err, Be[error](nil))
+		keys[title] = key
+	}
+	Expect(t, tx.Commit(), Be[error](nil))
+
+	t.Run("index added to existing table should be backfilled", func(t *testing.T) {
+		// sync table schema with the new index
+		tx := db.Begin()
+		_, err := db.Table(ctx, tx, &NoteWithIndex{})
+		Expect(t, err, Be[error](nil))
+		Expect(t, tx.Commit(), Be[error](nil))
+
+		tx = db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		idx, err := db.Index(ctx, tx, &NoteWithIndex{}, "title")
+		Expect(t, err, Be[error](nil))
+
+		for title, key := range keys {
+			found, dKey, err := idx.Exists(ctx, []any{title})
+			Expect(t, err, Be[error](nil))
+			Expect(t, found, Be(true))
+			Expect(t, dKey.Bytes(), Equal(key.Bytes()))
+		}
+	})
+
+	t.Run("index removed from table should be dropped", func(t *testing.T) {
+		tx := db.Begin(database.TransactionReadOnly())
+		tbl, err := db.TableByName(ctx, tx, "Note")
+		Expect(t, err, Be[error](nil))
+		ns := tree.Namespace(tbl.Schema().IndexSchemas["title"].ID)
+		Expect(t, tx.Rollback(), Be[error](nil))
+
+		tx = db.Begin()
+		_, err = db.Table(ctx, tx, &NoteWithoutIndex{})
+		Expect(t, err, Be[error](nil))
+		Expect(t, tx.Commit(), Be[error](nil))
+
+		tx = db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		tbl, err = db.TableByName(ctx, tx, "Note")
+		Expect(t, err, Be[error](nil))
+		Expect(t, len(tbl.Schema().IndexSchemas), Be(0))
+
+		n := 0
+		err = tree.New(tx.Session(), ns).Range(ctx, nil, false, func(key tree.Key, value []byte) error {
+			n++
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+		Expect(t, n, Be(0))
+	})
+
+	t.Run("range with context canceled", func(t *testing.T) {
+		tx := db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		tableNote, err := db.Table(ctx, tx, &Note{})
+		Expect(t, err, Be[error](nil))
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err = tableNote.Range(ctx, nil, false, func(key tree.Key, d database.Document) error {
+			return nil
+		})
+		Expect(t, errors.Is(err, context.Canceled), Be(true))
+	})
+}
+
+func TestTransactionSequence(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	ctx := context.Background()
+
+	var key tree.Key
+
+	put := func(name string) uint64 {
+		var seq uint64
+
+		err := db.Update(ctx, func(tx database.Transaction) error {
+			tx.On(database.TransactionEventCommit, func() {
+				seq = tx.Sequence()
+			})
+
+			tableUser, err := db.Table(ctx, tx, &User{})
+			if err != nil {
+				return err
+			}
+			if key == nil {
+				key, _, err = tableUser.Insert(ctx, database.DocumentFrom(&User{Name: name}))
+				return err
+			}
+			return tableUser.Replace(ctx, key, database.DocumentFrom(&User{Name: name}))
+		})
+		Expect(t, err, Be[error](nil))
+
+		return seq
+	}
+
+	nameAt := func(seq uint64) string {
+		var name string
+
+		err := db.ViewAt(ctx, seq, func(tx database.Transaction) error {
+			Expect(t, tx.Sequence(), Be(seq))
+
+			tableUser, err := db.Table(ctx, tx, &User{})
+			if err != nil {
+				return err
+			}
+			d, err := tableUser.Get(ctx, key)
+			if err != nil {
+				return err
+			}
+			u := &User{}
+			if err := d.Unmarshal(u); err != nil {
+				return err
+			}
+			name = u.Name
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+
+		return name
+	}
+
+	seq1 := put("1")
+	seq2 := put("2")
+
+	Expect(t, nameAt(seq1), Be("1"))
+	Expect(t, nameAt(seq2), Be("2"))
+
+	t.Run("read at sequence not committed", func(t *testing.T) {
+		_, err := db.BeginAt(seq2 + 100)
+		Expect(t, errors.Is(err, kv.ErrSequenceUnavailable), Be(true))
+	})
+}
+
+func TestTransactionSequenceWhileOthersFlushed(t *testing.T) {
+	s, err := kv.NewStore("pebble", kv.Options{
+		MaxBatchSize: 1024,
+		Extra: map[string]string{
+			"path": testutil.TempDir(t),
+		},
+	})
+	Expect(t, err, Be[error](nil))
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+
+	db := database.New("test", s, testutil.NewIDGen(t))
+
+	ctx := context.Background()
+
+	insert := func(tx database.Transaction, name string) {
+		tableUser, err := db.Table(ctx, tx, &User{})
+		Expect(t, err, Be[error](nil))
+		_, _, err = tableUser.Insert(ctx, database.DocumentFrom(&User{Name: name}))
+		Expect(t, err, Be[error](nil))
+	}
+
+	countAt := func(seq uint64) int {
+		tx, err := db.BeginAt(seq)
+		Expect(t, err, Be[error](nil))
+		defer tx.Rollback()
+
+		tableUser, err := db.Table(ctx, tx, &User{})
+		Expect(t, err, Be[error](nil))
+
+		n := 0
+		err = tableUser.Range(ctx, nil, false, func(key tree.Key, d database.Document) error {
+			n++
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+		return n
+	}
+
+	Expect(t, db.Update(ctx, func(tx database.Transaction) error {
+		insert(tx, "committed before")
+		return nil
+	}), Be[error](nil))
+
+	large := db.Begin()
+	defer large.Rollback()
+	for i := 0; i < 100; i++ {
+		insert(large, fmt.Sprintf("not committed - %d", i))
+	}
+
+	tx := db.Begin()
+	insert(tx, "committed while others flushed")
+	Expect(t, tx.Commit(), Be[error](nil))
+
+	Expect(t, countAt(tx.Sequence()), Be(2))
+}
+
+func TestTransactionHooks(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	ctx := context.Background()
+
+	exists := func(key tree.Key) bool {
+		tx := db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		tableUser, err := db.Table(ctx, tx, &User{})
+		Expect(t, err, Be[error](nil))
+
+		_, err = tableUser.Get(ctx, key)
+		return err == nil
+	}
+
+	t.Run("before commit hook writes in transaction", func(t *testing.T) {
+		tx := db.Begin()
+		tableUser, err := db.Table(ctx, tx, &User{})
+		Expect(t, err, Be[error](nil))
+
+		var key tree.Key
+
+		tx.Hook(database.TransactionEventBeforeCommit, func() error {
+			k, _, err := tableUser.Insert(ctx, database.DocumentFrom(&User{Name: "outbox"}))
+			key = k
+			return err
+		})
+
+		Expect(t, tx.Commit(), Be[error](nil))
+		Expect(t, exists(key), Be(true))
+	})
+
+	t.Run("before commit hook failed", func(t *testing.T) {
+		tx := db.Begin()
+		tableUser, err := db.Table(ctx, tx, &User{})
+		Expect(t, err, Be[error](nil))
+
+		key, _, err := tableUser.Insert(ctx, database.DocumentFrom(&User{Name: "aborted"}))
+		Expect(t, err, Be[error](nil))
+
+		errCheck := errors.New("check failed")
+		committed, rolledBack := false, false
+
+		tx.Hook(database.TransactionEventBeforeCommit, func() error {
+			return errCheck
+		})
+		tx.On(database.TransactionEventCommit, func() {
+			committed = true
+		})
+		tx.On(database.TransactionEventRollback, func() {
+			rolledBack = true
+		})
+
+		err = tx.Commit()
+		Expect(t, errors.Is(err, errCheck), Be(true))
+		Expect(t, committed, Be(false))
+		Expect(t, rolledBack, Be(true))
+		Expect(t, exists(key), Be(false))
+	})
+
+	t.Run("after commit hook failed", func(t *testing.T) {
+		tx := db.Begin()
+		tableUser, err := db.Table(ctx, tx, &User{})
+		Expect(t, err, Be[error](nil))
+
+		key, _, err := tableUser.Insert(ctx, database.DocumentFrom(&User{Name: "committed"}))
+		Expect(t, err, Be[error](nil))
+
+		called := false
+
+		tx.Hook(database.TransactionEventCommit, func() error {
+			called = true
+			return nil
+		})
+		tx.Hook(database.TransactionEventCommit, func() error {
+			return kv.ErrConflict
+		})
+
+		err = tx.Commit()
+		_, ok := dberr.IsAfterCommitError(err)
+		Expect(t, ok, Be(true))
+		Expect(t, errors.Is(err, kv.ErrConflict), Be(true))
+		Expect(t, dberr.IsRetryable(err), Be(false))
+
+		Expect(t, called, Be(true))
+		Expect(t, exists(key), Be(true))
+	})
+
+	t.Run("after commit hooks failed", func(t *testing.T) {
+		tx := db.Begin()
+		tableUser, err := db.Table(ctx, tx, &User{})
+		Expect(t, err, Be[error](nil))
+
+		_, _, err = tableUser.Insert(ctx, database.DocumentFrom(&User{Name: "committed with hooks failed"}))
+		Expect(t, err, Be[error](nil))
+
+		tx.Hook(database.TransactionEventCommit, func() error {
+			return &dberr.NotFoundError{Name: "hook"}
+		})
+		tx.Hook(database.TransactionEventCommit, func() error {
+			return kv.ErrConflict
+		})
+
+		err = tx.Commit()
+		_, ok := dberr.IsAfterCommitError(err)
+		Expect(t, ok, Be(true))
+		Expect(t, errors.Is(err, kv.ErrConflict), Be(true))
+
+		notFound := &dberr.NotFoundError{}
+		Expect(t, errors.As(err, &notFound), Be(true))
+		Expect(t, notFound.Name, Be("hook"))
+	})
+}
+
+type Counter struct {
+	schema.PKey
+	N int64 `msgp:"n" json:"n"`
+}
+
+func TestTableLock(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	ctx := context.Background()
+
+	insert := func() tree.Key {
+		var key tree.Key
+		err := db.Update(ctx, func(tx database.Transaction) error {
+			tableCounter, err := db.Table(ctx, tx, &Counter{})
+			if err != nil {
+				return err
+			}
+			key, _, err = tableCounter.Insert(ctx, database.DocumentFrom(&Counter{}))
+			return err
+		})
+		Expect(t, err, Be[error](nil))
+		return key
+	}
+
+	t.Run("read-modify-write with locks", func(t *testing.T) {
+		key := insert()
+
+		workers, times := 4, 10
+		attempts := int64(0)
+
+		incr := func() error {
+			return db.Update(ctx, func(tx database.Transaction) error {
+				atomic.AddInt64(&attempts, 1)
+
+				tableCounter, err := db.Table(ctx, tx, &Counter{})
+				if err != nil {
+					return err
+				}
+				if err := tableCounter.Lock(ctx, key); err != nil {
+					return err
+				}
+				d, err := tableCounter.Get(ctx, key)
+				if err != nil {
+					return err
+				}
+				c := &Counter{}
+				if err := d.Unmarshal(c); err != nil {
+					return err
+				}
+				c.N++
+				return tableCounter.Replace(ctx, key, database.DocumentFrom(c))
+			})
+		}
+
+		wg := &sync.WaitGroup{}
+		errs := make(chan error, workers)
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < times; j++ {
+					if err := incr(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			Expect(t, err, Be[error](nil))
+		}
+
+		tx := db.Begin(database.TransactionReadOnly())
+		defer tx.Rollback()
+
+		tableCounter, err := db.Table(ctx, tx, &Counter{})
+		Expect(t, err, Be[error](nil))
+		d, err := tableCounter.Get(ctx, key)
+		Expect(t, err, Be[error](nil))
+		c := &Counter{}
+		Expect(t, d.Unmarshal(c), Be[error](nil))
+
+		Expect(t, c.N, Be(int64(workers*times)))
+
+		t.Run("no conflicts between transactions locked", func(t *testing.T) {
+			Expect(t, atomic.LoadInt64(&attempts), Be(int64(workers*times)))
+		})
+	})
+
+	lock := func(tx database.Transaction, ctx context.Context, key tree.Key) error {
+		tableCounter, err := db.Table(ctx, tx, &Counter{})
+		if err != nil {
+			return err
+		}
+		return tableCounter.Lock(ctx, key)
+	}
+
+	t.Run("deadlock", func(t *testing.T) {
+		a, b := insert(), insert()
+
+		tx1 := db.Begin()
+		tx2 := db.Begin()
+
+		Expect(t, lock(tx1, ctx, a), Be[error](nil))
+		Expect(t, lock(tx2, ctx, b), Be[error](nil))
+
+		type result struct {
+			tx  database.Transaction
+			err error
+		}
+
+		results := make(chan result, 2)
+		go func() {
+			results <- result{tx: tx1, err: lock(tx1, ctx, b)}
+		}()
+		go func() {
+			results <- result{tx: tx2, err: lock(tx2, ctx, a)}
+		}()
+
+		// one of them chosen as victim
+		victim := <-results
+		Expect(t, errors.Is(victim.err, kv.ErrDeadlock), Be(true))
+		Expect(t, dberr.IsRetryable(victim.err), Be(true))
+		Expect(t, victim.tx.Rollback(), Be[error](nil))
+
+		// the other one locked once victim released
+		survivor := <-results
+		Expect(t, survivor.err, Be[error](nil))
+		Expect(t, survivor.tx.Commit(), Be[error](nil))
+	})
+
+	t.Run("lock timeout", func(t *testing.T) {
+		key := insert()
+
+		tx1 := db.Begin()
+		defer tx1.Rollback()
+		Expect(t, lock(tx1, ctx, key), Be[error](nil))
+
+		t.Run("reentrant", func(t *testing.T) {
+			Expect(t, lock(tx1, ctx, key), Be[error](nil))
+		})
+
+		tx2 := db.Begin()
+		defer tx2.Rollback()
+
+		timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+
+		err := lock(tx2, timeout, key)
+		Expect(t, errors.Is(err, context.DeadlineExceeded), Be(true))
+	})
+}
+
+func TestTransactionDurability(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	ctx := context.Background()
+
+	for _, d := range []kv.Durability{kv.DurabilityNoSync, kv.DurabilityGroupCommit} {
+		t.Run(string(d), func(t *testing.T) {
+			tx := db.Begin(database.TransactionDurability(d))
+
+			tableUser, err := db.Table(ctx, tx, &User{})
+			Expect(t, err, Be[error](nil))
+
+			key, _, err := tableUser.Insert(ctx, database.DocumentFrom(&User{Name: string(d)}))
+			Expect(t, err, Be[error](nil))
+			Expect(t, tx.Commit(), Be[error](nil))
+			Expect(t, db.Sync(), Be[error](nil))
+
+			err = db.View(ctx, func(tx database.Transaction) error {
+				tableUser, err := db.Table(ctx, tx, &User{})
+				if err != nil {
+					return err
+				}
+				_, err = tableUser.Get(ctx, key)
+				return err
+			})
+			Expect(t, err, Be[error](nil))
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db := testutil.NewDatabase(t, "test")
+
+	tx := db.Begin()
+	tableUser, err := db.Table(context.Background(), tx, &User{})
+	Expect(t, err, Be[error](nil))
+	for i := 0; i < 300; i++ {
+		_, _, err := tableUser.Insert(context.Background(), database.DocumentFrom(&User{
+			Name: fmt.Sprintf("test - %d", i),
+		}))
+		Expect(t, err, Be[error](nil))
+	}
+	Expect(t, tx.Commit(), Be[error](nil))
+
+	buf := bytes.NewBuffer(nil)
+	Expect(t, db.Backup(context.Background(), buf), Be[error](nil))
+	backup := buf.Bytes()
+
+	t.Run("restore into empty store", func(t *testing.T) {
+		restored := testutil.NewDatabase(t, "test")
+		Expect(t, restored.Restore(context.Background(), bytes.NewReader(backup)), Be[error](nil))
+
+		err := restored.View(context.Background(), func(tx database.Transaction) error {
+			tbl, err := restored.Table(context.Background(), tx, &User{})
+			Expect(t, err, Be[error](nil))
+			Expect(t, tbl.Schema().PrimaryKey(), Be(tableUser.Schema().PrimaryKey()))
+
+			n := 0
+			err = tbl.Range(context.Background(), nil, false, func(key tree.Key, d database.Document) error {
+				n++
+				return nil
+			})
+			Expect(t, err, Be[error](nil))
+			Expect(t, n, Be(300))
+
+			idx, err := restored.Index(context.Background(), tx, &User{}, "name")
+			Expect(t, err, Be[error](nil))
+			ok, _, err := idx.Exists(context.Background(), []any{"test - 7"})
+			Expect(t, err, Be[error](nil))
+			Expect(t, ok, Be(true))
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+
+		t.Run("restore again should fail", func(t *testing.T) {
+			Expect(t, restored.Restore(context.Background(), bytes.NewReader(backup)), Not(Be[error](nil)))
+		})
+	})
+
+	t.Run("restore incomplete backup should fail", func(t *testing.T) {
+		restored := testutil.NewDatabase(t, "test")
+		Expect(t, restored.Restore(context.Background(), bytes.NewReader(backup[:len(backup)/2])), Not(Be[error](nil)))
+
+		err := restored.View(context.Background(), func(tx database.Transaction) error {
+			_, err := restored.TableByName(context.Background(), tx, "User")
+			_, ok := dberr.IsNotFoundError(err)
+			Expect(t, ok, Be(true))
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+	})
+
+	t.Run("restore unsupported version should fail", func(t *testing.T) {
+		header, err := msgp.Marshal(map[string]any{"format": "kiwidb.backup", "version": 2})
+		Expect(t, err, Be[error](nil))
+
+		restored := testutil.NewDatabase(t, "test")
+		Expect(t, restored.Restore(context.Background(), bytes.NewReader(header)), Not(Be[error](nil)))
+	})
+
+	t.Run("migrate store created with legacy comparer", func(t *testing.T) {
+		dir := testutil.TempDir(t)
+
+		openStore := func(extra map[string]string) (kv.Store, error) {
+			extra[pebble.ExtraPath] = dir
+			return kv.NewStore("pebble", kv.Options{Extra: extra})
+		}
+
+		s, err := openStore(map[string]string{pebble.ExtraComparer: pebble.LegacyComparerName})
+		Expect(t, err, Be[error](nil))
+
+		legacy := database.New("test", s, testutil.NewIDGen(t))
+		err = legacy.Update(context.Background(), func(tx database.Transaction) error {
+			tbl, err := legacy.Table(context.Background(), tx, &User{})
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 10; i++ {
+				if _, _, err := tbl.Insert(context.Background(), database.DocumentFrom(&User{
+					Name: fmt.Sprintf("test - %d", i),
+				})); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+
+		buf := bytes.NewBuffer(nil)
+		Expect(t, legacy.Backup(context.Background(), buf), Be[error](nil))
+		Expect(t, s.Shutdown(context.Background()), Be[error](nil))
+
+		t.Run("refused by default comparer", func(t *testing.T) {
+			_, err := openStore(map[string]string{})
+			Expect(t, errors.Is(err, pebble.ErrIncompatibleComparer), Be(true))
+		})
+
+		restored := testutil.NewDatabase(t, "test")
+		Expect(t, restored.Restore(context.Background(), buf), Be[error](nil))
+
+		err = restored.View(context.Background(), func(tx database.Transaction) error {
+			idx, err := restored.Index(context.Background(), tx, &User{}, "name")
+			Expect(t, err, Be[error](nil))
+			ok, _, err := idx.Exists(context.Background(), []any{"test - 7"})
+			Expect(t, err, Be[error](nil))
+			Expect(t, ok, Be(true))
+			return nil
+		})
+		Expect(t, err, Be[error](nil))
+	})
 }
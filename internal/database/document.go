@@ -39,6 +39,11 @@ func (d *doc) SetPrimaryKey(id uint64) {
 		d.raw = nil
 		return
 	}
+	if m, ok := d.value.(map[string]any); ok {
+		m["id"] = id
+		d.raw = nil
+		return
+	}
 	raw, err := d.Marshal()
 	if err != nil {
 		return
@@ -60,7 +65,13 @@ func (d *doc) PrimaryKey() uint64 {
 	if err != nil {
 		return 0
 	}
-	return id.Value().(uint64)
+	switch x := id.Value().(type) {
+	case uint64:
+		return x
+	case schema.SFID:
+		return uint64(x)
+	}
+	return 0
 }
 
 func (d *doc) Field(keyPath ...any) (Document, error) {
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/octohelm/kiwidb/internal/tree"
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
 	"github.com/octohelm/kiwidb/pkg/kv"
 	"github.com/octohelm/kiwidb/pkg/schema"
 	"github.com/pkg/errors"
@@ -14,6 +15,9 @@ type Index interface {
 	Exists(ctx context.Context, values []any) (bool, tree.Key, error)
 	Delete(ctx context.Context, values []any, key tree.Key) error
 	Range(ctx context.Context, rng tree.Range, reverse bool, fn func(key tree.Key) error) error
+	// SkipScan iterates keys of documents which values of paths after the first skip ones are in range,
+	// so composite index could be used without values of leading paths.
+	SkipScan(ctx context.Context, skip int, rng tree.Range, fn func(key tree.Key) error) error
 	Truncate(ctx context.Context) error
 }
 
@@ -48,16 +52,17 @@ func (idx *index) Exists(ctx context.Context, vs []any) (bool, tree.Key, error)
 		return false, nil, errors.New("cannot index without enough values")
 	}
 
-	seek := tree.NewNamespacedKey(idx.tree.Namespace, vs...)
+	vs, err := idx.normalize(vs)
+	if err != nil {
+		return false, nil, err
+	}
 
 	var found bool
 	var dKey tree.Key
 
-	rng := tree.NewRange(seek, seek, false)
-
-	err := idx.tree.Range(rng, false, func(k tree.Key, _ []byte) error {
+	err = idx.tree.Prefix(ctx, tree.NewKey(vs...), false, func(k tree.Key, _ []byte) error {
 		values := k.Values()
-		if len(values) != 2 {
+		if len(values) != len(idx.schema.Paths)+1 {
 			return errors.Errorf("invalid index value %q", k)
 		}
 		if keyBytes, ok := values[len(values)-1].([]byte); ok {
@@ -85,14 +90,52 @@ func (idx *index) Delete(ctx context.Context, vs []any, key tree.Key) error {
 	return err
 }
 
+// Range iterates keys of documents in range,
+// values of range are normalized by exprs of index, so lookups could use raw values.
 func (idx *index) Range(ctx context.Context, rng tree.Range, reverse bool, fn func(key tree.Key) error) error {
+	if rng != nil && len(idx.schema.Exprs) > 0 {
+		min, err := idx.normalizeKey(rng.Min())
+		if err != nil {
+			return err
+		}
+		max, err := idx.normalizeKey(rng.Max())
+		if err != nil {
+			return err
+		}
+		rng = tree.NewRange(min, max, rng.Exclusive())
+	}
+
 	return idx.iterateOnRange(ctx, rng, reverse, func(itmKey, key tree.Key) error {
 		return fn(key)
 	})
 }
 
+// SkipScan iterates keys of documents which values of paths after the first skip ones are in range,
+// values of range are normalized by exprs of these paths.
+func (idx *index) SkipScan(ctx context.Context, skip int, rng tree.Range, fn func(key tree.Key) error) error {
+	if skip < 0 || skip >= len(idx.schema.Paths) {
+		return errors.Errorf("cannot skip %d of %d paths of index", skip, len(idx.schema.Paths))
+	}
+
+	if rng != nil && len(idx.schema.Exprs) > 0 {
+		min, err := idx.normalizeKeyFrom(skip, rng.Min())
+		if err != nil {
+			return err
+		}
+		max, err := idx.normalizeKeyFrom(skip, rng.Max())
+		if err != nil {
+			return err
+		}
+		rng = tree.NewRange(min, max, rng.Exclusive())
+	}
+
+	return idx.tree.SkipScan(ctx, skip, rng, idx.iterator(ctx, func(itmKey tree.Key, key tree.Key) error {
+		return fn(key)
+	}))
+}
+
 func (idx *index) iterateOnRange(ctx context.Context, rng tree.Range, reverse bool, fn func(itmKey tree.Key, key tree.Key) error) error {
-	return idx.tree.Range(rng, reverse, idx.iterator(ctx, fn))
+	return idx.tree.Range(ctx, rng, reverse, idx.iterator(ctx, fn))
 }
 
 func (idx *index) iterator(ctx context.Context, fn func(itmKey tree.Key, key tree.Key) error) func(k tree.Key, d []byte) error {
@@ -103,6 +146,158 @@ func (idx *index) iterator(ctx context.Context, fn func(itmKey tree.Key, key tre
 	}
 }
 
+// normalize applies exprs of index on values for lookups.
+func (idx *index) normalize(vs []any) ([]any, error) {
+	return idx.normalizeFrom(0, vs)
+}
+
+// normalizeFrom applies exprs of index on values of paths from offset.
+func (idx *index) normalizeFrom(offset int, vs []any) ([]any, error) {
+	if len(idx.schema.Exprs) == 0 {
+		return vs, nil
+	}
+
+	normalized := make([]any, len(vs))
+	for i := range vs {
+		v, err := idx.schema.Expr(offset + i).Apply(vs[i])
+		if err != nil {
+			return nil, err
+		}
+		normalized[i] = v
+	}
+	return normalized, nil
+}
+
+func (idx *index) normalizeKey(k tree.Key) (tree.Key, error) {
+	return idx.normalizeKeyFrom(0, k)
+}
+
+func (idx *index) normalizeKeyFrom(offset int, k tree.Key) (tree.Key, error) {
+	if k == nil {
+		return nil, nil
+	}
+	values, err := idx.normalizeFrom(offset, k.Values())
+	if err != nil {
+		return nil, err
+	}
+	return tree.NewKey(values...), nil
+}
+
 func (idx *index) Truncate(ctx context.Context) error {
-	return idx.tree.Truncate()
+	return idx.tree.Truncate(ctx)
+}
+
+// indexValuesOf returns values of every index entry of the document.
+// Multikey index emits one entry for each element of the array,
+// and the composite one emits the cartesian product of values of its paths.
+// Nothing returned when document not matches conditions of partial index.
+func indexValuesOf(s *schema.IndexSchema, d Document) ([][]any, error) {
+	entries := [][]any{{}}
+
+	matched, err := matchIndexConditions(s, d)
+	if err != nil || !matched {
+		return nil, err
+	}
+
+	for i := range s.Paths {
+		values, err := keyPathValues(d, s.Paths[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if expr := s.Expr(i); expr != "" {
+			for j := range values {
+				if values[j] == nil {
+					continue
+				}
+				var v any
+				if err := msgp.Unmarshal(values[j].(msgp.Encoded), &v); err != nil {
+					return nil, err
+				}
+				computed, err := expr.Apply(v)
+				if err != nil {
+					return nil, err
+				}
+				values[j] = computed
+			}
+		}
+
+		next := make([][]any, 0, len(entries)*len(values))
+		for _, e := range entries {
+			for _, v := range values {
+				entry := make([]any, len(e), len(e)+1)
+				copy(entry, e)
+				next = append(next, append(entry, v))
+			}
+		}
+		entries = next
+	}
+
+	return entries, nil
+}
+
+func keyPathValues(d Document, p schema.KeyPath) ([]any, error) {
+	path, rest, each := p.Each()
+
+	v, err := d.Field(path...)
+	if err != nil {
+		// missing field indexed as null
+		if errors.Is(err, msgp.ErrKeyPathNotExists) {
+			return []any{nil}, nil
+		}
+		return nil, err
+	}
+
+	if !each {
+		raw, err := v.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		return []any{msgp.Encoded(raw)}, nil
+	}
+
+	list, ok := v.Value().([]any)
+	if !ok {
+		// non array value treated as array with single element
+		return keyPathValues(v, rest)
+	}
+
+	values := make([]any, 0, len(list))
+	for i := range list {
+		vs, err := keyPathValues(DocumentFrom(list[i]), rest)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, vs...)
+	}
+	return values, nil
+}
+
+func matchIndexConditions(s *schema.IndexSchema, d Document) (bool, error) {
+	for _, c := range s.Where {
+		v, err := d.Field(c.Path...)
+		if err != nil {
+			if errors.Is(err, msgp.ErrKeyPathNotExists) {
+				return false, nil
+			}
+			return false, err
+		}
+		if c.Op == schema.OpExists {
+			continue
+		}
+
+		actual, err := v.Marshal()
+		if err != nil {
+			return false, err
+		}
+		expect, err := msgp.Marshal(c.Value)
+		if err != nil {
+			return false, err
+		}
+
+		if !c.Op.Match(msgp.Compare(actual, expect)) {
+			return false, nil
+		}
+	}
+	return true, nil
 }
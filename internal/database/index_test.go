@@ -2,6 +2,7 @@ package database_test
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	"github.com/octohelm/kiwidb/internal/database"
@@ -16,6 +17,9 @@ func TestIndex(t *testing.T) {
 	s := testutil.NewStore(t)
 
 	tx := database.NewTransaction("test", s, idgen)
+	t.Cleanup(func() {
+		_ = tx.Rollback()
+	})
 
 	t.Run("index name", func(t *testing.T) {
 		index := database.NewIndex(tx, &schema.IndexSchema{
@@ -70,4 +74,74 @@ func TestIndex(t *testing.T) {
 
 		})
 	})
+
+	t.Run("composite index", func(t *testing.T) {
+		index := database.NewIndex(tx, &schema.IndexSchema{
+			PKey:      schema.PKey{ID: 10},
+			IndexType: schema.Index,
+			Paths: []schema.KeyPath{
+				{"group"},
+				{"age"},
+			},
+		})
+
+		for i := 0; i < 10; i++ {
+			err := index.Set(context.Background(), []any{fmt.Sprintf("g%d", i%2), i}, tree.NewKey(i))
+			Expect(t, err, Be[error](nil))
+		}
+
+		t.Run("could check exists", func(t *testing.T) {
+			ok, key, err := index.Exists(context.Background(), []any{"g1", 3})
+			Expect(t, err, Be[error](nil))
+			Expect(t, ok, Be(true))
+			Expect(t, key.Values(), Equal(tree.NewKey(int32(3)).Values()))
+		})
+
+		t.Run("could range by prefix", func(t *testing.T) {
+			rng := tree.NewRange(tree.NewKey("g0"), tree.NewKey("g0"), false)
+			expectIndexRangeGot(t, index, rng, false, []int32{0, 2, 4, 6, 8})
+		})
+
+		t.Run("could range by prefix and range of last value", func(t *testing.T) {
+			rng := tree.NewRange(tree.NewKey("g1", 3), tree.NewKey("g1", 7), false)
+			expectIndexRangeGot(t, index, rng, false, []int32{3, 5, 7})
+		})
+
+		t.Run("could range by prefix and lower bound of last value", func(t *testing.T) {
+			rng := tree.NewRange(tree.NewKey("g1", 5), nil, false)
+			expectIndexRangeGot(t, index, rng, true, []int32{9, 7, 5})
+		})
+
+		t.Run("could range by prefix and upper bound of last value", func(t *testing.T) {
+			rng := tree.NewRange(nil, tree.NewKey("g0", 4), true)
+			expectIndexRangeGot(t, index, rng, false, []int32{0, 2})
+		})
+
+		t.Run("could skip scan by range of second value", func(t *testing.T) {
+			ids := make([]int32, 0)
+			err := index.SkipScan(context.Background(), 1, tree.NewRange(tree.NewKey(3), tree.NewKey(6), false), func(key tree.Key) error {
+				ids = append(ids, key.Values()[0].(int32))
+				return nil
+			})
+			Expect(t, err, Be[error](nil))
+			Expect(t, ids, Equal([]int32{4, 6, 3, 5}))
+		})
+
+		t.Run("could not skip all paths", func(t *testing.T) {
+			err := index.SkipScan(context.Background(), 2, nil, func(key tree.Key) error {
+				return nil
+			})
+			Expect(t, err, Not(Be[error](nil)))
+		})
+	})
+}
+
+func expectIndexRangeGot(t testing.TB, index database.Index, rng tree.Range, reverse bool, got []int32) {
+	ids := make([]int32, 0)
+	err := index.Range(context.Background(), rng, reverse, func(key tree.Key) error {
+		ids = append(ids, key.Values()[0].(int32))
+		return nil
+	})
+	Expect(t, err, Be[error](nil))
+	Expect(t, ids, Equal(got))
 }
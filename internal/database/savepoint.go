@@ -0,0 +1,182 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/octohelm/kiwidb/pkg/dberr"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/pkg/errors"
+)
+
+// savepoint marks position of undo log.
+type savepoint struct {
+	name string
+	// length of undo log when savepoint created
+	pos int
+	// keys with original values logged after savepoint created
+	logged map[string]struct{}
+}
+
+type undoEntry struct {
+	key []byte
+	// nil means the key not exists before
+	value []byte
+}
+
+// savepointSession logs original values of keys before written when any savepoint created,
+// so changes after savepoint could be undone without aborting the whole transaction.
+type savepointSession struct {
+	kv.Session
+
+	savepoints []*savepoint
+	undoLog    []undoEntry
+}
+
+func (s *savepointSession) Insert(k, v []byte) error {
+	if err := s.log(k); err != nil {
+		return err
+	}
+	return s.Session.Insert(k, v)
+}
+
+func (s *savepointSession) Put(k, v []byte) error {
+	if err := s.log(k); err != nil {
+		return err
+	}
+	return s.Session.Put(k, v)
+}
+
+func (s *savepointSession) Delete(k []byte) error {
+	if err := s.log(k); err != nil {
+		return err
+	}
+	return s.Session.Delete(k)
+}
+
+func (s *savepointSession) Restamp(k []byte) {
+	if r, ok := s.Session.(kv.Restamper); ok {
+		r.Restamp(k)
+	}
+}
+
+// DeleteRange logs original values of all keys visible in the range before deleted.
+func (s *savepointSession) DeleteRange(start []byte, end []byte) error {
+	if len(s.savepoints) > 0 {
+		sp := s.savepoints[len(s.savepoints)-1]
+
+		it := s.Session.Iterator(start, end)
+		for it.First(); it.Valid(); it.Next() {
+			if _, ok := sp.logged[string(it.Key())]; ok {
+				continue
+			}
+			s.append(sp, it.Key(), append([]byte(nil), it.Value()...))
+		}
+		if err := it.Error(); err != nil {
+			_ = it.Close()
+			return err
+		}
+		if err := it.Close(); err != nil {
+			return err
+		}
+	}
+	return s.Session.DeleteRange(start, end)
+}
+
+func (s *savepointSession) log(k []byte) error {
+	if len(s.savepoints) == 0 {
+		return nil
+	}
+
+	sp := s.savepoints[len(s.savepoints)-1]
+	if _, ok := sp.logged[string(k)]; ok {
+		return nil
+	}
+
+	v, err := s.Session.Get(k)
+	if err != nil {
+		if !errors.Is(err, kv.ErrKeyNotFound) {
+			return err
+		}
+		v = nil
+	}
+
+	s.append(sp, k, v)
+
+	return nil
+}
+
+func (s *savepointSession) append(sp *savepoint, k []byte, v []byte) {
+	sp.logged[string(k)] = struct{}{}
+	s.undoLog = append(s.undoLog, undoEntry{
+		key:   append([]byte(nil), k...),
+		value: v,
+	})
+}
+
+func (s *savepointSession) Savepoint(name string) error {
+	if name == "" {
+		return errors.New("savepoint name is required")
+	}
+
+	s.savepoints = append(s.savepoints, &savepoint{
+		name:   name,
+		pos:    len(s.undoLog),
+		logged: map[string]struct{}{},
+	})
+
+	return nil
+}
+
+// RollbackTo undoes changes after the savepoint, the savepoint is kept.
+func (s *savepointSession) RollbackTo(name string) error {
+	i, err := s.indexOf(name)
+	if err != nil {
+		return err
+	}
+
+	sp := s.savepoints[i]
+
+	for j := len(s.undoLog) - 1; j >= sp.pos; j-- {
+		e := s.undoLog[j]
+		if e.value == nil {
+			err = s.Session.Delete(e.key)
+		} else {
+			err = s.Session.Put(e.key, e.value)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "rollback to savepoint %s", name)
+		}
+	}
+
+	s.undoLog = s.undoLog[0:sp.pos]
+	sp.logged = map[string]struct{}{}
+	s.savepoints = s.savepoints[0 : i+1]
+
+	return nil
+}
+
+// Release drops the savepoint and savepoints created after it, changes are kept.
+func (s *savepointSession) Release(name string) error {
+	i, err := s.indexOf(name)
+	if err != nil {
+		return err
+	}
+
+	s.savepoints = s.savepoints[0:i]
+
+	if len(s.savepoints) == 0 {
+		s.undoLog = nil
+	}
+
+	return nil
+}
+
+// indexOf returns index of the latest savepoint with the name.
+func (s *savepointSession) indexOf(name string) (int, error) {
+	for i := len(s.savepoints) - 1; i >= 0; i-- {
+		if s.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+	return -1, &dberr.NotFoundError{Name: fmt.Sprintf("savepoint %s", name)}
+}
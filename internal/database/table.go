@@ -12,10 +12,14 @@ import (
 )
 
 type Table interface {
+	Schema() *schema.TableSchema
 	Insert(ctx context.Context, d Document) (tree.Key, Document, error)
 	Delete(ctx context.Context, key tree.Key) error
 	Replace(ctx context.Context, key tree.Key, d Document) error
 	Get(ctx context.Context, key tree.Key) (Document, error)
+	// Lock acquires exclusive lock of the document held until the transaction ends,
+	// documents should be read after locked for read-modify-write.
+	Lock(ctx context.Context, key tree.Key) error
 	Range(ctx context.Context, rng tree.Range, reverse bool, fn func(key tree.Key, d Document) error) error
 	Truncate(ctx context.Context) error
 }
@@ -34,8 +38,22 @@ type table struct {
 	schema *schema.TableSchema
 }
 
+func (t *table) Schema() *schema.TableSchema {
+	return t.schema
+}
+
 func (t *table) Truncate(ctx context.Context) error {
-	return t.tree.Truncate()
+	if err := t.tree.Truncate(ctx); err != nil {
+		return err
+	}
+
+	for name := range t.schema.IndexSchemas {
+		if err := NewIndex(t.tx, t.schema.IndexSchemas[name]).Truncate(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (t *table) Insert(ctx context.Context, d Document) (tree.Key, Document, error) {
@@ -63,7 +81,13 @@ func (t *table) Insert(ctx context.Context, d Document) (tree.Key, Document, err
 				Key:  key,
 			}
 		}
+		return nil, nil, err
 	}
+
+	if err := t.setIndexes(ctx, key, d); err != nil {
+		return nil, nil, err
+	}
+
 	return key, d, nil
 }
 
@@ -80,8 +104,24 @@ func (t *table) Get(ctx context.Context, key tree.Key) (Document, error) {
 	return DocumentFromBytes(data), nil
 }
 
+func (t *table) Lock(ctx context.Context, key tree.Key) error {
+	return t.tx.Lock(ctx, key.WithNamespace(t.tree.Namespace).Bytes())
+}
+
 func (t *table) Delete(ctx context.Context, key tree.Key) error {
-	err := t.tree.Delete(key)
+	old, err := t.tree.Get(key)
+	if err != nil {
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if err := t.deleteIndexes(ctx, key, DocumentFromBytes(old)); err != nil {
+		return err
+	}
+
+	err = t.tree.Delete(key)
 	if errors.Is(err, kv.ErrKeyNotFound) {
 		return nil
 	}
@@ -89,26 +129,71 @@ func (t *table) Delete(ctx context.Context, key tree.Key) error {
 }
 
 func (t *table) Replace(ctx context.Context, key tree.Key, d Document) error {
-	ok, err := t.tree.Exists(key)
+	old, err := t.tree.Get(key)
 	if err != nil {
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return errors.Wrapf(dberr.NotFoundError{}, "can't replace key %v", key.Values())
+		}
 		return err
 	}
-	if !ok {
-		return errors.Wrapf(dberr.NotFoundError{}, "can't replace key %v", key.Values())
-	}
 
 	enc, err := d.Marshal()
 	if err != nil {
-		return nil
+		return err
+	}
+
+	if err := t.deleteIndexes(ctx, key, DocumentFromBytes(old)); err != nil {
+		return err
 	}
 
 	// replace old document with new document
-	err = t.tree.Put(key, enc)
-	return err
+	if err := t.tree.Put(key, enc); err != nil {
+		return err
+	}
+
+	return t.setIndexes(ctx, key, d)
+}
+
+func (t *table) setIndexes(ctx context.Context, key tree.Key, d Document) error {
+	for name := range t.schema.IndexSchemas {
+		is := t.schema.IndexSchemas[name]
+
+		entries, err := indexValuesOf(is, d)
+		if err != nil {
+			return err
+		}
+
+		idx := NewIndex(t.tx, is)
+		for i := range entries {
+			if err := idx.Set(ctx, entries[i], key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *table) deleteIndexes(ctx context.Context, key tree.Key, d Document) error {
+	for name := range t.schema.IndexSchemas {
+		is := t.schema.IndexSchemas[name]
+
+		entries, err := indexValuesOf(is, d)
+		if err != nil {
+			return err
+		}
+
+		idx := NewIndex(t.tx, is)
+		for i := range entries {
+			if err := idx.Delete(ctx, entries[i], key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (t *table) Range(ctx context.Context, rng tree.Range, reverse bool, fn func(key tree.Key, d Document) error) error {
-	return t.tree.Range(rng, reverse, func(k tree.Key, enc []byte) error {
+	return t.tree.Range(ctx, rng, reverse, func(k tree.Key, enc []byte) error {
 		return fn(k, DocumentFromBytes(enc))
 	})
 }
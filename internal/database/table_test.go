@@ -25,6 +25,9 @@ func TestTable(t *testing.T) {
 	Expect(t, err, Be[error](nil))
 
 	tx := database.NewTransaction("test", s, idgen)
+	t.Cleanup(func() {
+		_ = tx.Rollback()
+	})
 	tableGroup, err := database.NewTable(tx, ts)
 	Expect(t, err, Be[error](nil))
 
@@ -56,6 +59,19 @@ func TestTable(t *testing.T) {
 				found := &Group{}
 				err = doc.Unmarshal(found)
 				Expect(t, found, Equal(group))
+
+				t.Run("replace with document failed to marshal", func(t *testing.T) {
+					err := tableGroup.Replace(context.Background(), tree.NewKey(g.PrimaryKey()), database.DocumentFrom(map[string]any{
+						"name": make(chan int),
+					}))
+					Expect(t, err, Not(Be[error](nil)))
+
+					doc, err := tableGroup.Get(context.Background(), tree.NewKey(group.PrimaryKey()))
+					Expect(t, err, Be[error](nil))
+					found := &Group{}
+					err = doc.Unmarshal(found)
+					Expect(t, found, Equal(group))
+				})
 			})
 
 			t.Run("delete by pk", func(t *testing.T) {
@@ -1,6 +1,10 @@
 package database
 
 import (
+	"context"
+	"strings"
+
+	"github.com/octohelm/kiwidb/pkg/dberr"
 	"github.com/octohelm/kiwidb/pkg/id"
 	"github.com/octohelm/kiwidb/pkg/kv"
 	"github.com/pkg/errors"
@@ -11,21 +15,48 @@ type Transaction interface {
 	Session() kv.Session
 
 	Rollback() error
+	// Commit runs TransactionEventBeforeCommit hooks, any error of them aborts the commit,
+	// then applies changes, errors of TransactionEventCommit hooks are returned as dberr.AfterCommitError.
 	Commit() error
 	On(event TransactionEvent, callback func())
+	// Hook registers callback which could fail of the event.
+	Hook(event TransactionEvent, callback func() error)
+
+	// Lock acquires exclusive lock of key held until the transaction ends,
+	// waits until released by others or ctx done, fails with kv.ErrDeadlock when waiting would deadlock.
+	// Once locked, reads of the key before never conflict with changes committed before,
+	// so the key should be read again.
+	Lock(ctx context.Context, key []byte) error
+
+	// Sequence returns the commit sequence assigned once committed,
+	// or the sequence of the last commit visible of read-only transaction.
+	// Read-only transaction could be pinned to the sequence by NewTransactionAt.
+	Sequence() uint64
+
+	// Savepoint marks current changes of the transaction, names could be reused as nested.
+	Savepoint(name string) error
+	// RollbackTo undoes changes after the latest savepoint with the name,
+	// savepoints created after it are dropped.
+	RollbackTo(name string) error
+	// Release drops the latest savepoint with the name and savepoints created after it,
+	// changes are kept.
+	Release(name string) error
 }
 
 type TransactionEvent string
 
 var (
-	TransactionEventCommit   TransactionEvent = "commit"
-	TransactionEventRollback TransactionEvent = "rollback"
+	// TransactionEventBeforeCommit fires before changes applied, changes could still be written by callbacks.
+	TransactionEventBeforeCommit TransactionEvent = "before_commit"
+	TransactionEventCommit       TransactionEvent = "commit"
+	TransactionEventRollback     TransactionEvent = "rollback"
 )
 
 type TransactionOptionFunc = func(o *transactionOption)
 
 type transactionOption struct {
-	readOnly bool
+	readOnly   bool
+	durability kv.Durability
 }
 
 func TransactionReadOnly() func(o *transactionOption) {
@@ -34,8 +65,18 @@ func TransactionReadOnly() func(o *transactionOption) {
 	}
 }
 
+// TransactionDurability sets when changes of the transaction persisted on commit,
+// kv.DurabilitySync by default.
+func TransactionDurability(d kv.Durability) func(o *transactionOption) {
+	return func(o *transactionOption) {
+		o.durability = d
+	}
+}
+
 func NewTransaction(dbName string, s kv.Store, idgen id.Gen, optFns ...TransactionOptionFunc) Transaction {
-	o := &transactionOption{}
+	o := &transactionOption{
+		durability: kv.DurabilitySync,
+	}
 
 	for i := range optFns {
 		optFns[i](o)
@@ -46,22 +87,45 @@ func NewTransaction(dbName string, s kv.Store, idgen id.Gen, optFns ...Transacti
 			gen:      idgen,
 			readOnly: true,
 			session:  s.NewSnapshotSession(dbName),
-			hooks:    map[TransactionEvent][]func(){},
+			hooks:    map[TransactionEvent][]func() error{},
 		}
 	}
 	return &transaction{
-		gen:      idgen,
-		readOnly: false,
-		session:  s.NewBatchSession(dbName),
-		hooks:    map[TransactionEvent][]func(){},
+		gen:        idgen,
+		readOnly:   false,
+		durability: o.durability,
+		session:    &savepointSession{Session: s.NewBatchSession(dbName)},
+		hooks:      map[TransactionEvent][]func() error{},
+		locks:      locksOf(s),
 	}
 }
 
+// NewTransactionAt creates read-only transaction pinned to the commit sequence.
+func NewTransactionAt(dbName string, s kv.Store, idgen id.Gen, seq uint64) (Transaction, error) {
+	session, err := s.NewSnapshotSessionAt(dbName, seq)
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{
+		gen:      idgen,
+		readOnly: true,
+		session:  session,
+		hooks:    map[TransactionEvent][]func() error{},
+		locks:    locksOf(s),
+	}, nil
+}
+
 type transaction struct {
-	gen      id.Gen
-	session  kv.Session
-	hooks    map[TransactionEvent][]func()
-	readOnly bool
+	gen     id.Gen
+	session kv.Session
+	hooks   map[TransactionEvent][]func() error
+	locks   *kv.LockTable
+	// owner of locks, assigned when first lock acquired
+	owner      uint64
+	readOnly   bool
+	durability kv.Durability
+	// catalog version visible to the transaction, loaded when first used
+	catalogVersion *uint64
 }
 
 func (tx *transaction) ID() (uint64, error) {
@@ -72,41 +136,182 @@ func (tx *transaction) Session() kv.Session {
 	return tx.session
 }
 
+func (tx *transaction) Sequence() uint64 {
+	return tx.session.Sequence()
+}
+
 func (tx *transaction) On(event TransactionEvent, callback func()) {
+	tx.Hook(event, func() error {
+		callback()
+		return nil
+	})
+}
+
+func (tx *transaction) Hook(event TransactionEvent, callback func() error) {
 	tx.hooks[event] = append(tx.hooks[event], callback)
 }
 
-func (tx *transaction) Rollback() error {
-	err := tx.session.Close()
+// runHooks calls hooks of event in reverse order of registration.
+// when failFast, it stops at the first error, otherwise errors of all hooks are combined.
+func (tx *transaction) runHooks(event TransactionEvent, failFast bool) error {
+	hooks := tx.hooks[event]
+
+	var errs hookErrors
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i](); err != nil {
+			if failFast {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return errs
+}
+
+// hookErrors combines errors of hooks, which matches any of them by errors.Is and errors.As.
+type hookErrors []error
+
+func (errs hookErrors) Error() string {
+	b := strings.Builder{}
+	for i, err := range errs {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the first error.
+func (errs hookErrors) Unwrap() error {
+	return errs[0]
+}
+
+func (errs hookErrors) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (errs hookErrors) As(target any) bool {
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tx *transaction) Savepoint(name string) error {
+	s, err := tx.savepointSession()
 	if err != nil {
 		return err
 	}
+	return s.Savepoint(name)
+}
 
-	if hooks, ok := tx.hooks[TransactionEventRollback]; ok {
-		for i := len(hooks) - 1; i >= 0; i-- {
-			hooks[i]()
-		}
+func (tx *transaction) RollbackTo(name string) error {
+	s, err := tx.savepointSession()
+	if err != nil {
+		return err
 	}
+	return s.RollbackTo(name)
+}
 
+func (tx *transaction) Release(name string) error {
+	s, err := tx.savepointSession()
+	if err != nil {
+		return err
+	}
+	return s.Release(name)
+}
+
+func (tx *transaction) savepointSession() (*savepointSession, error) {
+	if s, ok := tx.session.(*savepointSession); ok {
+		return s, nil
+	}
+	return nil, errors.New("savepoints are not supported in read-only transaction")
+}
+
+func locksOf(s kv.Store) *kv.LockTable {
+	if l, ok := s.(kv.Locker); ok {
+		return l.Locks()
+	}
+	return nil
+}
+
+func (tx *transaction) Lock(ctx context.Context, key []byte) error {
+	if tx.readOnly {
+		return errors.New("cannot lock in read-only transaction")
+	}
+	if tx.locks == nil {
+		return errors.New("locks are not supported by the store")
+	}
+	if tx.owner == 0 {
+		tx.owner = tx.locks.NewOwner()
+	}
+	if err := tx.locks.Lock(ctx, tx.owner, key); err != nil {
+		return err
+	}
+	// reads of the key before locked, like by scans, would not conflict with changes committed before,
+	// the key should be read again once locked.
+	if r, ok := tx.session.(kv.Restamper); ok {
+		r.Restamp(key)
+	}
 	return nil
 }
 
+func (tx *transaction) unlock() {
+	if tx.owner != 0 {
+		tx.locks.Unlock(tx.owner)
+	}
+}
+
+// Rollback discards changes, errors of TransactionEventRollback hooks are returned.
+func (tx *transaction) Rollback() error {
+	err := tx.session.Close()
+	tx.unlock()
+	if err != nil {
+		return err
+	}
+
+	return tx.runHooks(TransactionEventRollback, false)
+}
+
 func (tx *transaction) Commit() error {
 	if tx.readOnly {
 		return errors.New("cannot commit read-only transaction")
 	}
 
-	err := tx.session.Commit()
+	if err := tx.runHooks(TransactionEventBeforeCommit, true); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrap(err, "before commit")
+	}
+
+	err := tx.session.Commit(kv.WithDurability(tx.durability))
+	tx.unlock()
 	if err != nil {
+		// session is discarded when commit failed
+		_ = tx.runHooks(TransactionEventRollback, false)
 		return err
 	}
 
 	_ = tx.session.Close()
 
-	if hooks, ok := tx.hooks[TransactionEventCommit]; ok {
-		for i := len(hooks) - 1; i >= 0; i-- {
-			hooks[i]()
-		}
+	if err := tx.runHooks(TransactionEventCommit, false); err != nil {
+		return &dberr.AfterCommitError{Err: err}
 	}
+
 	return nil
 }
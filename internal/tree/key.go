@@ -40,6 +40,8 @@ type key struct {
 
 func (k key) WithNamespace(ns Namespace) Key {
 	if k.ns != ns {
+		// values must be decoded before raw dropped
+		k.Values()
 		k.ns = ns
 		// when namespace not equal should remove raw
 		k.raw = nil
@@ -1,6 +1,9 @@
 package tree
 
 import (
+	"bytes"
+	"context"
+
 	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
 	"github.com/octohelm/kiwidb/pkg/kv"
 )
@@ -47,27 +50,158 @@ func (t *Tree) Delete(key Key) error {
 	return t.Session.Delete(key.WithNamespace(t.Namespace).Bytes())
 }
 
-func (t *Tree) Truncate() error {
+// Truncate deletes all keys of the tree in the session, returns ctx.Err() if ctx done.
+func (t *Tree) Truncate(ctx context.Context) error {
 	from := NewNamespacedKey(t.Namespace).Bytes()
 	to := NewNamespacedKey(t.Namespace + 1).Bytes()
 
-	s := t.Session.Iterator(from, to)
-	defer s.Close()
+	return kv.DeleteRange(ctx, t.Session, from, to)
+}
+
+// Range iterates keys in range, returns ctx.Err() once ctx done.
+func (t *Tree) Range(ctx context.Context, rng Range, reverse bool, fn func(key Key, value []byte) error) error {
+	return t.RangeAfter(ctx, rng, nil, reverse, fn)
+}
+
+// RangeAfter iterates keys in range after the key, or before it when reverse, nil means from the beginning.
+// The key should be one passed to fn before, so the iteration stopped could be resumed without visiting keys again.
+func (t *Tree) RangeAfter(ctx context.Context, rng Range, after Key, reverse bool, fn func(key Key, value []byte) error) error {
+	start, end := t.bounds(rng)
+
+	it := t.Session.Iterator(start, end)
+	defer it.Close()
+
+	switch {
+	case after == nil && !reverse:
+		it.First()
+	case after == nil:
+		it.Last()
+	case !reverse:
+		// keys prefixed by the key are after it.
+		if it.SeekGE(after.Bytes()) && bytes.Equal(it.Key(), after.Bytes()) {
+			it.Next()
+		}
+	default:
+		it.SeekLT(after.Bytes())
+	}
+
+	return t.iterate(ctx, it, nil, reverse, fn)
+}
+
+// Prefix iterates keys with leading values of prefix, returns ctx.Err() once ctx done.
+func (t *Tree) Prefix(ctx context.Context, prefix Key, reverse bool, fn func(key Key, value []byte) error) error {
+	it := kv.PrefixIterator(t.Session, prefix.WithNamespace(t.Namespace).Bytes())
+	defer it.Close()
+
+	if !reverse {
+		it.First()
+	} else {
+		it.Last()
+	}
+
+	return t.iterate(ctx, it, nil, reverse, fn)
+}
 
-	for s.First(); s.Valid(); s.Next() {
-		t.Session.Delete(s.Key())
+// SkipScan iterates keys which values after the first skip ones are in range, returns ctx.Err() once ctx done.
+// For each distinct leading values, it seeks to the range prefixed by them, then seeks to the next leading values,
+// so keys out of range are never visited, which is efficient when leading values are few.
+// Keys are visited in order of leading values, then in order of the range.
+func (t *Tree) SkipScan(ctx context.Context, skip int, rng Range, fn func(key Key, value []byte) error) error {
+	if skip == 0 {
+		return t.Range(ctx, rng, false, fn)
 	}
 
-	return t.Session.Commit()
+	first := t.buildFirstKey()
+	start, end := t.bounds(rng)
+
+	it := t.Session.Iterator(first, t.buildLastKey())
+	defer it.Close()
+
+	for it.First(); it.Valid(); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		leading, ok := prefixOf(it.Key(), skip)
+		if !ok {
+			// keys without enough values are not in any range
+			it.Next()
+			continue
+		}
+
+		// bounds of the range rebased on leading values
+		subEnd := append(append([]byte(nil), leading...), end[len(first):]...)
+		it.SeekGE(append(append([]byte(nil), leading...), start[len(first):]...))
+
+		if err := t.iterate(ctx, it, subEnd, false, fn); err != nil {
+			return err
+		}
+
+		it.SeekGE(kv.PrefixEnd(leading))
+	}
+
+	return it.Error()
 }
 
-func (t *Tree) Range(rng Range, reverse bool, fn func(key Key, value []byte) error) error {
+// iterate calls fn with keys from the current one of iterator until invalid, or reached end when not nil.
+func (t *Tree) iterate(ctx context.Context, it kv.Iterator, end []byte, reverse bool, fn func(key Key, value []byte) error) error {
+	var k Key
+	for n := 0; it.Valid(); n++ {
+		if end != nil && msgp.Compare(it.Key(), end) >= 0 {
+			break
+		}
+
+		if n%kv.CheckContextInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		// copied, so keys could be kept to resume iteration.
+		k = NewEncodedKey(append([]byte(nil), it.Key()...))
+
+		err := fn(k, it.Value())
+		if err != nil {
+			return err
+		}
+
+		if !reverse {
+			it.Next()
+		} else {
+			it.Prev()
+		}
+	}
+
+	return it.Error()
+}
+
+// prefixOf returns copy of encoded namespace with the first n values of key,
+// false when key has less values.
+func prefixOf(key []byte, n int) ([]byte, bool) {
+	r := bytes.NewReader(key)
+	dec := msgp.NewDecoder(r)
+
+	var ns Namespace
+	if err := dec.Decode(&ns); err != nil {
+		return nil, false
+	}
+
+	for i := 0; i < n; i++ {
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, false
+		}
+	}
+
+	return append([]byte(nil), key[:len(key)-r.Len()]...), true
+}
+
+// bounds returns [start, end) of keys in range.
+func (t *Tree) bounds(rng Range) (start []byte, end []byte) {
 	if rng == nil {
 		rng = NewRange(nil, nil, false)
 	}
 
-	var start, end []byte
-
 	min := rng.Min()
 	max := rng.Max()
 
@@ -97,34 +231,7 @@ func (t *Tree) Range(rng Range, reverse bool, fn func(key Key, value []byte) err
 		}
 	}
 
-	//fmt.Printf("%x %x\n", start, end)
-
-	it := t.Session.Iterator(start, end)
-	defer it.Close()
-
-	if !reverse {
-		it.First()
-	} else {
-		it.Last()
-	}
-
-	var k Key
-	for it.Valid() {
-		k = NewEncodedKey(it.Key())
-
-		err := fn(k, it.Value())
-		if err != nil {
-			return err
-		}
-
-		if !reverse {
-			it.Next()
-		} else {
-			it.Prev()
-		}
-	}
-
-	return it.Error()
+	return start, end
 }
 
 func (t *Tree) buildMinKeyForType(max Key) []byte {
@@ -157,10 +264,9 @@ func (t *Tree) buildMaxKeyForType(min Key) []byte {
 	if min == nil {
 		return t.buildLastKey()
 	}
-	if len(min.Values()) == 1 {
-		return append(NewKey().WithNamespace(t.Namespace).Bytes(), msgp.MaxTypeCodeForType(min.Values()[0]))
-	}
-	return append(NewNamespacedKey(t.Namespace, min.Values()[:]...).Bytes(), msgp.MaxTypeCodeForType(min.Values()[len(min.Values())-1]))
+	values := min.Values()
+	// keep leading values as prefix, only the type of last value bounds the range.
+	return append(NewNamespacedKey(t.Namespace, values[:len(values)-1]...).Bytes(), msgp.MaxTypeCodeForType(values[len(values)-1]))
 }
 
 func (t *Tree) buildLastKey() []byte {
@@ -1,6 +1,9 @@
 package tree_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/octohelm/kiwidb/internal/tree"
@@ -88,12 +91,125 @@ func TestTree(t *testing.T) {
 			rng := tree.NewRange(tree.NewKey(-1), tree.NewKey(1), true)
 			expectRangeGot(t, tt, rng, false, []int32{0})
 		})
+
+		t.Run("range with context canceled", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			err := tt.Range(ctx, nil, false, func(key tree.Key, data []byte) error {
+				return nil
+			})
+			Expect(t, errors.Is(err, context.Canceled), Be(true))
+		})
+
+		t.Run("truncate with context canceled", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			err := tt.Truncate(ctx)
+			Expect(t, errors.Is(err, context.Canceled), Be(true))
+
+			expectRangeGot(t, tt, nil, false, []int32{-3, -2, -1, 0, 1, 2, 3})
+		})
+
+		t.Run("range after key", func(t *testing.T) {
+			var last tree.Key
+			values := make([]int32, 0)
+
+			// resume iteration stopped every 2 keys
+			for {
+				n := 0
+				err := tt.RangeAfter(context.Background(), nil, last, false, func(key tree.Key, data []byte) error {
+					if n == 2 {
+						return errStop
+					}
+					n++
+					last = key
+					values = append(values, key.Values()[0].(int32))
+					return nil
+				})
+				if err == nil {
+					break
+				}
+				Expect(t, err, Be(errStop))
+			}
+
+			Expect(t, values, Equal([]int32{-3, -2, -1, 0, 1, 2, 3}))
+		})
+
+		t.Run("reverse range before key", func(t *testing.T) {
+			values := make([]int32, 0)
+			err := tt.RangeAfter(context.Background(), nil, tree.NewNamespacedKey(10, 1), true, func(key tree.Key, data []byte) error {
+				values = append(values, key.Values()[0].(int32))
+				return nil
+			})
+			Expect(t, err, Be[error](nil))
+			Expect(t, values, Equal([]int32{0, -1, -2, -3}))
+		})
+	})
+
+	t.Run("Given namespace 10 and put composite keys", func(t *testing.T) {
+		tt := testutil.NewTree(t, 10)
+
+		for a := 1; a <= 3; a++ {
+			for b := 1; b <= 3; b++ {
+				err := tt.Put(tree.NewKey(a, b), []byte{1})
+				Expect(t, err, Be[error](nil))
+			}
+		}
+
+		collect := func(t testing.TB, do func(fn func(key tree.Key, data []byte) error) error) []string {
+			keys := make([]string, 0)
+			err := do(func(key tree.Key, data []byte) error {
+				keys = append(keys, fmt.Sprint(key.Values()))
+				return nil
+			})
+			Expect(t, err, Be[error](nil))
+			return keys
+		}
+
+		t.Run("prefix", func(t *testing.T) {
+			keys := collect(t, func(fn func(key tree.Key, data []byte) error) error {
+				return tt.Prefix(context.Background(), tree.NewKey(2), false, fn)
+			})
+			Expect(t, keys, Equal([]string{"[2 1]", "[2 2]", "[2 3]"}))
+		})
+
+		t.Run("reverse prefix", func(t *testing.T) {
+			keys := collect(t, func(fn func(key tree.Key, data []byte) error) error {
+				return tt.Prefix(context.Background(), tree.NewKey(2), true, fn)
+			})
+			Expect(t, keys, Equal([]string{"[2 3]", "[2 2]", "[2 1]"}))
+		})
+
+		t.Run("skip scan second value >= 2", func(t *testing.T) {
+			keys := collect(t, func(fn func(key tree.Key, data []byte) error) error {
+				return tt.SkipScan(context.Background(), 1, tree.NewRange(tree.NewKey(2), nil, false), fn)
+			})
+			Expect(t, keys, Equal([]string{"[1 2]", "[1 3]", "[2 2]", "[2 3]", "[3 2]", "[3 3]"}))
+		})
+
+		t.Run("skip scan second value = 1", func(t *testing.T) {
+			keys := collect(t, func(fn func(key tree.Key, data []byte) error) error {
+				return tt.SkipScan(context.Background(), 1, tree.NewRange(tree.NewKey(1), tree.NewKey(1), false), fn)
+			})
+			Expect(t, keys, Equal([]string{"[1 1]", "[2 1]", "[3 1]"}))
+		})
+
+		t.Run("skip scan out of range", func(t *testing.T) {
+			keys := collect(t, func(fn func(key tree.Key, data []byte) error) error {
+				return tt.SkipScan(context.Background(), 1, tree.NewRange(tree.NewKey(4), nil, false), fn)
+			})
+			Expect(t, keys, Equal([]string{}))
+		})
 	})
 }
 
+var errStop = errors.New("stop")
+
 func expectRangeGot(t testing.TB, tt *tree.Tree, rng tree.Range, reverse bool, got []int32) {
 	values := make([]int32, 0)
-	err := tt.Range(rng, reverse, func(key tree.Key, data []byte) error {
+	err := tt.Range(context.Background(), rng, reverse, func(key tree.Key, data []byte) error {
 		values = append(values, key.Values()[0].(int32))
 		return nil
 	})
@@ -2,8 +2,12 @@ package db
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
 
+	"github.com/octohelm/kiwidb/internal/database"
+	"github.com/octohelm/kiwidb/pkg/kv"
 	"github.com/octohelm/kiwidb/pkg/schema"
 	"github.com/octohelm/kiwidb/pkg/testutil"
 	testing2 "github.com/octohelm/x/testing"
@@ -43,4 +47,242 @@ func TestDB(t *testing.T) {
 			testing2.Expect(t, err, testing2.Be[error](nil))
 		})
 	})
+
+	t.Run("Insert with context canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := d.Execute(ctx, Insert(&User{
+			Name: "canceled",
+		}))
+		testing2.Expect(t, errors.Is(err, context.Canceled), testing2.Be(true))
+	})
+
+	t.Run("Insert retried after conflict", func(t *testing.T) {
+		s := &conflictOnceStore{Store: testutil.NewStore(t)}
+		d := database.New("test", s, testutil.NewIDGen(t))
+
+		err := d.Update(context.Background(), func(tx Transaction) error {
+			_, err := d.Table(context.Background(), tx, &User{})
+			return err
+		})
+		testing2.Expect(t, err, testing2.Be[error](nil))
+
+		s.armed = true
+
+		err = d.Execute(context.Background(), Insert(&User{
+			Name: "retried",
+		}))
+		testing2.Expect(t, err, testing2.Be[error](nil))
+		testing2.Expect(t, s.conflicted, testing2.Be(true))
+
+		err = d.View(context.Background(), func(tx Transaction) error {
+			table, err := d.Table(context.Background(), tx, &User{})
+			if err != nil {
+				return err
+			}
+			count := 0
+			if err := table.Range(context.Background(), nil, false, func(key Key, doc Document) error {
+				count++
+				return nil
+			}); err != nil {
+				return err
+			}
+			testing2.Expect(t, count, testing2.Be(1))
+			return nil
+		})
+		testing2.Expect(t, err, testing2.Be[error](nil))
+	})
+}
+
+// conflictOnceStore fails the first commit with kv.ErrConflict once armed.
+type conflictOnceStore struct {
+	kv.Store
+	armed      bool
+	conflicted bool
+}
+
+func (s *conflictOnceStore) NewBatchSession(dbName string) kv.Session {
+	return &conflictOnceSession{Session: s.Store.NewBatchSession(dbName), store: s}
+}
+
+// conflictOnceSession rejects writes once closed,
+// which may be accepted by sessions of engines reusing batches.
+type conflictOnceSession struct {
+	kv.Session
+	store  *conflictOnceStore
+	closed bool
+}
+
+func (s *conflictOnceSession) Insert(k, v []byte) error {
+	if s.closed {
+		return errors.New("session closed")
+	}
+	return s.Session.Insert(k, v)
+}
+
+func (s *conflictOnceSession) Put(k, v []byte) error {
+	if s.closed {
+		return errors.New("session closed")
+	}
+	return s.Session.Put(k, v)
+}
+
+func (s *conflictOnceSession) Close() error {
+	s.closed = true
+	return s.Session.Close()
+}
+
+func (s *conflictOnceSession) Commit(opts ...kv.CommitOptionFunc) error {
+	if s.store.armed && !s.store.conflicted {
+		s.store.conflicted = true
+		_ = s.Close()
+		return kv.ErrConflict
+	}
+	return s.Session.Commit(opts...)
+}
+
+type Counter struct {
+	schema.PKey
+	N int64 `msgp:"n" json:"n"`
+}
+
+func TestForUpdate(t *testing.T) {
+	d := testutil.NewDatabase(t, "test")
+
+	err := d.Execute(context.Background(), Insert(&Counter{}))
+	testing2.Expect(t, err, testing2.Be[error](nil))
+
+	// documents scanned are fed into ForUpdate, then increased.
+	incr := func() error {
+		tx := d.Begin()
+
+		in := database.NewStateWithContext(context.Background())
+		in.SetDatabase(d)
+		in.SetTx(tx)
+
+		op := Pipe(
+			&scanOperator{model: &Counter{}},
+			ForUpdate(&Counter{}),
+			&incrOperator{model: &Counter{}},
+		)
+
+		if err := op.Iterate(in, func(out State) error {
+			return nil
+		}); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	t.Run("scan feeding ForUpdate under contention should not conflict", func(t *testing.T) {
+		workers, times := 4, 10
+
+		wg := &sync.WaitGroup{}
+		errs := make(chan error, workers)
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < times; j++ {
+					if err := incr(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			testing2.Expect(t, err, testing2.Be[error](nil))
+		}
+
+		err := d.View(context.Background(), func(tx Transaction) error {
+			table, err := d.Table(context.Background(), tx, &Counter{})
+			if err != nil {
+				return err
+			}
+			return table.Range(context.Background(), nil, false, func(key Key, doc Document) error {
+				c := &Counter{}
+				if err := doc.Unmarshal(c); err != nil {
+					return err
+				}
+				testing2.Expect(t, c.N, testing2.Be(int64(workers*times)))
+				return nil
+			})
+		})
+		testing2.Expect(t, err, testing2.Be[error](nil))
+	})
+}
+
+// scanOperator feeds states with all documents of the table.
+type scanOperator struct {
+	Op
+	model any
+}
+
+func (op *scanOperator) Iterate(in State, next func(out State) error) error {
+	table, err := in.Database().Table(in.Context(), in.Tx(), op.model)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]Key, 0)
+	docs := make([]Document, 0)
+
+	if err := table.Range(in.Context(), nil, false, func(key Key, doc Document) error {
+		keys = append(keys, key)
+		docs = append(docs, doc)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for i := range keys {
+		in.SetKey(keys[i])
+		in.SetDocument(docs[i])
+		if err := next(in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *scanOperator) String() string {
+	return "Scan()"
+}
+
+type incrOperator struct {
+	Op
+	model any
+}
+
+func (op *incrOperator) Iterate(in State, next func(out State) error) error {
+	return op.Prev().Iterate(in, func(out State) error {
+		table, err := out.Database().Table(out.Context(), out.Tx(), op.model)
+		if err != nil {
+			return err
+		}
+
+		c := &Counter{}
+		if err := out.Document().Unmarshal(c); err != nil {
+			return err
+		}
+		c.N++
+
+		if err := table.Replace(out.Context(), out.Key(), database.DocumentFrom(c)); err != nil {
+			return err
+		}
+		return next(out)
+	})
+}
+
+func (op *incrOperator) String() string {
+	return "Incr()"
 }
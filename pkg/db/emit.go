@@ -18,6 +18,10 @@ type omitOperator struct {
 
 func (op *omitOperator) Iterate(in State, next func(out State) error) error {
 	for i := range op.docs {
+		if err := in.Context().Err(); err != nil {
+			return err
+		}
+
 		in.SetDocument(op.docs[i])
 		if err := next(in); err != nil {
 			return err
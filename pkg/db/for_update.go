@@ -0,0 +1,58 @@
+package db
+
+import (
+	"github.com/octohelm/kiwidb/internal/database"
+	"github.com/pkg/errors"
+)
+
+// ForUpdate locks documents by keys of states until the transaction ends,
+// and reloads them after locked, so read-modify-write on them would not lose updates.
+// States could be fed by scans, reads of documents before locked never conflict with changes of others committed before.
+func ForUpdate(model any) Operator {
+	return &forUpdateOperator{model: model}
+}
+
+type forUpdateOperator struct {
+	Op
+	model any
+}
+
+func (op *forUpdateOperator) Iterate(in State, f func(out State) error) error {
+	var (
+		table database.Table
+		tx    database.Transaction
+	)
+
+	return op.Prev().Iterate(in, func(out State) error {
+		// table is bound to the transaction, which is renewed when retried.
+		if table == nil || tx != out.Tx() {
+			t, err := out.Database().Table(out.Context(), out.Tx(), op.model)
+			if err != nil {
+				return err
+			}
+			table, tx = t, out.Tx()
+		}
+
+		key := out.Key()
+		if key == nil {
+			return errors.New("ForUpdate requires key of document")
+		}
+
+		if err := table.Lock(out.Context(), key); err != nil {
+			return err
+		}
+
+		d, err := table.Get(out.Context(), key)
+		if err != nil {
+			return err
+		}
+
+		out.SetDocument(d)
+
+		return f(out)
+	})
+}
+
+func (op *forUpdateOperator) String() string {
+	return "ForUpdate()"
+}
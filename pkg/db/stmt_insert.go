@@ -17,15 +17,19 @@ type insertOperator struct {
 }
 
 func (op *insertOperator) Iterate(in State, f func(out State) error) error {
-	var table database.Table
+	var (
+		table database.Table
+		tx    database.Transaction
+	)
 
 	return op.Prev().Iterate(in, func(out State) error {
-		if table == nil {
-			t, err := out.Database().Table(out.Tx(), op.model)
+		// table is bound to the transaction, which is renewed when retried.
+		if table == nil || tx != out.Tx() {
+			t, err := out.Database().Table(out.Context(), out.Tx(), op.model)
 			if err != nil {
 				return err
 			}
-			table = t
+			table, tx = t, out.Tx()
 		}
 
 		d := database.DocumentFrom(op.model)
@@ -35,9 +39,6 @@ func (op *insertOperator) Iterate(in State, f func(out State) error) error {
 			return err
 		}
 
-		// FIXME update index
-		//table.Indexes
-
 		out.SetKey(key)
 		out.SetDocument(d)
 
@@ -57,6 +58,8 @@ func Do() Operator {
 	return nil
 }
 
+const onConflictSavepoint = "on_conflict"
+
 func OnConflict(name string, action Operator) Operator {
 	return &onConflict{
 		constraint: name,
@@ -72,9 +75,23 @@ type onConflict struct {
 
 func (o *onConflict) Iterate(in State, next func(state State) error) error {
 	return o.Prev().Iterate(in, func(state State) error {
+		tx := state.Tx()
+
+		// undo partial changes when conflict
+		if err := tx.Savepoint(onConflictSavepoint); err != nil {
+			return err
+		}
+
 		if err := next(state); err != nil {
 			if ce, ok := dberr.IsConflictError(err); ok {
 				if ce.Name == o.constraint {
+					if err := tx.RollbackTo(onConflictSavepoint); err != nil {
+						return err
+					}
+					if err := tx.Release(onConflictSavepoint); err != nil {
+						return err
+					}
+
 					// conflict do nothing
 					if o.action == nil {
 						return nil
@@ -92,7 +109,7 @@ func (o *onConflict) Iterate(in State, next func(state State) error) error {
 			return err
 		}
 
-		return nil
+		return tx.Release(onConflictSavepoint)
 	})
 }
 
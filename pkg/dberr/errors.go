@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/octohelm/kiwidb/internal/tree"
+	"github.com/octohelm/kiwidb/pkg/kv"
 
 	"github.com/cockroachdb/errors"
 )
@@ -48,3 +49,35 @@ type ConflictError struct {
 func (a ConflictError) Error() string {
 	return fmt.Sprintf("%q not found", a.Name)
 }
+
+// IsRetryable returns whether the transaction failed by err could be retried,
+// like commit conflicts with other transactions, or chosen as victim of deadlock.
+// Transaction already committed is never retryable.
+func IsRetryable(err error) bool {
+	if _, ok := IsAfterCommitError(err); ok {
+		return false
+	}
+	return errors.Is(err, kv.ErrConflict) || errors.Is(err, kv.ErrDeadlock)
+}
+
+func IsAfterCommitError(err error) (*AfterCommitError, bool) {
+	var e *AfterCommitError
+	if errors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
+
+// AfterCommitError means hooks failed after the transaction committed,
+// changes of the transaction are applied.
+type AfterCommitError struct {
+	Err error
+}
+
+func (a *AfterCommitError) Error() string {
+	return fmt.Sprintf("transaction committed, but hooks failed: %s", a.Err)
+}
+
+func (a *AfterCommitError) Unwrap() error {
+	return a.Err
+}
@@ -11,7 +11,33 @@ func Equal(a, b []byte) bool {
 	return bytes.Equal(a, b)
 }
 
+// Compare compares keys by values of them, length headers are read as Encoder writes them.
 func Compare(a, b []byte) int {
+	return compare(a, b, readLength)
+}
+
+// CompareLegacy compares keys as Compare did before length headers were read as encoded,
+// which reads them as uvarint, and orders keys with long strings, arrays or maps by mistake.
+// Only to read stores created before, keys should be moved to stores ordered by Compare.
+func CompareLegacy(a, b []byte) int {
+	return compare(a, b, readUvarintLength)
+}
+
+// lengthReader reads length header of the value v starts with the type,
+// returns the length and the size of the type and the header.
+type lengthReader = func(v []byte) (l uint64, n int)
+
+func readLength(v []byte) (uint64, int) {
+	n := 1 + sizeOfHeader(v[0])
+	return readHeader(v[1:n]), n
+}
+
+func readUvarintLength(v []byte) (uint64, int) {
+	l, n := binary.Uvarint(v[1:])
+	return l, n + 1
+}
+
+func compare(a, b []byte, readLength lengthReader) int {
 	var n, cmp int
 
 	for {
@@ -27,14 +53,14 @@ func Compare(a, b []byte) int {
 		a = a[n:]
 		b = b[n:]
 
-		cmp, n = compareNextValue(a, b)
+		cmp, n = compareNextValue(a, b, readLength)
 		if cmp != 0 {
 			return cmp
 		}
 	}
 }
 
-func compareNextValue(a, b []byte) (cmp int, n int) {
+func compareNextValue(a, b []byte, readLength lengthReader) (cmp int, n int) {
 	if len(a) == 0 || len(b) == 0 {
 		if len(a) == 0 && len(b) == 0 {
 			return 0, 0
@@ -85,23 +111,21 @@ func compareNextValue(a, b []byte) (cmp int, n int) {
 	case int8Value, uint8Value:
 		return bytes.Compare(a[1:2], b[1:2]), 2
 	case str8Value, str16Value, str32Value, bin8Value, bin16Value, bin32Value:
-		l, n := binary.Uvarint(a[1:])
-		n++
-		enda := n + int(l)
-		l, n = binary.Uvarint(b[1:])
-		n++
-		endb := n + int(l)
+		// headers of the same type are of the same size, except read as uvarint.
+		la, na := readLength(a)
+		lb, n := readLength(b)
+		enda := na + int(la)
+		endb := n + int(lb)
 		return bytes.Compare(a[n:enda], b[n:endb]), enda
 	case array16Value, array32Value:
-		la, _ := binary.Uvarint(a[1:])
-		lb, n := binary.Uvarint(b[1:])
+		la, _ := readLength(a)
+		lb, n := readLength(b)
 		minl := la
 		if lb < minl {
 			minl = lb
 		}
-		n++
 		for i := 0; i < int(minl); i++ {
-			cmp, nn := compareNextValue(a[n:], b[n:])
+			cmp, nn := compareNextValue(a[n:], b[n:], readLength)
 			n += nn
 			if cmp != 0 {
 				return cmp, n
@@ -116,23 +140,22 @@ func compareNextValue(a, b []byte) (cmp int, n int) {
 
 		return 0, n
 	case map16Value, map32Value:
-		la, _ := binary.Uvarint(a[1:])
-		lb, n := binary.Uvarint(b[1:])
+		la, _ := readLength(a)
+		lb, n := readLength(b)
 		minl := la
 		if lb < minl {
 			minl = lb
 		}
-		n++
 		for i := 0; i < int(minl); i++ {
 			// compare field
-			cmp, nn := compareNextValue(a[n:], b[n:])
+			cmp, nn := compareNextValue(a[n:], b[n:], readLength)
 			n += nn
 			if cmp != 0 {
 				return cmp, n
 			}
 
 			// compare value
-			cmp, nn = compareNextValue(a[n:], b[n:])
+			cmp, nn = compareNextValue(a[n:], b[n:], readLength)
 			n += nn
 			if cmp != 0 {
 				return cmp, n
@@ -151,15 +174,39 @@ func compareNextValue(a, b []byte) (cmp int, n int) {
 	panic(fmt.Sprintf("unsupported value type: %d", a[0]))
 }
 
-func Successor(dst, a []byte) []byte {
-	if len(a) == 0 {
-		return a
+// sizeOfNamespace is the size of uint64 namespace leading keys.
+const sizeOfNamespace = 9
+
+// namespaceOf returns the leading namespace of key, false when key not starts with uint64.
+func namespaceOf(key []byte) (uint64, bool) {
+	if len(key) < sizeOfNamespace || key[0] != uint64Value {
+		return 0, false
 	}
-	namespace := binary.BigEndian.Uint64(a[1:])
-	if namespace == math.MaxUint64 {
-		return a
+	return binary.BigEndian.Uint64(key[1:sizeOfNamespace]), true
+}
+
+// Separator appends a key k to dst, a <= k < b, which is shorter than a when possible.
+// Only keys of different namespaces are shortened to the namespace after a,
+// otherwise a is appended as is.
+func Separator(dst, a, b []byte) []byte {
+	if len(a) > sizeOfNamespace {
+		na, oka := namespaceOf(a)
+		nb, okb := namespaceOf(b)
+		// namespace only key na+1 is less than any key of namespace nb with values.
+		if oka && okb && na < math.MaxUint64 && (na+1 < nb || (na+1 == nb && len(b) > sizeOfNamespace)) {
+			return write8(dst, uint64Value, na+1)
+		}
+	}
+	return append(dst, a...)
+}
+
+// Successor appends a key k to dst, a <= k, which is shorter than a when possible.
+// Keys are shortened to the namespace after a, otherwise a is appended as is.
+func Successor(dst, a []byte) []byte {
+	if na, ok := namespaceOf(a); ok && na < math.MaxUint64 {
+		return write8(dst, uint64Value, na+1)
 	}
-	return write8(dst, uint64Value, namespace)
+	return append(dst, a...)
 }
 
 func AbbreviatedKey(key []byte) uint64 {
@@ -170,8 +217,15 @@ func AbbreviatedKey(key []byte) uint64 {
 	var abbv uint64
 
 	// get the namespace
-	namespace, n := binary.BigEndian.Uint64(key[1:]), 9
-	key = key[n:]
+	namespace, ok := namespaceOf(key)
+	if !ok {
+		// keys without namespace are ordered by type first.
+		if key[0] < uint64Value {
+			return 0
+		}
+		return math.MaxUint64
+	}
+	key = key[sizeOfNamespace:]
 	if namespace >= 1<<16 {
 		return math.MaxUint16 << 48
 	}
@@ -196,7 +250,8 @@ func AbbreviatedKey(key []byte) uint64 {
 
 // return the abbreviated value of the first value on max 5 bytes.
 func abbreviatedValue(key []byte) uint64 {
-	if len(key) == 0 {
+	// type code only, like bounds of types, less than all values of the type.
+	if len(key) < 1+sizeOfFixed(key[0]) || len(key) == 1 {
 		return 0
 	}
 
@@ -217,20 +272,25 @@ func abbreviatedValue(key []byte) uint64 {
 		return x >> 24
 	case str8Value, str16Value, str32Value, bin8Value, bin16Value, bin32Value:
 		var abbv uint64
-		l, n := binary.Uvarint(key[1:])
-		n++
+		n := 1 + sizeOfHeader(key[0])
+		if len(key) < n {
+			return 0
+		}
+		ll := int(readHeader(key[1:n]))
 		key = key[n:]
-		ll := int(l)
 		// put the first 5 bytes of the value
 		for i := 0; i < 5 && i < ll; i++ {
 			abbv |= uint64(key[i]) << (32 - uint64(i)*8)
 		}
 		return abbv
 	case array16Value, array32Value, map16Value, map32Value:
-		key = key[1:]
-		l, n := binary.Uvarint(key)
+		n := 1 + sizeOfHeader(key[0])
+		if len(key) < n {
+			return 0
+		}
+		l := readHeader(key[1:n])
 		key = key[n:]
-		if l > 0 {
+		if l > 0 && len(key) > 0 {
 			switch key[0] {
 			case array16Value, array32Value, map16Value, map32Value:
 				return uint64(key[0]) << 32
@@ -76,3 +76,117 @@ func TestOrdering(t *testing.T) {
 		}
 	}
 }
+
+func TestComparer(t *testing.T) {
+	key := func(ns uint64, values ...any) []byte {
+		b, _ := Marshal(ns)
+		for _, v := range values {
+			raw, _ := Marshal(v)
+			b = append(b, raw...)
+		}
+		return b
+	}
+
+	long := func(c byte, n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = c
+		}
+		return string(b)
+	}
+
+	// ordered keys
+	keys := [][]byte{
+		key(1),
+		key(1, int64(1)),
+		key(1, int64(1), "a"),
+		key(1, int64(2)),
+		// strings of the same type are compared by bytes
+		key(1, "a"),
+		key(1, long('a', 200)),
+		key(1, "b"),
+		key(1, long('b', 200)),
+		// longer strings are of larger type
+		key(1, long('a', 300)),
+		key(1, long('b', 300)),
+		key(1, []any{int64(1), int64(2)}),
+		key(1, []any{int64(1), int64(3)}),
+		key(1, []any{int64(1), int64(3), int64(1)}),
+		key(2),
+		key(2, int64(1)),
+		key(3, int64(1)),
+		key(1<<20, int64(1)),
+		key(math.MaxUint64, int64(1)),
+	}
+
+	t.Run("Compare", func(t *testing.T) {
+		for i := range keys {
+			for j := range keys {
+				cmp := Compare(keys[i], keys[j])
+				switch {
+				case i < j:
+					textingx.Expect(t, cmp < 0, textingx.Be(true))
+				case i > j:
+					textingx.Expect(t, cmp > 0, textingx.Be(true))
+				default:
+					textingx.Expect(t, cmp, textingx.Be(0))
+				}
+			}
+		}
+	})
+
+	t.Run("AbbreviatedKey", func(t *testing.T) {
+		for i := 1; i < len(keys); i++ {
+			textingx.Expect(t, AbbreviatedKey(keys[i-1]) <= AbbreviatedKey(keys[i]), textingx.Be(true))
+		}
+	})
+
+	t.Run("Separator", func(t *testing.T) {
+		for i := range keys {
+			for j := i + 1; j < len(keys); j++ {
+				s := Separator(nil, keys[i], keys[j])
+				textingx.Expect(t, Compare(keys[i], s) <= 0, textingx.Be(true))
+				textingx.Expect(t, Compare(s, keys[j]) < 0, textingx.Be(true))
+			}
+		}
+
+		textingx.Expect(t, Separator(nil, key(1, int64(1)), key(3, int64(1))), textingx.Equal(key(2)))
+		textingx.Expect(t, Separator(nil, key(1, int64(1)), key(2)), textingx.Equal(key(1, int64(1))))
+	})
+
+	t.Run("Successor", func(t *testing.T) {
+		for i := range keys {
+			s := Successor(nil, keys[i])
+			textingx.Expect(t, Compare(keys[i], s) <= 0, textingx.Be(true))
+		}
+
+		textingx.Expect(t, Successor(nil, key(1, int64(1))), textingx.Equal(key(2)))
+	})
+
+	t.Run("CompareLegacy", func(t *testing.T) {
+		sign := func(cmp int) int {
+			switch {
+			case cmp < 0:
+				return -1
+			case cmp > 0:
+				return 1
+			}
+			return 0
+		}
+
+		// keys without long strings, arrays or maps are ordered the same.
+		for i := range keys {
+			for j := range keys {
+				if len(keys[i]) > 16 || len(keys[j]) > 16 {
+					continue
+				}
+				textingx.Expect(t, sign(CompareLegacy(keys[i], keys[j])), textingx.Be(sign(Compare(keys[i], keys[j]))))
+			}
+		}
+
+		// header of str16 is read as uvarint of one byte.
+		a, b := key(1, long('b', 300)), key(1, long('a', 301))
+		textingx.Expect(t, Compare(a, b) > 0, textingx.Be(true))
+		textingx.Expect(t, CompareLegacy(a, b) < 0, textingx.Be(true))
+	})
+}
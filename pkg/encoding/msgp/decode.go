@@ -242,7 +242,9 @@ func (d *decodeState) array(bitSize int, rv reflect.Value) error {
 			d.saveError(&UnmarshalTypeError{Value: "array", Type: rv.Type(), Offset: int64(d.off)})
 			break
 		}
-		rv.Set(reflect.MakeSlice(reflect.TypeOf([]any{}), int(n), int(n)))
+		list := reflect.MakeSlice(reflect.TypeOf([]any{}), int(n), int(n))
+		rv.Set(list)
+		rv = list
 	case reflect.Slice:
 		rv.Set(reflect.MakeSlice(rv.Type(), int(n), int(n)))
 	}
@@ -500,7 +502,8 @@ func (d *decodeState) readCode() (byte, error) {
 
 func (d *decodeState) read(n int) ([]byte, error) {
 	part := make([]byte, n)
-	nn, err := d.Read(part)
+	// readers of stream could return less bytes than requested.
+	nn, err := io.ReadFull(d, part)
 	if err != nil {
 		return nil, err
 	}
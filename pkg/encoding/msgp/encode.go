@@ -42,9 +42,7 @@ type Encoded []byte
 func (e *encodeState) marshal(v any) (err error) {
 	if encoded, ok := v.(Encoded); ok {
 		_, err := e.Write(encoded)
-		if err != nil {
-			return err
-		}
+		return err
 	}
 
 	defer func() {
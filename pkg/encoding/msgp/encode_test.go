@@ -136,6 +136,10 @@ func TestMarshalUnmarshal(t *testing.T) {
 				[]any{int32(1), []any{}},
 				makeSizedValue(array16Value, 2, makeLit[int32](1), makeSizedValue(array16Value, 0)),
 			},
+			{
+				[]any{int32(1), []any{"a"}},
+				makeSizedValue(array16Value, 2, makeLit[int32](1), makeSizedValue(array16Value, 1, makeText("a"))),
+			},
 		}
 
 		for _, test := range tests {
@@ -299,6 +303,12 @@ func TestMarshalUnmarshal(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("encoded", func(t *testing.T) {
+		got, err := Marshal(Encoded(makeText("1")))
+		textingx.Expect(t, err, textingx.Be[error](nil))
+		textingx.Expect(t, got, textingx.Equal(makeText("1")))
+	})
 }
 
 func makeValue(typ byte, bytes ...[]byte) []byte {
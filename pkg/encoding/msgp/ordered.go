@@ -0,0 +1,242 @@
+package msgp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Ordered keys are transcoded from msgp encoded keys,
+// bytes.Compare of ordered keys is the same as Compare of original keys,
+// so keys could be stored in engines which order keys by bytes, like bbolt.
+//
+// Each value is transcoded with its type byte first, as Compare compares types first, then
+//   - fixed size values keep big-endian bytes as they are.
+//   - strings and binaries are escaped, 0x00 as 0x00 0xFF, and end with 0x00 0x01,
+//     then the length header of original value, which is only for decoding.
+//   - arrays and maps write 0x01 before each element, and end with 0x00, then the length header of original value.
+//
+// Length headers are read as Encoder writes them, big-endian with the size of the type.
+//
+// Values not complete, like prefixes used as bounds of iterators, are kept as they are,
+// they are never stored, so never decoded.
+
+// ErrInvalidOrderedKey means the key is not transcoded by EncodeOrderedKey.
+var ErrInvalidOrderedKey = errors.New("msgp: invalid ordered key")
+
+const (
+	orderedEscape        byte = 0x00
+	orderedEscaped       byte = 0xFF
+	orderedEndOfBytes    byte = 0x01
+	orderedElement       byte = 0x01
+	orderedEndOfElements byte = 0x00
+)
+
+func sizeOfFixed(typ byte) int {
+	switch typ {
+	case int64Value, uint64Value, float64Value:
+		return 8
+	case int32Value, uint32Value, float32Value:
+		return 4
+	case int16Value, uint16Value:
+		return 2
+	case int8Value, uint8Value:
+		return 1
+	}
+	return 0
+}
+
+func sizeOfHeader(typ byte) int {
+	switch typ {
+	case str8Value, bin8Value:
+		return 1
+	case str16Value, bin16Value, array16Value, map16Value:
+		return 2
+	case str32Value, bin32Value, array32Value, map32Value:
+		return 4
+	}
+	return 0
+}
+
+func readHeader(header []byte) uint64 {
+	switch len(header) {
+	case 1:
+		return uint64(header[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(header))
+	default:
+		return uint64(binary.BigEndian.Uint32(header))
+	}
+}
+
+// EncodeOrderedKey transcodes key to ordered key.
+func EncodeOrderedKey(k []byte) []byte {
+	if k == nil {
+		return nil
+	}
+
+	dst := make([]byte, 0, len(k)+8)
+	for len(k) > 0 {
+		dst, k = encodeOrderedValue(dst, k)
+	}
+	return dst
+}
+
+// encodeOrderedValue appends transcoded value of v to dst, returns bytes left after the value.
+func encodeOrderedValue(dst []byte, v []byte) ([]byte, []byte) {
+	typ := v[0]
+	dst = append(dst, typ)
+
+	switch typ {
+	case nullValue, falseValue, trueValue, 0:
+		return dst, v[1:]
+	}
+
+	if size := sizeOfFixed(typ); size > 0 {
+		if len(v) < 1+size {
+			return append(dst, v[1:]...), nil
+		}
+		return append(dst, v[1:1+size]...), v[1+size:]
+	}
+
+	n := sizeOfHeader(typ)
+	if n == 0 || len(v) < 1+n {
+		// unknown types like 0xFF appended as upper bound, or header not complete.
+		return append(dst, v[1:]...), nil
+	}
+
+	header := v[1 : 1+n]
+	l := readHeader(header)
+	v = v[1+n:]
+
+	switch typ {
+	case str8Value, str16Value, str32Value, bin8Value, bin16Value, bin32Value:
+		if uint64(len(v)) < l {
+			return append(append(dst, header...), v...), nil
+		}
+
+		for _, c := range v[0:l] {
+			if c == orderedEscape {
+				dst = append(dst, orderedEscape, orderedEscaped)
+				continue
+			}
+			dst = append(dst, c)
+		}
+
+		dst = append(dst, orderedEscape, orderedEndOfBytes)
+		dst = append(dst, header...)
+
+		return dst, v[l:]
+	}
+
+	if typ == map16Value || typ == map32Value {
+		// field and value
+		l = l * 2
+	}
+
+	for i := uint64(0); i < l; i++ {
+		if len(v) == 0 {
+			// elements not complete
+			return dst, nil
+		}
+		dst = append(dst, orderedElement)
+		dst, v = encodeOrderedValue(dst, v)
+	}
+
+	dst = append(dst, orderedEndOfElements)
+	dst = append(dst, header...)
+
+	return dst, v
+}
+
+// DecodeOrderedKey returns original key of ordered key.
+func DecodeOrderedKey(k []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(k))
+
+	var err error
+	for len(k) > 0 {
+		dst, k, err = decodeOrderedValue(dst, k)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dst, nil
+}
+
+func decodeOrderedValue(dst []byte, v []byte) ([]byte, []byte, error) {
+	typ := v[0]
+
+	switch typ {
+	case nullValue, falseValue, trueValue, 0:
+		return append(dst, typ), v[1:], nil
+	}
+
+	if size := sizeOfFixed(typ); size > 0 {
+		if len(v) < 1+size {
+			return nil, nil, ErrInvalidOrderedKey
+		}
+		return append(dst, v[0:1+size]...), v[1+size:], nil
+	}
+
+	n := sizeOfHeader(typ)
+	if n == 0 {
+		return nil, nil, ErrInvalidOrderedKey
+	}
+
+	// content or elements of original value
+	content := make([]byte, 0, len(v))
+
+	switch typ {
+	case str8Value, str16Value, str32Value, bin8Value, bin16Value, bin32Value:
+		i := 1
+		for {
+			if i+1 >= len(v) {
+				return nil, nil, ErrInvalidOrderedKey
+			}
+			if v[i] != orderedEscape {
+				content = append(content, v[i])
+				i++
+				continue
+			}
+			i += 2
+			if v[i-1] == orderedEscaped {
+				content = append(content, orderedEscape)
+				continue
+			}
+			if v[i-1] != orderedEndOfBytes {
+				return nil, nil, ErrInvalidOrderedKey
+			}
+			break
+		}
+		v = v[i:]
+	default:
+		v = v[1:]
+		for {
+			if len(v) == 0 {
+				return nil, nil, ErrInvalidOrderedKey
+			}
+			if v[0] == orderedEndOfElements {
+				v = v[1:]
+				break
+			}
+			if v[0] != orderedElement || len(v) < 2 {
+				return nil, nil, ErrInvalidOrderedKey
+			}
+			var err error
+			content, v, err = decodeOrderedValue(content, v[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if len(v) < n {
+		return nil, nil, ErrInvalidOrderedKey
+	}
+
+	dst = append(dst, typ)
+	dst = append(dst, v[0:n]...)
+	dst = append(dst, content...)
+
+	return dst, v[n:], nil
+}
@@ -0,0 +1,117 @@
+package msgp
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	textingx "github.com/octohelm/x/testing"
+)
+
+func TestOrderedKey(t *testing.T) {
+	values := []any{
+		nil,
+		false,
+		true,
+		math.SmallestNonzeroFloat64,
+		float64(100),
+		int64(math.MinInt64),
+		int64(-2),
+		int64(0),
+		int64(279),
+		uint64(1),
+		uint64(math.MaxUint64),
+		"",
+		"1",
+		"1\x00",
+		"1\x00\x00",
+		"1\x001",
+		"12",
+		"中文",
+		[]byte{},
+		[]byte{0},
+		[]byte{0, 1},
+	}
+
+	keys := make([][]byte, 0, len(values)*len(values))
+
+	// composite keys like [namespace, ...values]
+	for i := range values {
+		for j := range values {
+			buf := bytes.NewBuffer(nil)
+			enc := NewEncoder(buf)
+			textingx.Expect(t, enc.Encode(uint64(1)), textingx.Be[error](nil))
+			textingx.Expect(t, enc.Encode(values[i]), textingx.Be[error](nil))
+			textingx.Expect(t, enc.Encode(values[j]), textingx.Be[error](nil))
+			keys = append(keys, buf.Bytes())
+		}
+	}
+
+	// values with length headers larger than one byte.
+	ordered := []any{
+		strings.Repeat("a", 200),
+		strings.Repeat("a", 200) + "b",
+		strings.Repeat("b", 70000),
+		[]any{},
+		[]any{int64(1)},
+		[]any{int64(1), "a"},
+		[]any{int64(1), "a\x00"},
+		[]any{int64(2)},
+		[]any{[]any{"a"}, "b"},
+		[]any{[]any{"a", "b"}},
+		map[string]any{"a": int64(1)},
+		map[string]any{"a": int64(1), "b": int64(1)},
+		map[string]any{"a": int64(2)},
+	}
+
+	t.Run("ordering of long strings, arrays and maps", func(t *testing.T) {
+		for i := 1; i < len(ordered); i++ {
+			a, _ := Marshal(ordered[i-1])
+			b, _ := Marshal(ordered[i])
+			textingx.Expect(t, Compare(a, b) < 0, textingx.Be(true))
+			textingx.Expect(t, bytes.Compare(EncodeOrderedKey(a), EncodeOrderedKey(b)) < 0, textingx.Be(true))
+		}
+	})
+
+	t.Run("ordering", func(t *testing.T) {
+		for _, a := range keys {
+			for _, b := range keys {
+				textingx.Expect(t, sign(bytes.Compare(EncodeOrderedKey(a), EncodeOrderedKey(b))), textingx.Be(sign(Compare(a, b))))
+			}
+		}
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		prefix := keys[len(values)][0:9]
+		upper := append(append([]byte(nil), prefix...), 0xFF)
+
+		for _, k := range keys {
+			textingx.Expect(t, bytes.Compare(EncodeOrderedKey(k), EncodeOrderedKey(prefix)) > 0, textingx.Be(true))
+			textingx.Expect(t, bytes.Compare(EncodeOrderedKey(k), EncodeOrderedKey(upper)) < 0, textingx.Be(true))
+		}
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		for _, v := range ordered {
+			k, _ := Marshal(v)
+			keys = append(keys, k)
+		}
+
+		for _, k := range keys {
+			decoded, err := DecodeOrderedKey(EncodeOrderedKey(k))
+			textingx.Expect(t, err, textingx.Be[error](nil))
+			textingx.Expect(t, decoded, textingx.Equal(k))
+		}
+	})
+}
+
+func sign(v int) int {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	textingx "github.com/octohelm/x/testing"
 )
@@ -31,3 +32,23 @@ func TestStream(t *testing.T) {
 
 	textingx.Expect(t, outputs, textingx.Equal(inputs))
 }
+
+func TestStreamShortRead(t *testing.T) {
+	inputs := []any{[]byte(strings.Repeat("v", 100)), "s"}
+
+	buf := bytes.NewBuffer(nil)
+
+	encoder := NewEncoder(buf)
+	for i := range inputs {
+		textingx.Expect(t, encoder.Encode(inputs[i]), textingx.Be[error](nil))
+	}
+
+	outputs := make([]any, len(inputs))
+	decoder := NewDecoder(iotest.OneByteReader(buf))
+
+	for i := range outputs {
+		textingx.Expect(t, decoder.Decode(&outputs[i]), textingx.Be[error](nil))
+	}
+
+	textingx.Expect(t, outputs, textingx.Equal(inputs))
+}
@@ -0,0 +1,207 @@
+package bbolt
+
+import (
+	"math"
+	"time"
+
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+)
+
+var _ kv.Session = (*BatchSession)(nil)
+var _ kv.Restamper = (*BatchSession)(nil)
+
+// reads of batch sessions see the latest committed state, without undo logs.
+const latest = math.MaxUint64
+
+// BatchSession keeps changes in memory until committed, all changes are written in one bbolt transaction,
+// reads see changes of the session over the latest committed state.
+type BatchSession struct {
+	store *store
+	txn   *kv.Txn
+	// changes of ordered keys, value nil means deleted
+	changes   *changes
+	closed    bool
+	committed bool
+	// bytes of keys and values written
+	size int
+	seq  uint64
+}
+
+func (s *BatchSession) Commit(opts ...kv.CommitOptionFunc) error {
+	if s.closed {
+		return errors.New("already closed")
+	}
+
+	startedAt := time.Now()
+	err := s.commit(opts...)
+	s.store.metrics.ObserveCommit(startedAt, s.size, err)
+	return err
+}
+
+func (s *BatchSession) commit(opts ...kv.CommitOptionFunc) error {
+	opt := &kv.CommitOption{
+		Durability: kv.DurabilitySync,
+	}
+	for i := range opts {
+		opts[i](opt)
+	}
+
+	// commits are always synced, see NewStore.
+	if !opt.Durability.IsValid() {
+		return errors.Errorf("unsupported durability %q", opt.Durability)
+	}
+
+	err := s.txn.Commit(func(seq uint64) error {
+		if err := s.store.apply(seq, s.changes); err != nil {
+			return err
+		}
+		s.seq = seq
+		return nil
+	})
+	if err != nil {
+		// session could not be used after commit failed
+		_ = s.Close()
+		return err
+	}
+
+	s.committed = true
+
+	return s.Close()
+}
+
+func (s *BatchSession) Close() error {
+	if s.closed {
+		return errors.New("already closed")
+	}
+	s.closed = true
+	s.store.metrics.BatchSessionClosed()
+	defer s.store.gate.Leave()
+	s.txn.Discard()
+	s.changes = nil
+	return nil
+}
+
+func (s *BatchSession) Sequence() uint64 {
+	return s.seq
+}
+
+// Get returns a value associated with the given key. If not found, returns ErrKeyNotFound.
+func (s *BatchSession) Get(k []byte) (value []byte, err error) {
+	s.txn.Read(k)
+
+	key := msgp.EncodeOrderedKey(k)
+
+	if i, ok := s.changes.Get(item{key: key}); ok {
+		if i.value == nil {
+			return nil, errors.WithStack(kv.ErrKeyNotFound)
+		}
+		return append([]byte(nil), i.value...), nil
+	}
+
+	err = s.store.view(latest, func(b *bbolt.Bucket, logs []*undoLog) error {
+		value, err = get(b, logs, key)
+		return err
+	})
+	return
+}
+
+// Restamp treats the key as read again at the last commit, see kv.Restamper.
+func (s *BatchSession) Restamp(k []byte) {
+	s.txn.Restamp(k)
+}
+
+// Exists returns whether a key exists and is visible by the current session.
+func (s *BatchSession) Exists(k []byte) (bool, error) {
+	_, err := s.Get(k)
+	if err != nil {
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Insert inserts a key-value pair. If it already exists, it returns ErrKeyAlreadyExists.
+func (s *BatchSession) Insert(k, v []byte) error {
+	if len(k) == 0 {
+		return errors.New("cannot store empty key")
+	}
+
+	if len(v) == 0 {
+		return errors.New("cannot store empty value")
+	}
+
+	ok, err := s.Exists(k)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return kv.ErrKeyAlreadyExists
+	}
+
+	s.set(k, v)
+	return nil
+}
+
+// Put stores a key value pair. If it already exists, it overrides it.
+func (s *BatchSession) Put(k, v []byte) error {
+	if len(k) == 0 {
+		return errors.New("cannot store empty key")
+	}
+
+	if len(v) == 0 {
+		return errors.New("cannot store empty value")
+	}
+
+	s.set(k, v)
+	return nil
+}
+
+// Delete a record by key. If the key doesn't exist, it doesn't do anything.
+func (s *BatchSession) Delete(k []byte) error {
+	s.set(k, nil)
+	return nil
+}
+
+// set copies value, callers may reuse it.
+func (s *BatchSession) set(k, v []byte) {
+	s.txn.Write(k)
+	s.size += len(k) + len(v)
+
+	i := item{key: msgp.EncodeOrderedKey(k)}
+	if v != nil {
+		i.value = append([]byte(nil), v...)
+	}
+	s.changes.ReplaceOrInsert(i)
+}
+
+// DeleteRange deletes keys in [start, end), nil start means unbounded, end is required.
+// Keys in range are read and deleted one by one, bbolt has no range tombstones.
+func (s *BatchSession) DeleteRange(start []byte, end []byte) error {
+	if len(end) == 0 {
+		return errors.New("cannot delete range without end")
+	}
+
+	s.txn.WriteRange(start, end)
+	s.size += len(start) + len(end)
+
+	it := s.store.iterator(latest, s.changes.Clone(), start, end)
+	for it.First(); it.Valid(); it.Next() {
+		s.changes.ReplaceOrInsert(item{key: msgp.EncodeOrderedKey(it.Key())})
+	}
+	if err := it.Error(); err != nil {
+		_ = it.Close()
+		return err
+	}
+	return it.Close()
+}
+
+func (s *BatchSession) Iterator(start []byte, end []byte) kv.Iterator {
+	s.txn.ReadRange(start, end)
+	// changes after iterator created are not visible.
+	return s.store.iterator(latest, s.changes.Clone(), start, end)
+}
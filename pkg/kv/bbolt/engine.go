@@ -0,0 +1,49 @@
+package bbolt
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+)
+
+func init() {
+	kv.RegisterEngine("bbolt", &engine{})
+}
+
+type engine struct {
+}
+
+// New opens store of the file Extra["path"], directories of the file are created if not exists.
+func (e engine) New(opt kv.Options) (kv.Store, error) {
+	path, ok := opt.Extra["path"]
+	if !ok || path == "" {
+		return nil, errors.New("engine bbolt need `path`")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return nil, err
+	}
+
+	db, err := Open(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStore(db, opt)
+}
+
+// Open a database, fails when the file locked by others over a second, instead of waiting forever.
+func Open(path string, opts *bbolt.Options) (*bbolt.DB, error) {
+	if opts == nil {
+		opts = &bbolt.Options{
+			Timeout: time.Second,
+		}
+	}
+	return bbolt.Open(path, 0o600, opts)
+}
+
+type DB = bbolt.DB
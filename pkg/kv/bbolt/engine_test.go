@@ -0,0 +1,268 @@
+package bbolt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/octohelm/kiwidb/pkg/kv/kvtest"
+	. "github.com/octohelm/x/testing"
+)
+
+func newStore(t testing.TB) kv.Store {
+	s, err := kv.NewStore("bbolt", kv.Options{
+		Extra: map[string]string{
+			"path": filepath.Join(t.TempDir(), "kiwi.db"),
+		},
+	})
+	Expect(t, err, Be[error](nil))
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+	return s
+}
+
+func TestEngine(t *testing.T) {
+	kvtest.RunSuite(t, newStore)
+}
+
+func TestSnapshotSession(t *testing.T) {
+	key := kvtest.Key
+
+	t.Run("undo logs kept until sessions closed", func(t *testing.T) {
+		s := newStore(t)
+
+		put := func(v string) {
+			sess := s.NewBatchSession("test")
+			Expect(t, sess.Put(key(1), []byte(v)), Be[error](nil))
+			Expect(t, sess.Put(key(2, uint64(len(v))), []byte(v)), Be[error](nil))
+			Expect(t, sess.Commit(), Be[error](nil))
+		}
+
+		put("1")
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		for i := 0; i < kv.DefaultMaxRetainedCommits*2; i++ {
+			put("22")
+		}
+
+		v, err := r.Get(key(1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, string(v), Be("1"))
+
+		it := r.Iterator(key(2), key(3))
+		// only original values in bounds merged.
+		Expect(t, it.(*iterator).changes.Len(), Be(1))
+		Expect(t, kvtest.Collect(it, false), Equal([][]byte{key(2, 1)}))
+		Expect(t, it.Close(), Be[error](nil))
+
+		r2, err := s.NewSnapshotSessionAt("test", r.Sequence()+1)
+		Expect(t, err, Be[error](nil))
+		Expect(t, r2.Close(), Be[error](nil))
+	})
+
+	t.Run("undo logs over budget dropped even if needed", func(t *testing.T) {
+		s := newStore(t)
+		st := s.(*store)
+		st.maxLogBytes = 1024
+
+		put := func(v string) {
+			sess := s.NewBatchSession("test")
+			Expect(t, sess.Put(key(1), []byte(v)), Be[error](nil))
+			Expect(t, sess.Commit(), Be[error](nil))
+		}
+
+		put("1")
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		for i := 0; i < 4; i++ {
+			put(strings.Repeat("2", 512))
+		}
+
+		_, err := r.Get(key(1))
+		Expect(t, errors.Is(err, kv.ErrSequenceUnavailable), Be(true))
+
+		it := r.Iterator(nil, nil)
+		Expect(t, it.First(), Be(false))
+		Expect(t, errors.Is(it.Error(), kv.ErrSequenceUnavailable), Be(true))
+		Expect(t, it.Close(), Be[error](nil))
+
+		st.mu.RLock()
+		Expect(t, st.logBytes <= st.maxLogBytes, Be(true))
+		st.mu.RUnlock()
+
+		latest := s.NewSnapshotSession("test")
+		defer latest.Close()
+		v, err := latest.Get(key(1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, string(v), Be(strings.Repeat("2", 512)))
+	})
+
+	t.Run("old sequences not retained", func(t *testing.T) {
+		s := newStore(t)
+
+		for i := 0; i < kv.DefaultMaxRetainedCommits*2; i++ {
+			sess := s.NewBatchSession("test")
+			Expect(t, sess.Put(key(1), []byte("1")), Be[error](nil))
+			Expect(t, sess.Commit(), Be[error](nil))
+		}
+
+		_, err := s.NewSnapshotSessionAt("test", 1)
+		Expect(t, errors.Is(err, kv.ErrSequenceUnavailable), Be(true))
+	})
+
+	t.Run("sequences continue after reopened", func(t *testing.T) {
+		opt := kv.Options{
+			Extra: map[string]string{
+				"path": filepath.Join(t.TempDir(), "kiwi.db"),
+			},
+		}
+
+		s, err := kv.NewStore("bbolt", opt)
+		Expect(t, err, Be[error](nil))
+
+		sess := s.NewBatchSession("test")
+		Expect(t, sess.Put(key(1), []byte("1")), Be[error](nil))
+		Expect(t, sess.Commit(), Be[error](nil))
+		seq := sess.Sequence()
+
+		Expect(t, s.Shutdown(context.Background()), Be[error](nil))
+
+		s, err = kv.NewStore("bbolt", opt)
+		Expect(t, err, Be[error](nil))
+		defer s.Shutdown(context.Background())
+
+		r, err := s.NewSnapshotSessionAt("test", seq)
+		Expect(t, err, Be[error](nil))
+		Expect(t, r.Close(), Be[error](nil))
+
+		_, err = s.NewSnapshotSessionAt("test", seq-1)
+		Expect(t, errors.Is(err, kv.ErrSequenceUnavailable), Be(true))
+
+		sess = s.NewBatchSession("test")
+		Expect(t, sess.Put(key(1), []byte("2")), Be[error](nil))
+		Expect(t, sess.Commit(), Be[error](nil))
+		Expect(t, sess.Sequence(), Be(seq+1))
+	})
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	s := newStore(t)
+
+	counter := kvtest.Key(1)
+
+	incr := func() error {
+		for {
+			sess := s.NewBatchSession("test")
+
+			n := uint64(0)
+			v, err := sess.Get(counter)
+			if err == nil {
+				n = binary.BigEndian.Uint64(v)
+			} else if !errors.Is(err, kv.ErrKeyNotFound) {
+				_ = sess.Close()
+				return err
+			}
+
+			next := make([]byte, 8)
+			binary.BigEndian.PutUint64(next, n+1)
+
+			if err := sess.Put(counter, next); err != nil {
+				_ = sess.Close()
+				return err
+			}
+
+			err = sess.Commit(kv.WithDurability(kv.DurabilityGroupCommit))
+			if errors.Is(err, kv.ErrConflict) {
+				continue
+			}
+			return err
+		}
+	}
+
+	workers, times := 8, 10
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, workers*2)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; j++ {
+				if err := incr(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; j++ {
+				r := s.NewSnapshotSession("test")
+				it := r.Iterator(nil, nil)
+				for it.First(); it.Valid(); it.Next() {
+				}
+				_ = it.Close()
+				_ = r.Close()
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		Expect(t, err, Be[error](nil))
+	}
+
+	r := s.NewSnapshotSession("test")
+	defer r.Close()
+
+	v, err := r.Get(counter)
+	Expect(t, err, Be[error](nil))
+	Expect(t, binary.BigEndian.Uint64(v), Be(uint64(workers*times)))
+}
+
+func TestCheckpoint(t *testing.T) {
+	key := kvtest.Key
+
+	s := newStore(t)
+
+	sess := s.NewBatchSession("test")
+	Expect(t, sess.Put(key(1), []byte("1")), Be[error](nil))
+	Expect(t, sess.Commit(), Be[error](nil))
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	Expect(t, s.Checkpoint(dir), Be[error](nil))
+
+	t.Run("opened as store", func(t *testing.T) {
+		c, err := kv.NewStore("bbolt", kv.Options{
+			Extra: map[string]string{
+				"path": filepath.Join(dir, "kiwi.db"),
+			},
+		})
+		Expect(t, err, Be[error](nil))
+		defer c.Shutdown(context.Background())
+
+		r := c.NewSnapshotSession("test")
+		defer r.Close()
+
+		v, err := r.Get(key(1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, string(v), Be("1"))
+	})
+
+	t.Run("dir exists", func(t *testing.T) {
+		Expect(t, s.Checkpoint(dir), Not(Be[error](nil)))
+	})
+}
@@ -0,0 +1,286 @@
+package bbolt
+
+import (
+	"bytes"
+
+	"github.com/google/btree"
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"go.etcd.io/bbolt"
+)
+
+// degree of b-trees of changes
+const degree = 32
+
+type item struct {
+	// ordered key
+	key []byte
+	// nil means the key deleted
+	value []byte
+}
+
+// changes are ordered by ordered keys, same as bbolt.
+type changes = btree.BTreeG[item]
+
+func newChanges() *changes {
+	return btree.NewG(degree, func(a, b item) bool {
+		return bytes.Compare(a.key, b.key) < 0
+	})
+}
+
+var _ kv.Iterator = (*iterator)(nil)
+
+// iterator iterates items of bbolt, merged with changes over them when changes not nil,
+// like changes of the batch session, or original values of keys committed after the snapshot.
+//
+// Iterator seeks from the current key for each move, so changes and cursor could move independently.
+// The read transaction is held until the iterator closed.
+type iterator struct {
+	tx      *bbolt.Tx
+	cursor  *bbolt.Cursor
+	changes *changes
+	start   []byte
+	end     []byte
+
+	current item
+	// original key of current item
+	key   []byte
+	valid bool
+	err   error
+}
+
+func (it *iterator) First() bool {
+	return it.seekForward(it.start, true)
+}
+
+func (it *iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	return it.seekForward(it.current.key, false)
+}
+
+func (it *iterator) Last() bool {
+	if it.end == nil {
+		return it.seekBackward(nil, true)
+	}
+	return it.seekBackward(it.end, false)
+}
+
+func (it *iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	return it.seekBackward(it.current.key, false)
+}
+
+// SeekGE moves to the first key greater than or equal to k, k is transcoded as ordered key first.
+func (it *iterator) SeekGE(k []byte) bool {
+	key := msgp.EncodeOrderedKey(k)
+	if it.start != nil && bytes.Compare(key, it.start) < 0 {
+		key = it.start
+	}
+	return it.seekForward(key, true)
+}
+
+// SeekLT moves to the last key less than k, k is transcoded as ordered key first.
+func (it *iterator) SeekLT(k []byte) bool {
+	key := msgp.EncodeOrderedKey(k)
+	if it.end != nil && bytes.Compare(key, it.end) > 0 {
+		key = it.end
+	}
+	return it.seekBackward(key, false)
+}
+
+func (it *iterator) seekForward(k []byte, inclusive bool) bool {
+	// failed to begin
+	if it.cursor == nil {
+		return false
+	}
+	for {
+		i, ok := it.merge(k, inclusive, true)
+		if !ok || (it.end != nil && bytes.Compare(i.key, it.end) >= 0) {
+			return it.invalidate()
+		}
+		if i.value == nil {
+			// deleted, skip it
+			k, inclusive = i.key, false
+			continue
+		}
+		return it.at(i)
+	}
+}
+
+func (it *iterator) seekBackward(k []byte, inclusive bool) bool {
+	if it.cursor == nil {
+		return false
+	}
+	for {
+		i, ok := it.merge(k, inclusive, false)
+		if !ok || (it.start != nil && bytes.Compare(i.key, it.start) < 0) {
+			return it.invalidate()
+		}
+		if i.value == nil {
+			k, inclusive = i.key, false
+			continue
+		}
+		return it.at(i)
+	}
+}
+
+// merge returns the nearest item of cursor and changes in the direction,
+// item of changes wins when both have the same key.
+func (it *iterator) merge(k []byte, inclusive bool, forward bool) (item, bool) {
+	var b, c item
+	var bok, cok bool
+
+	direction := 1
+	if forward {
+		b, bok = it.ceil(k, inclusive)
+		if it.changes != nil {
+			c, cok = ceil(it.changes, k, inclusive)
+		}
+	} else {
+		direction = -1
+		b, bok = it.floor(k, inclusive)
+		if it.changes != nil {
+			c, cok = floor(it.changes, k, inclusive)
+		}
+	}
+
+	switch {
+	case !cok:
+		return b, bok
+	case !bok:
+		return c, cok
+	}
+
+	if bytes.Compare(b.key, c.key)*direction < 0 {
+		return b, true
+	}
+	return c, true
+}
+
+func (it *iterator) ceil(k []byte, inclusive bool) (item, bool) {
+	var key, value []byte
+
+	if k == nil {
+		key, value = it.cursor.First()
+	} else {
+		key, value = it.cursor.Seek(k)
+		if key != nil && !inclusive && bytes.Equal(key, k) {
+			key, value = it.cursor.Next()
+		}
+	}
+
+	return item{key: key, value: value}, key != nil
+}
+
+func (it *iterator) floor(k []byte, inclusive bool) (item, bool) {
+	var key, value []byte
+
+	if k == nil {
+		key, value = it.cursor.Last()
+	} else {
+		key, value = it.cursor.Seek(k)
+		if key == nil {
+			key, value = it.cursor.Last()
+		} else if c := bytes.Compare(key, k); c > 0 || (c == 0 && !inclusive) {
+			key, value = it.cursor.Prev()
+		}
+	}
+
+	return item{key: key, value: value}, key != nil
+}
+
+func (it *iterator) at(i item) bool {
+	k, err := msgp.DecodeOrderedKey(i.key)
+	if err != nil {
+		it.err = err
+		return it.invalidate()
+	}
+	it.current = i
+	it.key = k
+	it.valid = true
+	return true
+}
+
+// contains returns whether ordered key k is in [start, end) of the iterator.
+func (it *iterator) contains(k []byte) bool {
+	if it.start != nil && bytes.Compare(k, it.start) < 0 {
+		return false
+	}
+	return it.end == nil || bytes.Compare(k, it.end) < 0
+}
+
+func (it *iterator) invalidate() bool {
+	it.current = item{}
+	it.key = nil
+	it.valid = false
+	return false
+}
+
+func (it *iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *iterator) Error() error {
+	return it.err
+}
+
+func (it *iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns value of current key, which is valid until next move.
+func (it *iterator) Value() []byte {
+	return it.current.value
+}
+
+func (it *iterator) Close() error {
+	it.invalidate()
+	if it.tx == nil {
+		return nil
+	}
+	tx := it.tx
+	it.tx = nil
+	return tx.Rollback()
+}
+
+// ceil returns the first change after k, or equals k when inclusive, nil k means from the min.
+func ceil(t *changes, k []byte, inclusive bool) (found item, ok bool) {
+	fn := func(i item) bool {
+		if !inclusive && bytes.Equal(i.key, k) {
+			return true
+		}
+		found, ok = i, true
+		return false
+	}
+
+	if k == nil {
+		t.Ascend(fn)
+	} else {
+		t.AscendGreaterOrEqual(item{key: k}, fn)
+	}
+
+	return
+}
+
+// floor returns the last change before k, or equals k when inclusive, nil k means from the max.
+func floor(t *changes, k []byte, inclusive bool) (found item, ok bool) {
+	fn := func(i item) bool {
+		if !inclusive && bytes.Equal(i.key, k) {
+			return true
+		}
+		found, ok = i, true
+		return false
+	}
+
+	if k == nil {
+		t.Descend(fn)
+	} else {
+		t.DescendLessOrEqual(item{key: k}, fn)
+	}
+
+	return
+}
@@ -0,0 +1,77 @@
+package bbolt
+
+import (
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+)
+
+var _ kv.Session = (*SnapshotSession)(nil)
+
+type SnapshotSession struct {
+	store  *store
+	seq    uint64
+	closed bool
+}
+
+func (s *SnapshotSession) Commit(opts ...kv.CommitOptionFunc) error {
+	return errors.New("cannot commit in read-only mode")
+}
+
+func (s *SnapshotSession) Close() error {
+	if s.closed {
+		return errors.New("already closed")
+	}
+	s.closed = true
+	s.store.metrics.SnapshotSessionClosed()
+	defer s.store.gate.Leave()
+	s.store.unpin(s.seq)
+	return nil
+}
+
+func (s *SnapshotSession) Sequence() uint64 {
+	return s.seq
+}
+
+func (s *SnapshotSession) Insert(k, v []byte) error {
+	return errors.New("cannot insert in read-only mode")
+}
+
+func (s *SnapshotSession) Put(k, v []byte) error {
+	return errors.New("cannot put in read-only mode")
+}
+
+// Get returns a value associated with the given key. If not found, returns ErrKeyNotFound.
+func (s *SnapshotSession) Get(k []byte) (value []byte, err error) {
+	err = s.store.view(s.seq, func(b *bbolt.Bucket, logs []*undoLog) error {
+		value, err = get(b, logs, msgp.EncodeOrderedKey(k))
+		return err
+	})
+	return
+}
+
+// Exists returns whether a key exists and is visible by the current session.
+func (s *SnapshotSession) Exists(k []byte) (bool, error) {
+	_, err := s.Get(k)
+	if err != nil {
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete a record by key. If not found, returns ErrKeyNotFound.
+func (s *SnapshotSession) Delete(k []byte) error {
+	return errors.New("cannot delete in read-only mode")
+}
+
+func (s *SnapshotSession) DeleteRange(start []byte, end []byte) error {
+	return errors.New("cannot delete in read-only mode")
+}
+
+func (s *SnapshotSession) Iterator(start []byte, end []byte) kv.Iterator {
+	return s.store.iterator(s.seq, nil, start, end)
+}
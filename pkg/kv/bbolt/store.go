@@ -0,0 +1,439 @@
+package bbolt
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+)
+
+var _ kv.Locker = (*store)(nil)
+
+// all keys are stored in one bucket, as pebble does.
+var bucketName = []byte("kiwidb")
+
+// bucket of states of the store, like sequenceKey.
+var metaBucketName = []byte("kiwidb.meta")
+
+// key of the sequence of last commit, persisted with changes of each commit.
+var sequenceKey = []byte("sequence")
+
+// bytes of keys and values of undo logs kept for read sessions,
+// undo logs over it are dropped even if needed, then read sessions of sequences before fail with kv.ErrSequenceUnavailable.
+const maxUndoLogBytes = 64 << 20
+
+// NewStore creates kv.Store of bbolt.
+//
+// Read transactions of bbolt could block commits when the file grows,
+// so they are only held during each read or iteration, never by sessions.
+// Read sessions see the state of their sequences by original values of keys
+// recorded by commits after, in undo logs kept in memory, bounded by maxUndoLogBytes.
+//
+// Commits are always synced whatever kv.Durability,
+// as bbolt without sync could corrupt the file once power lost, not only lose recent commits.
+// Sequences continue from the one persisted by commits before.
+func NewStore(db *bbolt.DB, opts kv.Options) (kv.Store, error) {
+	if opts.MaxRetainedCommits <= 0 {
+		opts.MaxRetainedCommits = kv.DefaultMaxRetainedCommits
+	}
+
+	seq := uint64(0)
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketName); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(sequenceKey); v != nil {
+			if len(v) != 8 {
+				return errors.New("invalid sequence persisted")
+			}
+			seq = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st := &store{
+		db:     db,
+		opts:   opts,
+		oracle: kv.NewOracleAt(msgp.Compare, seq),
+		seq:    seq,
+		oldest: seq,
+		locks:  kv.NewLockTable(),
+		pins:   map[uint64]int{},
+
+		maxLogBytes: maxUndoLogBytes,
+
+		metrics: kv.NewSessionMetrics(),
+		gate:    kv.NewSessionGate(),
+	}
+
+	st.oracle.Observe(func(seq uint64, clean bool) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		// sequences of commits failed are the same state as the last commit.
+		if seq > st.seq {
+			st.seq = seq
+		}
+	})
+
+	return st, nil
+}
+
+type store struct {
+	db     *bbolt.DB
+	opts   kv.Options
+	oracle *kv.Oracle
+	locks  *kv.LockTable
+	// metrics of sessions
+	metrics *kv.SessionMetrics
+	// open sessions waited on shutdown
+	gate *kv.SessionGate
+
+	mu sync.RWMutex
+	// sequence of last commit applied
+	seq uint64
+	// states before oldest could not be read, as undo logs dropped
+	oldest uint64
+	// undo logs of recent commits in order of sequences
+	logs []*undoLog
+	// bytes of undo logs
+	logBytes    int
+	maxLogBytes int
+	// count of read sessions of each sequence, undo logs after them are kept until sessions closed.
+	pins map[uint64]int
+}
+
+// undoLog records original values of keys changed by the commit.
+type undoLog struct {
+	seq uint64
+	// bytes of keys and values
+	size int
+	// values of ordered keys, nil means not exists before
+	values map[string][]byte
+}
+
+func (s *store) Locks() *kv.LockTable {
+	return s.locks
+}
+
+// Stats returns metrics of sessions and bbolt.
+func (s *store) Stats() kv.Stats {
+	stats := s.metrics.Stats()
+
+	m := s.db.Stats()
+
+	s.mu.RLock()
+	logs := len(s.logs)
+	s.mu.RUnlock()
+
+	stats.Engine = map[string]float64{
+		"read_transactions_total": float64(m.TxN),
+		"open_read_transactions":  float64(m.OpenTxN),
+		"free_pages":              float64(m.FreePageN),
+		"pending_pages":           float64(m.PendingPageN),
+		"freelist_inuse_bytes":    float64(m.FreelistInuse),
+		"write_seconds_total":     m.TxStats.WriteTime.Seconds(),
+		"undo_logs":               float64(logs),
+	}
+
+	return stats
+}
+
+func (s *store) Sync() error {
+	return s.db.Sync()
+}
+
+// Checkpoint copies the database file into dir with the same file name, in a read transaction.
+func (s *store) Checkpoint(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return errors.Errorf("checkpoint %s already exists", dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return tx.CopyFile(filepath.Join(dir, filepath.Base(s.db.Path())), 0o600)
+	})
+}
+
+// Shutdown rejects new sessions, waits for open sessions closed, then closes db.
+func (s *store) Shutdown(ctx context.Context) error {
+	return s.gate.Close(ctx, s.db.Close)
+}
+
+func (s *store) NewSnapshotSessionAt(dbName string, seq uint64) (kv.Session, error) {
+	if err := s.gate.Enter(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq < s.oldest || seq > s.seq {
+		s.gate.Leave()
+		return nil, errors.Wrapf(kv.ErrSequenceUnavailable, "read at %d", seq)
+	}
+
+	s.pins[seq]++
+	s.metrics.SnapshotSessionOpened()
+
+	return &SnapshotSession{
+		store: s,
+		seq:   seq,
+	}, nil
+}
+
+// NewSnapshotSession creates read session of the last commit.
+func (s *store) NewSnapshotSession(dbName string) kv.Session {
+	if err := s.gate.Enter(); err != nil {
+		return kv.RejectedSession(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pins[s.seq]++
+	s.metrics.SnapshotSessionOpened()
+
+	return &SnapshotSession{
+		store: s,
+		seq:   s.seq,
+	}
+}
+
+func (s *store) NewBatchSession(dbName string) kv.Session {
+	if err := s.gate.Enter(); err != nil {
+		return kv.RejectedSession(err)
+	}
+
+	s.metrics.BatchSessionOpened()
+
+	return &BatchSession{
+		store:   s,
+		txn:     s.oracle.Begin(),
+		changes: newChanges(),
+	}
+}
+
+func (s *store) unpin(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pins[seq]--
+	if s.pins[seq] <= 0 {
+		delete(s.pins, seq)
+	}
+
+	s.trim()
+}
+
+// trim drops undo logs over kv.Options.MaxRetainedCommits, unless needed by read sessions,
+// undo logs over maxLogBytes are always dropped.
+func (s *store) trim() {
+	for len(s.logs) > 0 {
+		oldest := s.logs[0]
+		// commit in progress
+		if oldest.seq > s.seq {
+			return
+		}
+
+		if s.logBytes <= s.maxLogBytes {
+			if len(s.logs) <= s.opts.MaxRetainedCommits {
+				return
+			}
+			for seq := range s.pins {
+				if seq < oldest.seq {
+					return
+				}
+			}
+		}
+
+		s.logs = s.logs[1:]
+		s.logBytes -= oldest.size
+		s.oldest = oldest.seq
+	}
+}
+
+// apply writes changes in a bbolt transaction,
+// must be called in kv.Txn.Commit, which serializes all commits.
+func (s *store) apply(seq uint64, changes *changes) error {
+	log := &undoLog{
+		seq:    seq,
+		values: map[string][]byte{},
+	}
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketName)
+
+		var err error
+
+		changes.Ascend(func(i item) bool {
+			if _, ok := log.values[string(i.key)]; !ok {
+				// values of bbolt are only valid in the transaction
+				if v := b.Get(i.key); v != nil {
+					log.values[string(i.key)] = append([]byte(nil), v...)
+				} else {
+					log.values[string(i.key)] = nil
+				}
+				log.size += len(i.key) + len(log.values[string(i.key)])
+			}
+
+			if i.value == nil {
+				err = b.Delete(i.key)
+			} else {
+				err = b.Put(i.key, i.value)
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, seq)
+		if err := tx.Bucket(metaBucketName).Put(sequenceKey, v); err != nil {
+			return err
+		}
+
+		// published before changes committed, as original values are the same as the state before committed,
+		// reads of sequences before could see changes or not.
+		s.mu.Lock()
+		s.logs = append(s.logs, log)
+		s.logBytes += log.size
+		s.mu.Unlock()
+
+		return nil
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		for i := len(s.logs) - 1; i >= 0; i-- {
+			if s.logs[i] == log {
+				s.logs = append(s.logs[0:i], s.logs[i+1:]...)
+				s.logBytes -= log.size
+				break
+			}
+		}
+		return err
+	}
+
+	s.seq = seq
+	s.trim()
+
+	return nil
+}
+
+// view reads in a read transaction with undo logs of commits after seq,
+// callers should apply undo logs in order, the first original value found for a key wins.
+func (s *store) view(seq uint64, fn func(b *bbolt.Bucket, logs []*undoLog) error) error {
+	tx, logs, err := s.begin(seq)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	return fn(tx.Bucket(bucketName), logs)
+}
+
+// begin starts read transaction, then collects undo logs after seq.
+//
+// Undo logs are published before changes committed, so logs of all commits visible to the transaction are collected,
+// logs of commits not visible are collected too, but original values of them are the same as the transaction sees.
+// bbolt transactions are started out of mu, as starting could wait for commits growing the file.
+func (s *store) begin(seq uint64) (*bbolt.Tx, []*undoLog, error) {
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if seq < s.oldest {
+		_ = tx.Rollback()
+		return nil, nil, errors.Wrapf(kv.ErrSequenceUnavailable, "read at %d", seq)
+	}
+
+	var logs []*undoLog
+
+	for i, l := range s.logs {
+		if l.seq > seq {
+			logs = append(logs, s.logs[i:]...)
+			break
+		}
+	}
+
+	return tx, logs, nil
+}
+
+// iterator creates iterator of state at seq merged with changes.
+// changes of batch session should be read at the latest sequence, changes win over undo logs.
+func (s *store) iterator(seq uint64, changes *changes, start []byte, end []byte) kv.Iterator {
+	it := &iterator{
+		start: msgp.EncodeOrderedKey(start),
+		end:   msgp.EncodeOrderedKey(end),
+	}
+
+	tx, logs, err := s.begin(seq)
+	if err != nil {
+		it.err = err
+		return it
+	}
+
+	// only original values of keys in [start, end) are merged, the iterator never moves out of them.
+	for _, l := range logs {
+		for k, v := range l.values {
+			i := item{key: []byte(k), value: v}
+			if !it.contains(i.key) {
+				continue
+			}
+			if changes == nil {
+				changes = newChanges()
+			}
+			if !changes.Has(i) {
+				changes.ReplaceOrInsert(i)
+			}
+		}
+	}
+
+	it.tx = tx
+	it.cursor = tx.Bucket(bucketName).Cursor()
+	it.changes = changes
+
+	return it
+}
+
+// get returns copy of value of ordered key.
+func get(b *bbolt.Bucket, logs []*undoLog, k []byte) ([]byte, error) {
+	for _, l := range logs {
+		if v, ok := l.values[string(k)]; ok {
+			if v == nil {
+				return nil, errors.WithStack(kv.ErrKeyNotFound)
+			}
+			return append([]byte(nil), v...), nil
+		}
+	}
+
+	v := b.Get(k)
+	if v == nil {
+		return nil, errors.WithStack(kv.ErrKeyNotFound)
+	}
+
+	return append([]byte(nil), v...), nil
+}
@@ -2,9 +2,16 @@ package kv
 
 import "github.com/pkg/errors"
 
+// DefaultMaxRetainedCommits is the default of Options.MaxRetainedCommits.
+const DefaultMaxRetainedCommits = 16
+
 type Options struct {
 	MaxBatchSize int
-	Extra        map[string]string
+	// MaxRetainedCommits is the count of recent commits retained for read sessions pinned to commit sequences,
+	// DefaultMaxRetainedCommits when not positive.
+	MaxRetainedCommits int
+	// Extra options of engine, like pebble.ExtraPath, each engine validates its own keys.
+	Extra map[string]string
 }
 
 type StoreEngine interface {
@@ -7,4 +7,12 @@ var (
 	ErrKeyAlreadyExists = errors.New("key already exists")
 	ErrMethodNotAllowed = errors.New("method is not allowd")
 	ErrNonexistentDB    = errors.New("db file does not exist")
+	// ErrConflict means changes of session conflict with others committed, the whole transaction could be retried.
+	ErrConflict = errors.New("transaction conflict")
+	// ErrSequenceUnavailable means snapshot of the commit sequence is not retained, like too old or not committed yet.
+	ErrSequenceUnavailable = errors.New("sequence unavailable")
+	// ErrDeadlock means waiting for the lock would deadlock, the whole transaction could be retried.
+	ErrDeadlock = errors.New("deadlock")
+	// ErrStoreClosed means the store is shutting down or closed, new sessions are rejected.
+	ErrStoreClosed = errors.New("store closed")
 )
@@ -0,0 +1,149 @@
+package kv
+
+import (
+	"context"
+	"sync"
+)
+
+// NewSessionGate creates SessionGate for stores to shut down gracefully.
+func NewSessionGate() *SessionGate {
+	return &SessionGate{}
+}
+
+// SessionGate tracks open sessions of store,
+// once closing, new sessions are rejected, and the store is closed after open sessions all closed.
+type SessionGate struct {
+	mu      sync.Mutex
+	closing bool
+	closed  bool
+	// count of sessions entered not left
+	open int
+	// closed once closing and no sessions open
+	drained chan struct{}
+}
+
+// Enter should be called when session opening, returns ErrStoreClosed once closing.
+func (g *SessionGate) Enter() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closing {
+		return ErrStoreClosed
+	}
+	g.open++
+	return nil
+}
+
+// Leave should be called once for each session entered when closed.
+func (g *SessionGate) Leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.open--
+	if g.closing && g.open == 0 {
+		close(g.drained)
+	}
+}
+
+// Close rejects new sessions, waits until open sessions all closed, then calls fn once.
+// Returns ctx.Err() if ctx done before, the store keeps rejecting new sessions, and Close could be called again.
+// Returns ErrStoreClosed if closed before.
+func (g *SessionGate) Close(ctx context.Context, fn func() error) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return ErrStoreClosed
+	}
+	if !g.closing {
+		g.closing = true
+		g.drained = make(chan struct{})
+		if g.open == 0 {
+			close(g.drained)
+		}
+	}
+	drained := g.drained
+	g.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-drained:
+	}
+
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return ErrStoreClosed
+	}
+	g.closed = true
+	g.mu.Unlock()
+
+	return fn()
+}
+
+// RejectedSession returns Session which all methods fail with err,
+// for stores rejected to create sessions, like ErrStoreClosed.
+func RejectedSession(err error) Session {
+	return &rejectedSession{err: err}
+}
+
+type rejectedSession struct {
+	err error
+}
+
+func (s *rejectedSession) Insert(k, v []byte) error {
+	return s.err
+}
+
+func (s *rejectedSession) Put(k, v []byte) error {
+	return s.err
+}
+
+func (s *rejectedSession) Get(k []byte) ([]byte, error) {
+	return nil, s.err
+}
+
+func (s *rejectedSession) Commit(opts ...CommitOptionFunc) error {
+	return s.err
+}
+
+// Close does nothing, so the session could be closed as others.
+func (s *rejectedSession) Close() error {
+	return nil
+}
+
+func (s *rejectedSession) Exists(k []byte) (bool, error) {
+	return false, s.err
+}
+
+func (s *rejectedSession) Delete(k []byte) error {
+	return s.err
+}
+
+func (s *rejectedSession) DeleteRange(start []byte, end []byte) error {
+	return s.err
+}
+
+func (s *rejectedSession) Iterator(start []byte, end []byte) Iterator {
+	return &rejectedIterator{err: s.err}
+}
+
+func (s *rejectedSession) Sequence() uint64 {
+	return 0
+}
+
+type rejectedIterator struct {
+	err error
+}
+
+func (it *rejectedIterator) First() bool          { return false }
+func (it *rejectedIterator) Next() bool           { return false }
+func (it *rejectedIterator) Last() bool           { return false }
+func (it *rejectedIterator) Prev() bool           { return false }
+func (it *rejectedIterator) SeekGE(k []byte) bool { return false }
+func (it *rejectedIterator) SeekLT(k []byte) bool { return false }
+func (it *rejectedIterator) Valid() bool          { return false }
+func (it *rejectedIterator) Error() error         { return it.err }
+func (it *rejectedIterator) Key() []byte          { return nil }
+func (it *rejectedIterator) Value() []byte        { return nil }
+func (it *rejectedIterator) Close() error         { return nil }
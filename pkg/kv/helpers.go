@@ -1,15 +1,25 @@
 package kv
 
-func DeleteRange(s Session, start, end []byte) error {
-	it := s.Iterator(start, end)
-	defer it.Close()
-
-	for it.First(); it.Valid(); it.Next() {
-		err := s.Delete(it.Key())
-		if err != nil {
-			return err
-		}
+import "context"
+
+// CheckContextInterval is the count of keys between checks of context in long iterations.
+const CheckContextInterval = 128
+
+// DeleteRange deletes keys in [start, end) by Session.DeleteRange, returns ctx.Err() if ctx done.
+func DeleteRange(ctx context.Context, s Session, start, end []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	return s.DeleteRange(start, end)
+}
+
+// PrefixEnd returns the exclusive upper bound of keys with the prefix,
+// prefix should be complete encoded values, keys are ordered value by value.
+func PrefixEnd(prefix []byte) []byte {
+	return append(append([]byte(nil), prefix...), 0xFF)
+}
 
-	return nil
+// PrefixIterator iterates keys with the prefix, see PrefixEnd.
+func PrefixIterator(s Session, prefix []byte) Iterator {
+	return s.Iterator(prefix, PrefixEnd(prefix))
 }
@@ -0,0 +1,92 @@
+// Package kvprom exports kv.Stats in Prometheus text format.
+package kvprom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/octohelm/kiwidb/pkg/kv"
+)
+
+// prefix of all metrics
+const namespace = "kiwidb_kv"
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler serves stats of the store in Prometheus text format.
+func Handler(s kv.Store) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		_ = WriteText(rw, s.Stats())
+	})
+}
+
+// WriteText writes stats in Prometheus text format,
+// engine metrics are named with prefix kiwidb_kv_engine_.
+func WriteText(w io.Writer, stats kv.Stats) error {
+	b := bufio.NewWriter(w)
+
+	writeMetric(b, "open_snapshot_sessions", "gauge", "Count of read sessions not closed.", float64(stats.OpenSnapshotSessions))
+	writeMetric(b, "open_batch_sessions", "gauge", "Count of write sessions not closed.", float64(stats.OpenBatchSessions))
+	writeMetric(b, "commits_total", "counter", "Count of write sessions committed.", float64(stats.Commits))
+	writeMetric(b, "conflicts_total", "counter", "Count of commits failed by conflicts.", float64(stats.Conflicts))
+	writeHistogram(b, "commit_latency_seconds", "Latency of commits.", stats.CommitLatency)
+	writeHistogram(b, "batch_size_bytes", "Bytes of keys and values written by commits.", stats.BatchSize)
+
+	names := make([]string, 0, len(stats.Engine))
+	for name := range stats.Engine {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		typ := "gauge"
+		if strings.HasSuffix(name, "_total") {
+			typ = "counter"
+		}
+		writeMetric(b, "engine_"+name, typ, "Engine metric "+name+".", stats.Engine[name])
+	}
+
+	return b.Flush()
+}
+
+func writeMetric(w io.Writer, name string, typ string, help string, value float64) {
+	name = namespace + "_" + name
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	_, _ = fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func writeHistogram(w io.Writer, name string, help string, h kv.HistogramStats) {
+	name = namespace + "_" + name
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	_, _ = fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	for _, bucket := range h.Buckets {
+		_, _ = fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(bucket.UpperBound), bucket.Count)
+	}
+
+	_, _ = fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(math.Inf(1)), h.Count)
+	_, _ = fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.Sum))
+	_, _ = fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,49 @@
+package kvprom
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/octohelm/kiwidb/pkg/kv/kvtest"
+	_ "github.com/octohelm/kiwidb/pkg/kv/memory"
+	. "github.com/octohelm/x/testing"
+)
+
+func TestHandler(t *testing.T) {
+	s, err := kv.NewStore("memory", kv.Options{})
+	Expect(t, err, Be[error](nil))
+	defer s.Shutdown(context.Background())
+
+	sess := s.NewBatchSession("test")
+	Expect(t, sess.Put(kvtest.Key(1), []byte("1")), Be[error](nil))
+	Expect(t, sess.Commit(), Be[error](nil))
+
+	r := s.NewSnapshotSession("test")
+	defer r.Close()
+
+	rw := httptest.NewRecorder()
+	Handler(s).ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+
+	Expect(t, rw.Header().Get("Content-Type"), Be(contentType))
+
+	data, _ := io.ReadAll(rw.Body)
+	text := string(data)
+
+	for _, line := range []string{
+		"# TYPE kiwidb_kv_commits_total counter",
+		"kiwidb_kv_commits_total 1",
+		"kiwidb_kv_open_snapshot_sessions 1",
+		"kiwidb_kv_open_batch_sessions 0",
+		"# TYPE kiwidb_kv_commit_latency_seconds histogram",
+		`kiwidb_kv_commit_latency_seconds_bucket{le="+Inf"} 1`,
+		`kiwidb_kv_batch_size_bytes_bucket{le="256"} 1`,
+		"kiwidb_kv_batch_size_bytes_count 1",
+		"kiwidb_kv_engine_keys 1",
+	} {
+		Expect(t, strings.Contains(text, line+"\n"), Be(true))
+	}
+}
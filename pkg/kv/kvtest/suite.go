@@ -0,0 +1,699 @@
+// Package kvtest provides conformance tests for kv.StoreEngine implementations.
+package kvtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	. "github.com/octohelm/x/testing"
+)
+
+// EngineFactory creates an empty store for each test, the store should be shut down by the factory on cleanup.
+type EngineFactory = func(t testing.TB) kv.Store
+
+// RunSuite checks the store created by newStore follows the contract of kv.Store, kv.Session and kv.Iterator.
+func RunSuite(t *testing.T, newStore EngineFactory) {
+	t.Run("Session", func(t *testing.T) {
+		testSession(t, newStore)
+	})
+	t.Run("Iterator", func(t *testing.T) {
+		testIterator(t, newStore)
+	})
+	t.Run("Snapshot", func(t *testing.T) {
+		testSnapshot(t, newStore)
+	})
+	t.Run("Conflict", func(t *testing.T) {
+		testConflict(t, newStore)
+	})
+	t.Run("Stats", func(t *testing.T) {
+		testStats(t, newStore)
+	})
+	t.Run("Shutdown", func(t *testing.T) {
+		testShutdown(t, newStore)
+	})
+}
+
+func testSession(t *testing.T, newStore EngineFactory) {
+	t.Run("Put then Get", func(t *testing.T) {
+		s := newStore(t)
+
+		sess := s.NewBatchSession("test")
+		Expect(t, sess.Put(Key(1), []byte("1")), Be[error](nil))
+		Expect(t, sess.Put(Key(1), []byte("2")), Be[error](nil))
+		expectValue(t, sess, Key(1), "2")
+		Expect(t, sess.Commit(), Be[error](nil))
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+		expectValue(t, r, Key(1), "2")
+	})
+
+	t.Run("Get missing key", func(t *testing.T) {
+		s := newStore(t)
+
+		sess := s.NewBatchSession("test")
+		defer sess.Close()
+
+		_, err := sess.Get(Key(1))
+		Expect(t, errors.Is(err, kv.ErrKeyNotFound), Be(true))
+
+		ok, err := sess.Exists(Key(1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(false))
+	})
+
+	t.Run("Insert existing key", func(t *testing.T) {
+		s := newStore(t)
+
+		commit(t, s, func(sess kv.Session) {
+			Expect(t, sess.Insert(Key(1), []byte("1")), Be[error](nil))
+		})
+
+		sess := s.NewBatchSession("test")
+		defer sess.Close()
+
+		Expect(t, errors.Is(sess.Insert(Key(1), []byte("2")), kv.ErrKeyAlreadyExists), Be(true))
+		Expect(t, sess.Insert(Key(2), []byte("2")), Be[error](nil))
+		Expect(t, errors.Is(sess.Insert(Key(2), []byte("2")), kv.ErrKeyAlreadyExists), Be(true))
+		expectValue(t, sess, Key(1), "1")
+	})
+
+	t.Run("empty key or value", func(t *testing.T) {
+		s := newStore(t)
+
+		sess := s.NewBatchSession("test")
+		defer sess.Close()
+
+		Expect(t, sess.Put(nil, []byte("1")), Not(Be[error](nil)))
+		Expect(t, sess.Put(Key(1), nil), Not(Be[error](nil)))
+		Expect(t, sess.Insert(nil, []byte("1")), Not(Be[error](nil)))
+		Expect(t, sess.Insert(Key(1), nil), Not(Be[error](nil)))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := newStore(t)
+
+		commit(t, s, func(sess kv.Session) {
+			Expect(t, sess.Put(Key(1), []byte("1")), Be[error](nil))
+		})
+
+		commit(t, s, func(sess kv.Session) {
+			Expect(t, sess.Delete(Key(1)), Be[error](nil))
+
+			ok, err := sess.Exists(Key(1))
+			Expect(t, err, Be[error](nil))
+			Expect(t, ok, Be(false))
+
+			// deleting missing key does nothing
+			Expect(t, sess.Delete(Key(2)), Be[error](nil))
+		})
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		_, err := r.Get(Key(1))
+		Expect(t, errors.Is(err, kv.ErrKeyNotFound), Be(true))
+	})
+
+	t.Run("DeleteRange", func(t *testing.T) {
+		s := newStore(t)
+
+		commit(t, s, func(sess kv.Session) {
+			for i := uint64(1); i <= 4; i++ {
+				Expect(t, sess.Put(Key(i), []byte("1")), Be[error](nil))
+				Expect(t, sess.Put(Key(i, 1), []byte("1")), Be[error](nil))
+			}
+		})
+
+		commit(t, s, func(sess kv.Session) {
+			// written by the session before are deleted too
+			Expect(t, sess.Put(Key(2, 2), []byte("2")), Be[error](nil))
+			Expect(t, sess.DeleteRange(Key(2), Key(4)), Be[error](nil))
+
+			ok, err := sess.Exists(Key(2, 2))
+			Expect(t, err, Be[error](nil))
+			Expect(t, ok, Be(false))
+
+			// written after are kept
+			Expect(t, sess.Put(Key(3, 3), []byte("3")), Be[error](nil))
+
+			// deleting empty range does nothing
+			Expect(t, sess.DeleteRange(Key(5), Key(6)), Be[error](nil))
+			Expect(t, sess.DeleteRange(Key(1), nil), Not(Be[error](nil)))
+		})
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		it := r.Iterator(nil, nil)
+		defer it.Close()
+
+		Expect(t, Collect(it, false), Equal([][]byte{
+			Key(1), Key(1, 1),
+			Key(3, 3),
+			Key(4), Key(4, 1),
+		}))
+	})
+
+	t.Run("values returned could be changed by callers", func(t *testing.T) {
+		s := newStore(t)
+
+		v := []byte("1")
+
+		commit(t, s, func(sess kv.Session) {
+			Expect(t, sess.Put(Key(1), v), Be[error](nil))
+			v[0] = '2'
+
+			got, err := sess.Get(Key(1))
+			Expect(t, err, Be[error](nil))
+			got[0] = '3'
+		})
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+		expectValue(t, r, Key(1), "1")
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		s := newStore(t)
+
+		sess := s.NewBatchSession("test")
+		Expect(t, sess.Put(Key(1), []byte("1")), Be[error](nil))
+		Expect(t, sess.Close(), Be[error](nil))
+		Expect(t, sess.Close(), Not(Be[error](nil)))
+		Expect(t, sess.Commit(), Not(Be[error](nil)))
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		ok, err := r.Exists(Key(1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(false))
+	})
+
+	t.Run("Sequence", func(t *testing.T) {
+		s := newStore(t)
+
+		sess := s.NewBatchSession("test")
+		Expect(t, sess.Sequence(), Be(uint64(0)))
+		Expect(t, sess.Put(Key(1), []byte("1")), Be[error](nil))
+		Expect(t, sess.Commit(), Be[error](nil))
+
+		seq := sess.Sequence()
+		Expect(t, seq > 0, Be(true))
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+		Expect(t, r.Sequence(), Be(seq))
+	})
+}
+
+func testIterator(t *testing.T, newStore EngineFactory) {
+	s := newStore(t)
+
+	commit(t, s, func(sess kv.Session) {
+		for i := uint64(1); i <= 5; i++ {
+			Expect(t, sess.Put(Key(i), Key(i)), Be[error](nil))
+			Expect(t, sess.Put(Key(i, 1), Key(i, 1)), Be[error](nil))
+		}
+	})
+
+	cases := []struct {
+		name       string
+		start, end []byte
+		keys       [][]byte
+	}{
+		{
+			name: "unbounded",
+			keys: [][]byte{Key(1), Key(1, 1), Key(2), Key(2, 1), Key(3), Key(3, 1), Key(4), Key(4, 1), Key(5), Key(5, 1)},
+		},
+		{
+			name:  "lower bound inclusive, upper bound exclusive",
+			start: Key(2), end: Key(4),
+			keys: [][]byte{Key(2), Key(2, 1), Key(3), Key(3, 1)},
+		},
+		{
+			name:  "only lower bound",
+			start: Key(4, 1),
+			keys:  [][]byte{Key(4, 1), Key(5), Key(5, 1)},
+		},
+		{
+			name: "only upper bound",
+			end:  Key(1, 1),
+			keys: [][]byte{Key(1)},
+		},
+		{
+			name:  "empty range",
+			start: Key(6), end: Key(7),
+			keys: [][]byte{},
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+
+		t.Run(c.name, func(t *testing.T) {
+			r := s.NewSnapshotSession("test")
+			defer r.Close()
+
+			it := r.Iterator(c.start, c.end)
+			defer it.Close()
+
+			Expect(t, Collect(it, false), Equal(c.keys))
+			Expect(t, Collect(it, true), Equal(reversed(c.keys)))
+			Expect(t, it.Error(), Be[error](nil))
+		})
+	}
+
+	t.Run("values", func(t *testing.T) {
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		it := r.Iterator(Key(3), Key(4))
+		defer it.Close()
+
+		for it.First(); it.Valid(); it.Next() {
+			Expect(t, it.Value(), Equal(it.Key()))
+		}
+	})
+
+	t.Run("change direction", func(t *testing.T) {
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		it := r.Iterator(nil, nil)
+		defer it.Close()
+
+		Expect(t, it.First(), Be(true))
+		Expect(t, it.Next(), Be(true))
+		Expect(t, it.Key(), Equal(Key(1, 1)))
+		Expect(t, it.Prev(), Be(true))
+		Expect(t, it.Key(), Equal(Key(1)))
+		Expect(t, it.Prev(), Be(false))
+		Expect(t, it.Valid(), Be(false))
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		it := r.Iterator(Key(2), Key(4))
+		defer it.Close()
+
+		Expect(t, it.SeekGE(Key(3)), Be(true))
+		Expect(t, it.Key(), Equal(Key(3)))
+		Expect(t, it.SeekGE(Key(2, 0)), Be(true))
+		Expect(t, it.Key(), Equal(Key(2, 1)))
+		Expect(t, it.Next(), Be(true))
+		Expect(t, it.Key(), Equal(Key(3)))
+
+		Expect(t, it.SeekLT(Key(3)), Be(true))
+		Expect(t, it.Key(), Equal(Key(2, 1)))
+		Expect(t, it.Prev(), Be(true))
+		Expect(t, it.Key(), Equal(Key(2)))
+
+		// bounded by the range
+		Expect(t, it.SeekGE(Key(1)), Be(true))
+		Expect(t, it.Key(), Equal(Key(2)))
+		Expect(t, it.SeekLT(Key(5)), Be(true))
+		Expect(t, it.Key(), Equal(Key(3, 1)))
+		Expect(t, it.SeekGE(Key(4)), Be(false))
+		Expect(t, it.SeekLT(Key(2)), Be(false))
+		Expect(t, it.Valid(), Be(false))
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		it := kv.PrefixIterator(r, Key(3))
+		defer it.Close()
+
+		Expect(t, Collect(it, false), Equal([][]byte{Key(3), Key(3, 1)}))
+		Expect(t, Collect(it, true), Equal([][]byte{Key(3, 1), Key(3)}))
+	})
+
+	t.Run("changes of batch session", func(t *testing.T) {
+		sess := s.NewBatchSession("test")
+		defer sess.Close()
+
+		Expect(t, sess.Delete(Key(2)), Be[error](nil))
+		Expect(t, sess.Put(Key(2, 2), []byte("2.2")), Be[error](nil))
+
+		it := sess.Iterator(Key(2), Key(3))
+		defer it.Close()
+
+		Expect(t, Collect(it, false), Equal([][]byte{Key(2, 1), Key(2, 2)}))
+		Expect(t, Collect(it, true), Equal([][]byte{Key(2, 2), Key(2, 1)}))
+
+		Expect(t, it.SeekGE(Key(2)), Be(true))
+		Expect(t, it.Key(), Equal(Key(2, 1)))
+		Expect(t, it.SeekLT(Key(2, 2)), Be(true))
+		Expect(t, it.Key(), Equal(Key(2, 1)))
+		Expect(t, it.SeekLT(Key(2, 1)), Be(false))
+	})
+}
+
+func testSnapshot(t *testing.T, newStore EngineFactory) {
+	t.Run("isolated from changes committed after created", func(t *testing.T) {
+		s := newStore(t)
+
+		commit(t, s, func(sess kv.Session) {
+			Expect(t, sess.Put(Key(1), []byte("1")), Be[error](nil))
+		})
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		commit(t, s, func(sess kv.Session) {
+			Expect(t, sess.Put(Key(1), []byte("2")), Be[error](nil))
+			Expect(t, sess.Put(Key(2), []byte("2")), Be[error](nil))
+		})
+
+		expectValue(t, r, Key(1), "1")
+
+		it := r.Iterator(nil, nil)
+		defer it.Close()
+		Expect(t, Collect(it, false), Equal([][]byte{Key(1)}))
+	})
+
+	t.Run("isolated from changes not committed", func(t *testing.T) {
+		s := newStore(t)
+
+		w := s.NewBatchSession("test")
+		defer w.Close()
+		Expect(t, w.Put(Key(1), []byte("1")), Be[error](nil))
+
+		r := s.NewSnapshotSession("test")
+		defer r.Close()
+
+		ok, err := r.Exists(Key(1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(false))
+	})
+
+	t.Run("read at sequence", func(t *testing.T) {
+		s := newStore(t)
+
+		w := s.NewBatchSession("test")
+		Expect(t, w.Put(Key(1), []byte("1")), Be[error](nil))
+		Expect(t, w.Commit(), Be[error](nil))
+
+		commit(t, s, func(sess kv.Session) {
+			Expect(t, sess.Put(Key(1), []byte("2")), Be[error](nil))
+		})
+
+		r, err := s.NewSnapshotSessionAt("test", w.Sequence())
+		Expect(t, err, Be[error](nil))
+		defer r.Close()
+
+		Expect(t, r.Sequence(), Be(w.Sequence()))
+		expectValue(t, r, Key(1), "1")
+
+		_, err = s.NewSnapshotSessionAt("test", w.Sequence()+100)
+		Expect(t, errors.Is(err, kv.ErrSequenceUnavailable), Be(true))
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		s := newStore(t)
+
+		r := s.NewSnapshotSession("test")
+
+		Expect(t, r.Put(Key(1), []byte("1")), Not(Be[error](nil)))
+		Expect(t, r.Insert(Key(1), []byte("1")), Not(Be[error](nil)))
+		Expect(t, r.Delete(Key(1)), Not(Be[error](nil)))
+		Expect(t, r.DeleteRange(Key(1), Key(2)), Not(Be[error](nil)))
+		Expect(t, r.Commit(), Not(Be[error](nil)))
+
+		Expect(t, r.Close(), Be[error](nil))
+		Expect(t, r.Close(), Not(Be[error](nil)))
+	})
+}
+
+func testConflict(t *testing.T, newStore EngineFactory) {
+	t.Run("read then written by others", func(t *testing.T) {
+		s := newStore(t)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		_, err := s1.Exists(Key(1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, s1.Put(Key(2), []byte("1")), Be[error](nil))
+
+		Expect(t, s2.Put(Key(1), []byte("2")), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+
+		Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+	})
+
+	t.Run("range read then written by others", func(t *testing.T) {
+		s := newStore(t)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		it := s1.Iterator(Key(1), Key(2))
+		for it.First(); it.Valid(); it.Next() {
+		}
+		Expect(t, it.Close(), Be[error](nil))
+		Expect(t, s1.Put(Key(3), []byte("1")), Be[error](nil))
+
+		Expect(t, s2.Insert(Key(1, 1), []byte("2")), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+
+		Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+	})
+
+	t.Run("range deleted then written by others", func(t *testing.T) {
+		s := newStore(t)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		Expect(t, s1.DeleteRange(Key(1), Key(2)), Be[error](nil))
+
+		Expect(t, s2.Insert(Key(1, 1), []byte("2")), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+
+		Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+	})
+
+	t.Run("read then range deleted by others", func(t *testing.T) {
+		s := newStore(t)
+
+		commit(t, s, func(sess kv.Session) {
+			Expect(t, sess.Put(Key(1, 1), []byte("1")), Be[error](nil))
+		})
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		expectValue(t, s1, Key(1, 1), "1")
+		Expect(t, s1.Put(Key(3), []byte("1")), Be[error](nil))
+
+		Expect(t, s2.DeleteRange(Key(1), Key(2)), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+
+		Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+	})
+
+	t.Run("range deleted then range deleted by others", func(t *testing.T) {
+		s := newStore(t)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+		s3 := s.NewBatchSession("test")
+
+		Expect(t, s1.DeleteRange(Key(1), Key(3)), Be[error](nil))
+		Expect(t, s2.DeleteRange(Key(2), Key(4)), Be[error](nil))
+		Expect(t, s3.DeleteRange(Key(3), Key(5)), Be[error](nil))
+
+		Expect(t, s2.Commit(), Be[error](nil))
+		Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+		Expect(t, errors.Is(s3.Commit(), kv.ErrConflict), Be(true))
+	})
+
+	t.Run("touched different keys", func(t *testing.T) {
+		s := newStore(t)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		Expect(t, s1.Insert(Key(1), []byte("1")), Be[error](nil))
+		Expect(t, s2.Insert(Key(2), []byte("2")), Be[error](nil))
+
+		Expect(t, s2.Commit(), Be[error](nil))
+		Expect(t, s1.Commit(), Be[error](nil))
+	})
+
+	t.Run("read then restamped after written by others", func(t *testing.T) {
+		s := newStore(t)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		it := s1.Iterator(Key(1), Key(2))
+		for it.First(); it.Valid(); it.Next() {
+		}
+		Expect(t, it.Close(), Be[error](nil))
+		_, err := s1.Exists(Key(1, 1))
+		Expect(t, err, Be[error](nil))
+
+		Expect(t, s2.Insert(Key(1, 1), []byte("2")), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+
+		r, ok := s1.(kv.Restamper)
+		Expect(t, ok, Be(true))
+		r.Restamp(Key(1, 1))
+
+		expectValue(t, s1, Key(1, 1), "2")
+		Expect(t, s1.Put(Key(1, 1), []byte("3")), Be[error](nil))
+		Expect(t, s1.Commit(), Be[error](nil))
+
+		t.Run("written by others after restamped", func(t *testing.T) {
+			s1 := s.NewBatchSession("test")
+			s2 := s.NewBatchSession("test")
+
+			expectValue(t, s1, Key(1, 1), "3")
+			s1.(kv.Restamper).Restamp(Key(1, 1))
+			Expect(t, s1.Put(Key(3), []byte("1")), Be[error](nil))
+
+			Expect(t, s2.Put(Key(1, 1), []byte("4")), Be[error](nil))
+			Expect(t, s2.Commit(), Be[error](nil))
+
+			Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+		})
+	})
+}
+
+func testStats(t *testing.T, newStore EngineFactory) {
+	s := newStore(t)
+
+	r := s.NewSnapshotSession("test")
+	w := s.NewBatchSession("test")
+
+	stats := s.Stats()
+	Expect(t, stats.OpenSnapshotSessions, Be(int64(1)))
+	Expect(t, stats.OpenBatchSessions, Be(int64(1)))
+
+	Expect(t, w.Put(Key(1), []byte("1")), Be[error](nil))
+	Expect(t, w.Commit(), Be[error](nil))
+	Expect(t, r.Close(), Be[error](nil))
+
+	conflicted := s.NewBatchSession("test")
+	_, _ = conflicted.Get(Key(2))
+	commit(t, s, func(sess kv.Session) {
+		Expect(t, sess.Put(Key(2), []byte("2")), Be[error](nil))
+	})
+	Expect(t, conflicted.Put(Key(3), []byte("3")), Be[error](nil))
+	Expect(t, errors.Is(conflicted.Commit(), kv.ErrConflict), Be(true))
+
+	stats = s.Stats()
+	Expect(t, stats.OpenSnapshotSessions, Be(int64(0)))
+	Expect(t, stats.OpenBatchSessions, Be(int64(0)))
+	Expect(t, stats.Commits, Be(uint64(2)))
+	Expect(t, stats.Conflicts, Be(uint64(1)))
+	Expect(t, stats.CommitLatency.Count, Be(uint64(3)))
+	Expect(t, stats.BatchSize.Count, Be(uint64(2)))
+	Expect(t, stats.BatchSize.Sum, Be(float64(2*(len(Key(1))+1))))
+}
+
+func testShutdown(t *testing.T, newStore EngineFactory) {
+	s := newStore(t)
+
+	commit(t, s, func(sess kv.Session) {
+		Expect(t, sess.Put(Key(1), []byte("1")), Be[error](nil))
+	})
+
+	r := s.NewSnapshotSession("test")
+	w := s.NewBatchSession("test")
+	Expect(t, w.Put(Key(2), []byte("2")), Be[error](nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	Expect(t, errors.Is(s.Shutdown(ctx), context.DeadlineExceeded), Be(true))
+
+	t.Run("new sessions rejected", func(t *testing.T) {
+		Expect(t, errors.Is(s.NewBatchSession("test").Put(Key(3), []byte("3")), kv.ErrStoreClosed), Be(true))
+
+		_, err := s.NewSnapshotSession("test").Get(Key(1))
+		Expect(t, errors.Is(err, kv.ErrStoreClosed), Be(true))
+
+		_, err = s.NewSnapshotSessionAt("test", r.Sequence())
+		Expect(t, errors.Is(err, kv.ErrStoreClosed), Be(true))
+	})
+
+	t.Run("closed once open sessions finished", func(t *testing.T) {
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Shutdown(context.Background())
+		}()
+
+		expectValue(t, r, Key(1), "1")
+		Expect(t, r.Close(), Be[error](nil))
+		Expect(t, w.Commit(), Be[error](nil))
+
+		Expect(t, <-done, Be[error](nil))
+		Expect(t, errors.Is(s.Shutdown(context.Background()), kv.ErrStoreClosed), Be(true))
+	})
+}
+
+// Key encodes uint values as msgp, like keys of tables.
+func Key(values ...uint64) []byte {
+	buf := bytes.NewBuffer(nil)
+	enc := msgp.NewEncoder(buf)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Collect returns copies of all keys of the iterator, in reverse order when reverse.
+func Collect(it kv.Iterator, reverse bool) [][]byte {
+	keys := make([][]byte, 0)
+
+	ok := it.First()
+	if reverse {
+		ok = it.Last()
+	}
+
+	for ok {
+		keys = append(keys, append([]byte(nil), it.Key()...))
+
+		if reverse {
+			ok = it.Prev()
+		} else {
+			ok = it.Next()
+		}
+	}
+
+	return keys
+}
+
+func reversed(keys [][]byte) [][]byte {
+	r := make([][]byte, len(keys))
+	for i := range keys {
+		r[len(keys)-1-i] = keys[i]
+	}
+	return r
+}
+
+func commit(t testing.TB, s kv.Store, fn func(sess kv.Session)) {
+	sess := s.NewBatchSession("test")
+	fn(sess)
+	Expect(t, sess.Commit(), Be[error](nil))
+}
+
+func expectValue(t testing.TB, sess kv.Session, k []byte, value string) {
+	v, err := sess.Get(k)
+	Expect(t, err, Be[error](nil))
+	Expect(t, string(v), Be(value))
+}
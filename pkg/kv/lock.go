@@ -0,0 +1,132 @@
+package kv
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Locker is implemented by stores which support pessimistic locks shared by all sessions.
+type Locker interface {
+	Locks() *LockTable
+}
+
+// NewLockTable creates LockTable.
+func NewLockTable() *LockTable {
+	return &LockTable{
+		locks:    map[string]*lock{},
+		held:     map[uint64]map[string]struct{}{},
+		waitsFor: map[uint64]uint64{},
+	}
+}
+
+// LockTable holds exclusive locks of keys by owners, like transactions.
+// Owner waits when the key locked by others, and fails with ErrDeadlock
+// when waiting would form a cycle between owners.
+type LockTable struct {
+	// id of last owner
+	owner uint64
+
+	mu    sync.Mutex
+	locks map[string]*lock
+	// keys locked by each owner
+	held map[uint64]map[string]struct{}
+	// owner waiting for the owner of the lock
+	waitsFor map[uint64]uint64
+}
+
+type lock struct {
+	owner uint64
+	// closed when the lock released
+	released chan struct{}
+}
+
+// NewOwner returns unique id for owner of locks.
+func (lt *LockTable) NewOwner() uint64 {
+	return atomic.AddUint64(&lt.owner, 1)
+}
+
+// Lock acquires the lock of key for owner, locks are reentrant for the same owner.
+// It waits until the lock released by others, or returns ctx.Err() once ctx done.
+func (lt *LockTable) Lock(ctx context.Context, owner uint64, key []byte) error {
+	k := string(key)
+
+	for {
+		lt.mu.Lock()
+
+		l, ok := lt.locks[k]
+		if !ok {
+			lt.locks[k] = &lock{
+				owner:    owner,
+				released: make(chan struct{}),
+			}
+			if lt.held[owner] == nil {
+				lt.held[owner] = map[string]struct{}{}
+			}
+			lt.held[owner][k] = struct{}{}
+			delete(lt.waitsFor, owner)
+			lt.mu.Unlock()
+			return nil
+		}
+
+		if l.owner == owner {
+			delete(lt.waitsFor, owner)
+			lt.mu.Unlock()
+			return nil
+		}
+
+		lt.waitsFor[owner] = l.owner
+
+		if lt.deadlocked(owner) {
+			delete(lt.waitsFor, owner)
+			lt.mu.Unlock()
+			return ErrDeadlock
+		}
+
+		lt.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			lt.mu.Lock()
+			delete(lt.waitsFor, owner)
+			lt.mu.Unlock()
+			return errors.Wrapf(ctx.Err(), "wait lock of %x", key)
+		case <-l.released:
+		}
+	}
+}
+
+// deadlocked returns whether the owner is waiting for itself through owners waited.
+func (lt *LockTable) deadlocked(owner uint64) bool {
+	visited := map[uint64]struct{}{}
+
+	for o, ok := lt.waitsFor[owner]; ok; o, ok = lt.waitsFor[o] {
+		if o == owner {
+			return true
+		}
+		if _, ok := visited[o]; ok {
+			return false
+		}
+		visited[o] = struct{}{}
+	}
+
+	return false
+}
+
+// Unlock releases all locks held by owner.
+func (lt *LockTable) Unlock(owner uint64) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	for k := range lt.held[owner] {
+		if l, ok := lt.locks[k]; ok && l.owner == owner {
+			delete(lt.locks, k)
+			close(l.released)
+		}
+	}
+
+	delete(lt.held, owner)
+	delete(lt.waitsFor, owner)
+}
@@ -0,0 +1,190 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/pkg/errors"
+)
+
+var _ kv.Session = (*BatchSession)(nil)
+var _ kv.Restamper = (*BatchSession)(nil)
+
+// BatchSession keeps changes in memory until committed,
+// reads see changes of the session over the latest committed state.
+type BatchSession struct {
+	store *store
+	txn   *kv.Txn
+	// changes of the session, value nil means deleted
+	writes    *tree
+	closed    bool
+	committed bool
+	// bytes of keys and values written
+	size int
+	seq  uint64
+}
+
+func (s *BatchSession) Commit(opts ...kv.CommitOptionFunc) error {
+	if s.closed {
+		return errors.New("already closed")
+	}
+
+	startedAt := time.Now()
+	err := s.commit(opts...)
+	s.store.metrics.ObserveCommit(startedAt, s.size, err)
+	return err
+}
+
+func (s *BatchSession) commit(opts ...kv.CommitOptionFunc) error {
+	opt := &kv.CommitOption{
+		Durability: kv.DurabilitySync,
+	}
+	for i := range opts {
+		opts[i](opt)
+	}
+
+	// nothing to persist, all modes are the same.
+	if !opt.Durability.IsValid() {
+		return errors.Errorf("unsupported durability %q", opt.Durability)
+	}
+
+	err := s.txn.Commit(func(seq uint64) error {
+		s.store.apply(s.writes)
+		s.seq = seq
+		return nil
+	})
+	if err != nil {
+		// session could not be used after commit failed
+		_ = s.Close()
+		return err
+	}
+
+	s.committed = true
+
+	return s.Close()
+}
+
+func (s *BatchSession) Close() error {
+	if s.closed {
+		return errors.New("already closed")
+	}
+	s.closed = true
+	s.store.metrics.BatchSessionClosed()
+	defer s.store.gate.Leave()
+	s.txn.Discard()
+	s.writes = nil
+	return nil
+}
+
+func (s *BatchSession) Sequence() uint64 {
+	return s.seq
+}
+
+// Get returns a value associated with the given key. If not found, returns ErrKeyNotFound.
+func (s *BatchSession) Get(k []byte) ([]byte, error) {
+	s.txn.Read(k)
+	if i, ok := s.writes.Get(item{key: k}); ok {
+		return get(s.writes, i.key)
+	}
+	return get(s.store.committed(), k)
+}
+
+// Restamp treats the key as read again at the last commit, see kv.Restamper.
+func (s *BatchSession) Restamp(k []byte) {
+	s.txn.Restamp(k)
+}
+
+// Exists returns whether a key exists and is visible by the current session.
+func (s *BatchSession) Exists(k []byte) (bool, error) {
+	s.txn.Read(k)
+	if i, ok := s.writes.Get(item{key: k}); ok {
+		return i.value != nil, nil
+	}
+	return s.store.committed().Has(item{key: k}), nil
+}
+
+// Insert inserts a key-value pair. If it already exists, it returns ErrKeyAlreadyExists.
+func (s *BatchSession) Insert(k, v []byte) error {
+	if len(k) == 0 {
+		return errors.New("cannot store empty key")
+	}
+
+	if len(v) == 0 {
+		return errors.New("cannot store empty value")
+	}
+
+	ok, err := s.Exists(k)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return kv.ErrKeyAlreadyExists
+	}
+
+	s.set(k, v)
+	return nil
+}
+
+// Put stores a key value pair. If it already exists, it overrides it.
+func (s *BatchSession) Put(k, v []byte) error {
+	if len(k) == 0 {
+		return errors.New("cannot store empty key")
+	}
+
+	if len(v) == 0 {
+		return errors.New("cannot store empty value")
+	}
+
+	s.set(k, v)
+	return nil
+}
+
+// Delete a record by key. If the key doesn't exist, it doesn't do anything.
+func (s *BatchSession) Delete(k []byte) error {
+	s.set(k, nil)
+	return nil
+}
+
+// set copies key and value, callers may reuse them.
+func (s *BatchSession) set(k, v []byte) {
+	s.txn.Write(k)
+	s.size += len(k) + len(v)
+
+	i := item{key: append([]byte(nil), k...)}
+	if v != nil {
+		i.value = append([]byte(nil), v...)
+	}
+	s.writes.ReplaceOrInsert(i)
+}
+
+// DeleteRange deletes keys in [start, end), nil start means unbounded, end is required.
+func (s *BatchSession) DeleteRange(start []byte, end []byte) error {
+	if len(end) == 0 {
+		return errors.New("cannot delete range without end")
+	}
+
+	s.txn.WriteRange(start, end)
+	s.size += len(start) + len(end)
+
+	it := &iterator{
+		base:   s.store.committed(),
+		writes: s.writes.Clone(),
+		start:  start,
+		end:    end,
+	}
+	for it.First(); it.Valid(); it.Next() {
+		s.writes.ReplaceOrInsert(item{key: append([]byte(nil), it.Key()...)})
+	}
+	return it.Close()
+}
+
+func (s *BatchSession) Iterator(start []byte, end []byte) kv.Iterator {
+	s.txn.ReadRange(start, end)
+	return &iterator{
+		base: s.store.committed(),
+		// changes after iterator created are not visible.
+		writes: s.writes.Clone(),
+		start:  start,
+		end:    end,
+	}
+}
@@ -0,0 +1,16 @@
+package memory
+
+import (
+	"github.com/octohelm/kiwidb/pkg/kv"
+)
+
+func init() {
+	kv.RegisterEngine("memory", &engine{})
+}
+
+type engine struct {
+}
+
+func (e engine) New(opt kv.Options) (kv.Store, error) {
+	return NewStore(opt), nil
+}
@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/octohelm/kiwidb/pkg/kv/kvtest"
+	. "github.com/octohelm/x/testing"
+)
+
+func newStore(t testing.TB) kv.Store {
+	s, err := kv.NewStore("memory", kv.Options{})
+	Expect(t, err, Be[error](nil))
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+	return s
+}
+
+func TestEngine(t *testing.T) {
+	kvtest.RunSuite(t, newStore)
+}
+
+func TestBatchSessionIterator(t *testing.T) {
+	s := newStore(t)
+
+	key := kvtest.Key
+
+	sess := s.NewBatchSession("test")
+	for i := uint64(1); i <= 5; i++ {
+		Expect(t, sess.Put(key(i), key(i)), Be[error](nil))
+	}
+	Expect(t, sess.Commit(), Be[error](nil))
+
+	t.Run("changes of session merged with committed", func(t *testing.T) {
+		sess := s.NewBatchSession("test")
+		defer sess.Close()
+
+		Expect(t, sess.Delete(key(2)), Be[error](nil))
+		Expect(t, sess.Delete(key(5)), Be[error](nil))
+		Expect(t, sess.Put(key(3), []byte("3")), Be[error](nil))
+		Expect(t, sess.Insert(key(4, 1), []byte("4.1")), Be[error](nil))
+		Expect(t, errors.Is(sess.Insert(key(1), []byte("1")), kv.ErrKeyAlreadyExists), Be(true))
+
+		it := sess.Iterator(key(1), key(5))
+		defer it.Close()
+
+		keys := [][]byte{key(1), key(3), key(4), key(4, 1)}
+		Expect(t, kvtest.Collect(it, false), Equal(keys))
+		Expect(t, kvtest.Collect(it, true), Equal([][]byte{key(4, 1), key(4), key(3), key(1)}))
+
+		it.First()
+		it.Next()
+		Expect(t, it.Value(), Equal([]byte("3")))
+	})
+
+	t.Run("changes after iterator created are not visible", func(t *testing.T) {
+		sess := s.NewBatchSession("test")
+		defer sess.Close()
+
+		it := sess.Iterator(nil, nil)
+		defer it.Close()
+
+		Expect(t, sess.Delete(key(1)), Be[error](nil))
+		Expect(t, it.First(), Be(true))
+		Expect(t, it.Key(), Equal(key(1)))
+	})
+}
@@ -0,0 +1,148 @@
+package memory
+
+import (
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+)
+
+var _ kv.Iterator = (*iterator)(nil)
+
+// iterator iterates committed items of base, merged with changes of the batch session when writes not nil.
+// Both trees must not be changed during iteration, so callers pass clones of them.
+//
+// Iterator seeks from the current key for each move,
+// so it costs O(log n) for each step, but never holds nodes of trees.
+type iterator struct {
+	base   *tree
+	writes *tree
+	start  []byte
+	end    []byte
+
+	current item
+	valid   bool
+}
+
+func (it *iterator) First() bool {
+	return it.seekForward(it.start, true)
+}
+
+func (it *iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	return it.seekForward(it.current.key, false)
+}
+
+func (it *iterator) Last() bool {
+	if it.end == nil {
+		return it.seekBackward(nil, true)
+	}
+	return it.seekBackward(it.end, false)
+}
+
+func (it *iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	return it.seekBackward(it.current.key, false)
+}
+
+func (it *iterator) SeekGE(k []byte) bool {
+	if it.start != nil && msgp.Compare(k, it.start) < 0 {
+		k = it.start
+	}
+	return it.seekForward(k, true)
+}
+
+func (it *iterator) SeekLT(k []byte) bool {
+	if it.end != nil && msgp.Compare(k, it.end) > 0 {
+		k = it.end
+	}
+	return it.seekBackward(k, false)
+}
+
+func (it *iterator) seekForward(k []byte, inclusive bool) bool {
+	for {
+		i, ok := it.merge(ceil, k, inclusive, 1)
+		if !ok || (it.end != nil && msgp.Compare(i.key, it.end) >= 0) {
+			return it.invalidate()
+		}
+		if i.value == nil {
+			// deleted in batch, skip it
+			k, inclusive = i.key, false
+			continue
+		}
+		return it.at(i)
+	}
+}
+
+func (it *iterator) seekBackward(k []byte, inclusive bool) bool {
+	for {
+		i, ok := it.merge(floor, k, inclusive, -1)
+		if !ok || (it.start != nil && msgp.Compare(i.key, it.start) < 0) {
+			return it.invalidate()
+		}
+		if i.value == nil {
+			k, inclusive = i.key, false
+			continue
+		}
+		return it.at(i)
+	}
+}
+
+// merge returns the nearest item of base and writes in the direction,
+// item of writes wins when both have the same key.
+func (it *iterator) merge(seek func(t *tree, k []byte, inclusive bool) (item, bool), k []byte, inclusive bool, direction int) (item, bool) {
+	b, bok := seek(it.base, k, inclusive)
+
+	if it.writes == nil {
+		return b, bok
+	}
+
+	w, wok := seek(it.writes, k, inclusive)
+
+	switch {
+	case !wok:
+		return b, bok
+	case !bok:
+		return w, wok
+	}
+
+	if msgp.Compare(b.key, w.key)*direction < 0 {
+		return b, true
+	}
+	return w, true
+}
+
+func (it *iterator) at(i item) bool {
+	it.current = i
+	it.valid = true
+	return true
+}
+
+func (it *iterator) invalidate() bool {
+	it.current = item{}
+	it.valid = false
+	return false
+}
+
+func (it *iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *iterator) Error() error {
+	return nil
+}
+
+func (it *iterator) Key() []byte {
+	return it.current.key
+}
+
+func (it *iterator) Value() []byte {
+	return it.current.value
+}
+
+func (it *iterator) Close() error {
+	it.invalidate()
+	return nil
+}
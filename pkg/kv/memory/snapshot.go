@@ -0,0 +1,68 @@
+package memory
+
+import (
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/pkg/errors"
+)
+
+var _ kv.Session = (*SnapshotSession)(nil)
+
+type SnapshotSession struct {
+	store  *store
+	data   *tree
+	seq    uint64
+	closed bool
+}
+
+func (s *SnapshotSession) Commit(opts ...kv.CommitOptionFunc) error {
+	return errors.New("cannot commit in read-only mode")
+}
+
+func (s *SnapshotSession) Close() error {
+	if s.closed {
+		return errors.New("already closed")
+	}
+	s.closed = true
+	s.store.metrics.SnapshotSessionClosed()
+	defer s.store.gate.Leave()
+	return nil
+}
+
+func (s *SnapshotSession) Sequence() uint64 {
+	return s.seq
+}
+
+func (s *SnapshotSession) Insert(k, v []byte) error {
+	return errors.New("cannot insert in read-only mode")
+}
+
+func (s *SnapshotSession) Put(k, v []byte) error {
+	return errors.New("cannot put in read-only mode")
+}
+
+// Get returns a value associated with the given key. If not found, returns ErrKeyNotFound.
+func (s *SnapshotSession) Get(k []byte) ([]byte, error) {
+	return get(s.data, k)
+}
+
+// Exists returns whether a key exists and is visible by the current session.
+func (s *SnapshotSession) Exists(k []byte) (bool, error) {
+	return s.data.Has(item{key: k}), nil
+}
+
+// Delete a record by key. If not found, returns ErrKeyNotFound.
+func (s *SnapshotSession) Delete(k []byte) error {
+	return errors.New("cannot delete in read-only mode")
+}
+
+func (s *SnapshotSession) DeleteRange(start []byte, end []byte) error {
+	return errors.New("cannot delete in read-only mode")
+}
+
+func (s *SnapshotSession) Iterator(start []byte, end []byte) kv.Iterator {
+	return &iterator{
+		base:  s.data,
+		start: start,
+		end:   end,
+	}
+}
@@ -0,0 +1,215 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/pkg/errors"
+)
+
+var _ kv.Locker = (*store)(nil)
+
+// NewStore creates kv.Store keeps all data in memory, data are lost once the process exits.
+//
+// Committed state is a copy-on-write b-tree, never changed once committed,
+// commits apply changes on a clone of it, so snapshots are just references of committed trees.
+func NewStore(opts kv.Options) kv.Store {
+	if opts.MaxRetainedCommits <= 0 {
+		opts.MaxRetainedCommits = kv.DefaultMaxRetainedCommits
+	}
+	st := &store{
+		opts:   opts,
+		oracle: kv.NewOracle(msgp.Compare),
+		locks:  kv.NewLockTable(),
+		data:   newTree(),
+
+		metrics: kv.NewSessionMetrics(),
+		gate:    kv.NewSessionGate(),
+	}
+	st.retained.snapshots = map[uint64]*tree{}
+	// state before any commits
+	st.retain(0)
+	st.oracle.Observe(func(seq uint64, clean bool) {
+		// changes are never flushed before committed, so the state is always clean.
+		st.retain(seq)
+	})
+	return st
+}
+
+type store struct {
+	opts   kv.Options
+	oracle *kv.Oracle
+	locks  *kv.LockTable
+	// metrics of sessions
+	metrics *kv.SessionMetrics
+	// open sessions waited on shutdown
+	gate *kv.SessionGate
+
+	mu sync.RWMutex
+	// committed state
+	data *tree
+
+	retained struct {
+		sync.Mutex
+
+		// sequence of last snapshot retained
+		seq       uint64
+		seqs      []uint64
+		snapshots map[uint64]*tree
+	}
+}
+
+func (s *store) Locks() *kv.LockTable {
+	return s.locks
+}
+
+// Stats returns metrics of sessions and count of keys committed.
+func (s *store) Stats() kv.Stats {
+	stats := s.metrics.Stats()
+
+	s.retained.Lock()
+	retained := len(s.retained.snapshots)
+	s.retained.Unlock()
+
+	stats.Engine = map[string]float64{
+		"keys":               float64(s.committed().Len()),
+		"retained_snapshots": float64(retained),
+	}
+
+	return stats
+}
+
+// Sync does nothing, nothing to persist.
+func (s *store) Sync() error {
+	return nil
+}
+
+// Checkpoint is not allowed, nothing persisted.
+func (s *store) Checkpoint(dir string) error {
+	return errors.Wrap(kv.ErrMethodNotAllowed, "engine memory could not checkpoint")
+}
+
+// Shutdown rejects new sessions, waits for open sessions closed, then drops snapshots retained.
+func (s *store) Shutdown(ctx context.Context) error {
+	return s.gate.Close(ctx, func() error {
+		s.retained.Lock()
+		defer s.retained.Unlock()
+
+		s.retained.snapshots = map[uint64]*tree{}
+		s.retained.seqs = nil
+
+		return nil
+	})
+}
+
+func (s *store) committed() *tree {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.data
+}
+
+// apply writes changes into clone of committed state,
+// must be called in kv.Txn.Commit, which serializes all commits.
+func (s *store) apply(writes *tree) {
+	next := s.data.Clone()
+
+	writes.Ascend(func(i item) bool {
+		if i.value == nil {
+			next.Delete(i)
+		} else {
+			next.ReplaceOrInsert(i)
+		}
+		return true
+	})
+
+	s.mu.Lock()
+	s.data = next
+	s.mu.Unlock()
+}
+
+// retain keeps committed state for the commit sequence,
+// should be called right after the commit applied, before any other changes applied.
+func (s *store) retain(seq uint64) {
+	data := s.committed()
+
+	s.retained.Lock()
+	defer s.retained.Unlock()
+
+	s.retained.seq = seq
+	s.retained.seqs = append(s.retained.seqs, seq)
+	s.retained.snapshots[seq] = data
+
+	for len(s.retained.seqs) > s.opts.MaxRetainedCommits {
+		oldest := s.retained.seqs[0]
+		s.retained.seqs = s.retained.seqs[1:]
+		delete(s.retained.snapshots, oldest)
+	}
+}
+
+func (s *store) NewSnapshotSessionAt(dbName string, seq uint64) (kv.Session, error) {
+	if err := s.gate.Enter(); err != nil {
+		return nil, err
+	}
+
+	s.retained.Lock()
+	defer s.retained.Unlock()
+
+	data, ok := s.retained.snapshots[seq]
+	if !ok {
+		s.gate.Leave()
+		return nil, errors.Wrapf(kv.ErrSequenceUnavailable, "read at %d", seq)
+	}
+
+	s.metrics.SnapshotSessionOpened()
+
+	return &SnapshotSession{
+		store: s,
+		data:  data,
+		seq:   seq,
+	}, nil
+}
+
+// NewSnapshotSession creates read session of the last snapshot retained.
+func (s *store) NewSnapshotSession(dbName string) kv.Session {
+	if err := s.gate.Enter(); err != nil {
+		return kv.RejectedSession(err)
+	}
+
+	s.retained.Lock()
+	defer s.retained.Unlock()
+
+	seq := s.retained.seq
+	s.metrics.SnapshotSessionOpened()
+
+	return &SnapshotSession{
+		store: s,
+		data:  s.retained.snapshots[seq],
+		seq:   seq,
+	}
+}
+
+func (s *store) NewBatchSession(dbName string) kv.Session {
+	if err := s.gate.Enter(); err != nil {
+		return kv.RejectedSession(err)
+	}
+
+	s.metrics.BatchSessionOpened()
+
+	return &BatchSession{
+		store:  s,
+		txn:    s.oracle.Begin(),
+		writes: newTree(),
+	}
+}
+
+// get returns copy of value, so callers could change it.
+func get(t *tree, k []byte) ([]byte, error) {
+	i, ok := t.Get(item{key: k})
+	if !ok || i.value == nil {
+		return nil, errors.WithStack(kv.ErrKeyNotFound)
+	}
+	return append([]byte(nil), i.value...), nil
+}
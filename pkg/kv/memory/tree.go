@@ -0,0 +1,65 @@
+package memory
+
+import (
+	"github.com/google/btree"
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+)
+
+// degree of b-trees, same as the default of google/btree examples.
+const degree = 32
+
+type item struct {
+	key []byte
+	// nil means the key deleted, only for changes of batch sessions.
+	value []byte
+}
+
+func less(a, b item) bool {
+	return msgp.Compare(a.key, b.key) < 0
+}
+
+type tree = btree.BTreeG[item]
+
+func newTree() *tree {
+	return btree.NewG(degree, less)
+}
+
+// ceil returns the first item after k, or equals k when inclusive,
+// nil k means from the min.
+func ceil(t *tree, k []byte, inclusive bool) (found item, ok bool) {
+	fn := func(i item) bool {
+		if !inclusive && msgp.Compare(i.key, k) == 0 {
+			return true
+		}
+		found, ok = i, true
+		return false
+	}
+
+	if k == nil {
+		t.Ascend(fn)
+	} else {
+		t.AscendGreaterOrEqual(item{key: k}, fn)
+	}
+
+	return
+}
+
+// floor returns the last item before k, or equals k when inclusive,
+// nil k means from the max.
+func floor(t *tree, k []byte, inclusive bool) (found item, ok bool) {
+	fn := func(i item) bool {
+		if !inclusive && msgp.Compare(i.key, k) == 0 {
+			return true
+		}
+		found, ok = i, true
+		return false
+	}
+
+	if k == nil {
+		t.Descend(fn)
+	} else {
+		t.DescendLessOrEqual(item{key: k}, fn)
+	}
+
+	return
+}
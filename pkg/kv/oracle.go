@@ -0,0 +1,392 @@
+package kv
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// NewOracle creates Oracle for optimistic concurrency control of sessions,
+// compare should be the same as the one of store.
+func NewOracle(compare func(a, b []byte) int) *Oracle {
+	return NewOracleAt(compare, 0)
+}
+
+// NewOracleAt creates Oracle continues from the sequence persisted by the store before reopened,
+// so sequences of states before are never assigned again.
+func NewOracleAt(compare func(a, b []byte) int, seq uint64) *Oracle {
+	return &Oracle{
+		compare: compare,
+		seq:     seq,
+		active:  map[*Txn]struct{}{},
+		dirty:   map[string]*Txn{},
+	}
+}
+
+// Oracle detects conflicts between write sessions.
+// Each Txn tracks keys read and written with the sequence when first accessed, when it commits,
+// it fails with ErrConflict if any session committed after that wrote any of these keys.
+type Oracle struct {
+	compare func(a, b []byte) int
+
+	mu sync.Mutex
+	// sequence of last commit, updated under mu, could be loaded atomically
+	seq       uint64
+	committed []*committedTxn
+	active    map[*Txn]struct{}
+	// keys flushed but not committed yet, with the session owns them
+	dirty map[string]*Txn
+	// called when changes committed or aborted
+	observers []func(seq uint64, clean bool)
+}
+
+// Observe registers fn called right after changes committed or aborted with the sequence,
+// before any other changes applied.
+// clean means no keys flushed but not committed, so the state could be read as committed.
+func (o *Oracle) Observe(fn func(seq uint64, clean bool)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.observers = append(o.observers, fn)
+}
+
+type committedTxn struct {
+	seq         uint64
+	owner       *Txn
+	writes      map[string]struct{}
+	writeRanges []keyRange
+}
+
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+// Begin starts tracking of a session.
+func (o *Oracle) Begin() *Txn {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	t := &Txn{
+		oracle:   o,
+		startSeq: o.seq,
+		reads:    map[string]uint64{},
+		writes:   map[string]uint64{},
+	}
+	o.active[t] = struct{}{}
+	return t
+}
+
+// Txn tracks read set and write set of a session.
+type Txn struct {
+	oracle   *Oracle
+	startSeq uint64
+	// keys with sequence when first accessed
+	reads       map[string]uint64
+	readRanges  []keyRange
+	writes      map[string]uint64
+	writeRanges []keyRange
+	flushed     map[string]struct{}
+	// keys read again with the sequence, changes committed before never conflict
+	restamps map[string]uint64
+	done     bool
+}
+
+// Read records the key read.
+func (t *Txn) Read(k []byte) {
+	if _, ok := t.reads[string(k)]; !ok {
+		// sequence must be loaded before the key read,
+		// so commits not recorded yet are treated as conflicts.
+		t.reads[string(k)] = atomic.LoadUint64(&t.oracle.seq)
+	}
+}
+
+// Restamp records the key read again, changes of it committed until now never conflict,
+// even the key read before, or in ranges read.
+func (t *Txn) Restamp(k []byte) {
+	seq := atomic.LoadUint64(&t.oracle.seq)
+
+	if t.restamps == nil {
+		t.restamps = map[string]uint64{}
+	}
+	t.restamps[string(k)] = seq
+
+	if _, ok := t.reads[string(k)]; ok {
+		t.reads[string(k)] = seq
+	}
+}
+
+// ReadRange records keys in [start, end) read, nil means unbounded.
+func (t *Txn) ReadRange(start []byte, end []byte) {
+	t.readRanges = append(t.readRanges, keyRange{
+		start: append([]byte(nil), start...),
+		end:   append([]byte(nil), end...),
+	})
+}
+
+// Write records the key written.
+func (t *Txn) Write(k []byte) {
+	if _, ok := t.writes[string(k)]; !ok {
+		t.writes[string(k)] = atomic.LoadUint64(&t.oracle.seq)
+	}
+}
+
+// WriteRange records keys in [start, end) written, like deleted by range, nil means unbounded.
+func (t *Txn) WriteRange(start []byte, end []byte) {
+	t.writeRanges = append(t.writeRanges, keyRange{
+		start: append([]byte(nil), start...),
+		end:   append([]byte(nil), end...),
+	})
+}
+
+// Commit validates there are no conflicts, then applies changes by apply with the sequence assigned to the commit.
+// Validation and apply are serialized between all sessions of the oracle,
+// so sequences are increasing in order of commits.
+// When commit failed, session with changes flushed should Abort to undo them.
+func (t *Txn) Commit(apply func(seq uint64) error) error {
+	o := t.oracle
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if t.conflicted() {
+		t.discardUnlessFlushed()
+		return ErrConflict
+	}
+
+	if err := apply(o.seq + 1); err != nil {
+		t.discardUnlessFlushed()
+		return err
+	}
+
+	t.discard()
+	writes := make(map[string]struct{}, len(t.writes))
+	for k := range t.writes {
+		writes[k] = struct{}{}
+	}
+	t.record(writes, t.writeRanges)
+	t.notify()
+
+	return nil
+}
+
+// keys flushed should be kept dirty until Abort.
+func (t *Txn) discardUnlessFlushed() {
+	if len(t.flushed) == 0 {
+		t.discard()
+	}
+}
+
+// Flush applies changes before commit by apply, like intermediate commits of large batch.
+// Keys flushed are dirty until the session committed or aborted,
+// sessions read or write dirty keys of others would fail with ErrConflict.
+func (t *Txn) Flush(keys [][]byte, apply func() error) error {
+	o := t.oracle
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, k := range keys {
+		if owner, ok := o.dirty[string(k)]; ok && owner != t {
+			return ErrConflict
+		}
+	}
+
+	if err := apply(); err != nil {
+		return err
+	}
+
+	if t.flushed == nil {
+		t.flushed = map[string]struct{}{}
+	}
+
+	writes := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		writes[string(k)] = struct{}{}
+		t.flushed[string(k)] = struct{}{}
+		o.dirty[string(k)] = t
+	}
+
+	// sessions which read these keys before should conflict.
+	t.record(writes, nil)
+
+	return nil
+}
+
+// Abort applies changes which undo keys flushed by undo, with the sequence assigned like Commit,
+// as the state undone could be read by others.
+// No validation here, others never commit dirty keys of the session.
+func (t *Txn) Abort(undo func(seq uint64) error) error {
+	o := t.oracle
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := undo(o.seq + 1); err != nil {
+		t.discard()
+		return err
+	}
+
+	t.discard()
+	// sessions which read dirty keys should conflict.
+	t.record(t.flushed, nil)
+	t.notify()
+
+	return nil
+}
+
+func (t *Txn) notify() {
+	o := t.oracle
+
+	for _, fn := range o.observers {
+		fn(o.seq, len(o.dirty) == 0)
+	}
+}
+
+func (t *Txn) record(writes map[string]struct{}, writeRanges []keyRange) {
+	o := t.oracle
+
+	atomic.AddUint64(&o.seq, 1)
+
+	if len(writes) > 0 || len(writeRanges) > 0 {
+		o.committed = append(o.committed, &committedTxn{
+			seq:         o.seq,
+			owner:       t,
+			writes:      writes,
+			writeRanges: writeRanges,
+		})
+	}
+}
+
+func (t *Txn) conflicted() bool {
+	o := t.oracle
+
+	for _, c := range o.committed {
+		if c.seq <= t.startSeq || c.owner == t {
+			continue
+		}
+		if t.conflictWith(c.writes, c.writeRanges, c.seq) {
+			return true
+		}
+	}
+
+	for k, owner := range o.dirty {
+		if owner == t {
+			continue
+		}
+		// dirty keys always conflict
+		if t.conflictWith(map[string]struct{}{k: {}}, nil, math.MaxUint64) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Discard stops tracking without commit.
+func (t *Txn) Discard() {
+	t.oracle.mu.Lock()
+	defer t.oracle.mu.Unlock()
+
+	t.discard()
+}
+
+func (t *Txn) discard() {
+	if t.done {
+		return
+	}
+	t.done = true
+
+	o := t.oracle
+	delete(o.active, t)
+
+	for k := range t.flushed {
+		if o.dirty[k] == t {
+			delete(o.dirty, k)
+		}
+	}
+
+	// committed txns which are visible to all active sessions are useless.
+	minSeq := o.seq
+	for a := range o.active {
+		if a.startSeq < minSeq {
+			minSeq = a.startSeq
+		}
+	}
+
+	i := 0
+	for i < len(o.committed) && o.committed[i].seq <= minSeq {
+		i++
+	}
+	o.committed = o.committed[i:]
+}
+
+// conflictWith returns whether writes at seq happened after keys of txn accessed.
+func (t *Txn) conflictWith(writes map[string]struct{}, writeRanges []keyRange, seq uint64) bool {
+	for k := range writes {
+		if readSeq, ok := t.reads[k]; ok && seq > readSeq {
+			return true
+		}
+		if writeSeq, ok := t.writes[k]; ok && seq > writeSeq {
+			return true
+		}
+		if restampSeq, ok := t.restamps[k]; ok && seq <= restampSeq {
+			continue
+		}
+		for _, r := range t.readRanges {
+			if t.inRange(r, []byte(k)) {
+				return true
+			}
+		}
+		for _, r := range t.writeRanges {
+			if t.inRange(r, []byte(k)) {
+				return true
+			}
+		}
+	}
+
+	for _, wr := range writeRanges {
+		for k, readSeq := range t.reads {
+			if seq > readSeq && t.inRange(wr, []byte(k)) {
+				return true
+			}
+		}
+		for k, writeSeq := range t.writes {
+			if seq > writeSeq && t.inRange(wr, []byte(k)) {
+				return true
+			}
+		}
+		for _, r := range t.readRanges {
+			if t.overlaps(r, wr) {
+				return true
+			}
+		}
+		for _, r := range t.writeRanges {
+			if t.overlaps(r, wr) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (t *Txn) inRange(r keyRange, k []byte) bool {
+	if len(r.start) > 0 && t.oracle.compare(k, r.start) < 0 {
+		return false
+	}
+	if len(r.end) > 0 && t.oracle.compare(k, r.end) >= 0 {
+		return false
+	}
+	return true
+}
+
+func (t *Txn) overlaps(a keyRange, b keyRange) bool {
+	if len(a.end) > 0 && len(b.start) > 0 && t.oracle.compare(b.start, a.end) >= 0 {
+		return false
+	}
+	if len(b.end) > 0 && len(a.start) > 0 && t.oracle.compare(a.start, b.end) >= 0 {
+		return false
+	}
+	return true
+}
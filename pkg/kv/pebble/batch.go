@@ -1,12 +1,15 @@
 package pebble
 
 import (
+	"time"
+
 	"github.com/cockroachdb/pebble"
 	"github.com/octohelm/kiwidb/pkg/kv"
 	"github.com/pkg/errors"
 )
 
 var _ kv.Session = (*BatchSession)(nil)
+var _ kv.Restamper = (*BatchSession)(nil)
 
 const (
 	// 10MB
@@ -18,10 +21,16 @@ var (
 )
 
 type BatchSession struct {
-	DB           *pebble.DB
-	Batch        *pebble.Batch
-	store        *store
-	closed       bool
+	DB              *pebble.DB
+	Batch           *pebble.Batch
+	store           *store
+	txn             *kv.Txn
+	rollbackSegment *rollbackSegment
+	closed          bool
+	committed       bool
+	// bytes of keys and values written
+	size         int
+	seq          uint64
 	maxBatchSize int
 }
 
@@ -30,22 +39,66 @@ func (s *BatchSession) Commit(opts ...kv.CommitOptionFunc) error {
 		return errors.New("already closed")
 	}
 
-	w := pebble.Sync
+	startedAt := time.Now()
+	err := s.commit(opts...)
+	s.store.metrics.ObserveCommit(startedAt, s.size, err)
+	return err
+}
 
-	opt := &kv.CommitOption{}
+func (s *BatchSession) commit(opts ...kv.CommitOptionFunc) error {
+	opt := &kv.CommitOption{
+		Durability: kv.DurabilitySync,
+	}
 	for i := range opts {
 		opts[i](opt)
 	}
 
-	if opt.NoSync {
-		w = pebble.NoSync
+	// WAL synced after commit applied, out of serialized commits,
+	// so commits never wait for syncs of others under the lock of oracle.
+	var sync func() error
+
+	switch opt.Durability {
+	case kv.DurabilitySync:
+		sync = s.store.Sync
+	case kv.DurabilityGroupCommit:
+		// syncs shared between concurrent commits
+		sync = func() error {
+			return s.store.syncer.Sync(s.store.Sync)
+		}
+	case kv.DurabilityNoSync:
+	default:
+		return errors.Errorf("unsupported durability %q", opt.Durability)
 	}
 
-	err := s.Batch.Commit(w)
+	err := s.txn.Commit(func(seq uint64) error {
+		// changes committed, original values are useless.
+		if err := s.rollbackSegment.Clear(s.Batch); err != nil {
+			return err
+		}
+		if err := writeSequence(s.Batch, seq); err != nil {
+			return err
+		}
+		if err := s.Batch.Commit(pebble.NoSync); err != nil {
+			return err
+		}
+		s.seq = seq
+		return nil
+	})
 	if err != nil {
+		// session could not be used after commit failed
+		_ = s.Close()
 		return err
 	}
 
+	s.committed = true
+
+	if sync != nil {
+		if err := sync(); err != nil {
+			_ = s.Close()
+			return errors.Wrap(err, "sync")
+		}
+	}
+
 	return s.Close()
 }
 
@@ -54,17 +107,59 @@ func (s *BatchSession) Close() error {
 		return errors.New("already closed")
 	}
 	s.closed = true
-	s.store.unlockSharedSnapshot()
+	s.store.metrics.BatchSessionClosed()
+	defer s.store.gate.Leave()
+
+	if err := s.rollback(); err != nil {
+		_ = s.Batch.Close()
+		return err
+	}
+
 	return s.Batch.Close()
 }
 
+// rollback undoes changes flushed if the session not committed.
+func (s *BatchSession) rollback() error {
+	if s.committed || !s.rollbackSegment.flushed {
+		s.txn.Discard()
+		return nil
+	}
+
+	return s.txn.Abort(func(seq uint64) error {
+		b := s.DB.NewBatch()
+		defer b.Close()
+
+		if err := s.rollbackSegment.Rollback(s.DB, b); err != nil {
+			return err
+		}
+		if err := writeSequence(b, seq); err != nil {
+			return err
+		}
+
+		// no sync under the lock of oracle, rollback segments are kept until the undo persisted,
+		// which would be rolled back again once recovered.
+		return b.Commit(pebble.NoSync)
+	})
+}
+
+func (s *BatchSession) Sequence() uint64 {
+	return s.seq
+}
+
 // Get returns a value associated with the given key. If not found, returns ErrKeyNotFound.
 func (s *BatchSession) Get(k []byte) ([]byte, error) {
+	s.txn.Read(k)
 	return get(s.Batch, k)
 }
 
+// Restamp treats the key as read again at the last commit, see kv.Restamper.
+func (s *BatchSession) Restamp(k []byte) {
+	s.txn.Restamp(k)
+}
+
 // Exists returns whether a key exists and is visible by the current session.
 func (s *BatchSession) Exists(k []byte) (bool, error) {
+	s.txn.Read(k)
 	return exists(s.Batch, k)
 }
 
@@ -73,19 +168,23 @@ func (s *BatchSession) ensureBatchSize() error {
 		return nil
 	}
 
-	//// The batch is too large. Insert the rollback segments and commit the batch.
-	//err := s.rollbackSegment.Apply(s.Batch)
-	//if err != nil {
-	//	return err
-	//}
+	// The batch is too large. Insert the rollback segments and commit the batch.
+	keys, err := s.rollbackSegment.Apply(s.DB, s.Batch)
+	if err != nil {
+		return err
+	}
 
 	// this is an intermediary commit that might be rolled back by the user
 	// so we don't need durability here.
-	err := s.Batch.Commit(pebble.NoSync)
+	err = s.txn.Flush(keys, func() error {
+		return s.Batch.Commit(pebble.NoSync)
+	})
 	if err != nil {
 		return err
 	}
 
+	s.rollbackSegment.Done()
+
 	// reset batch
 	s.Batch.Reset()
 
@@ -110,8 +209,9 @@ func (s *BatchSession) Insert(k, v []byte) error {
 		return kv.ErrKeyAlreadyExists
 	}
 
-	//s.rollbackSegment.EnqueueOp(k, kvOpInsert)
-
+	s.rollbackSegment.EnqueueOp(k)
+	s.txn.Write(k)
+	s.size += len(k) + len(v)
 	err = s.Batch.Set(k, v, nil)
 	if err != nil {
 		return err
@@ -130,8 +230,9 @@ func (s *BatchSession) Put(k, v []byte) error {
 		return errors.New("cannot store empty value")
 	}
 
-	//s.rollbackSegment.EnqueueOp(k, kvOpSet)
-
+	s.rollbackSegment.EnqueueOp(k)
+	s.txn.Write(k)
+	s.size += len(k) + len(v)
 	err := s.Batch.Set(k, v, nil)
 	if err != nil {
 		return err
@@ -142,8 +243,9 @@ func (s *BatchSession) Put(k, v []byte) error {
 
 // Delete a record by key. If the key doesn't exist, it doesn't do anything.
 func (s *BatchSession) Delete(k []byte) error {
-	//s.rollbackSegment.EnqueueOp(k, kvOpDel)
-
+	s.rollbackSegment.EnqueueOp(k)
+	s.txn.Write(k)
+	s.size += len(k)
 	err := s.Batch.Delete(k, nil)
 	if err != nil {
 		return err
@@ -152,9 +254,27 @@ func (s *BatchSession) Delete(k []byte) error {
 	return s.ensureBatchSize()
 }
 
+// DeleteRange deletes keys in [start, end) by a range tombstone, nil start means unbounded, end is required.
+func (s *BatchSession) DeleteRange(start []byte, end []byte) error {
+	if len(end) == 0 {
+		return errors.New("cannot delete range without end")
+	}
+
+	s.rollbackSegment.EnqueueRange(start, end)
+	s.txn.WriteRange(start, end)
+	s.size += len(start) + len(end)
+	err := s.Batch.DeleteRange(start, end, nil)
+	if err != nil {
+		return err
+	}
+
+	return s.ensureBatchSize()
+}
+
 func (s *BatchSession) Iterator(start []byte, end []byte) kv.Iterator {
+	s.txn.ReadRange(start, end)
 	return s.Batch.NewIter(&pebble.IterOptions{
 		LowerBound: start,
-		UpperBound: end,
+		UpperBound: upperBound(end),
 	})
 }
@@ -0,0 +1,71 @@
+package pebble
+
+import (
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/pkg/errors"
+)
+
+// ComparerName identifies the ordering of keys persisted,
+// the version should be bumped once the ordering of msgp.Compare changed.
+const ComparerName = "kiwidb.MsgpComparator.v1"
+
+// LegacyComparerName is the name of comparer of stores created before ComparerName,
+// which orders keys by msgp.CompareLegacy.
+//
+// Stores of it are refused by DefaultComparer, to migrate, open the store with LegacyComparer
+// by ExtraComparer, write a backup by Database.Backup, then restore it into a new store by Database.Restore.
+const LegacyComparerName = "leveldb.BytewiseComparator"
+
+// ErrIncompatibleComparer returned when the store was created with another comparer.
+var ErrIncompatibleComparer = errors.New("incompatible comparer")
+
+var DefaultComparer = &pebble.Comparer{
+	Name:           ComparerName,
+	FormatKey:      pebble.DefaultComparer.FormatKey,
+	Compare:        msgp.Compare,
+	Equal:          msgp.Equal,
+	AbbreviatedKey: msgp.AbbreviatedKey,
+	Separator:      msgp.Separator,
+	Successor:      msgp.Successor,
+	// no prefix of keys for bloom filters, whole keys are checked.
+	Split: func(a []byte) int {
+		return len(a)
+	},
+}
+
+// LegacyComparer only to read stores created with LegacyComparerName for migration.
+var LegacyComparer = &pebble.Comparer{
+	Name:      LegacyComparerName,
+	FormatKey: pebble.DefaultComparer.FormatKey,
+	Compare:   msgp.CompareLegacy,
+	Equal:     msgp.Equal,
+	// abbreviated keys of msgp.AbbreviatedKey follow msgp.Compare,
+	// all the same, so keys are always compared.
+	AbbreviatedKey: func(key []byte) uint64 {
+		return 0
+	},
+	// keys are shortened to namespaces, which are ordered the same.
+	Separator: msgp.Separator,
+	Successor: msgp.Successor,
+	Split: func(a []byte) int {
+		return len(a)
+	},
+}
+
+var comparers = map[string]*pebble.Comparer{
+	ComparerName:       DefaultComparer,
+	LegacyComparerName: LegacyComparer,
+}
+
+// wrapComparerError marks errors of pebble refusing the store created with comparer of another name,
+// which pebble checks with names in OPTIONS and MANIFEST files, without error values to match,
+// messages of both are checked by TestComparer, in case changed by upgrades of pebble.
+func wrapComparerError(err error) error {
+	if strings.Contains(err.Error(), "comparer name from file") {
+		return errors.Wrap(ErrIncompatibleComparer, err.Error())
+	}
+	return err
+}
@@ -1,14 +1,10 @@
 package pebble
 
 import (
-	"errors"
 	"fmt"
 	"os"
 
-	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
-
 	"github.com/cockroachdb/pebble"
-	"github.com/cockroachdb/pebble/vfs"
 	"github.com/octohelm/kiwidb/pkg/kv"
 )
 
@@ -19,28 +15,30 @@ func init() {
 type engine struct {
 }
 
+// New opens store with options in Extra, see ExtraPath and other Extra keys.
 func (e engine) New(opt kv.Options) (kv.Store, error) {
-	var opts pebble.Options
-
-	path, ok := opt.Extra["path"]
-	if !ok {
-		return nil, errors.New("engine pebble need `path`")
+	path, opts, err := NewOptions(opt.Extra)
+	if err != nil {
+		return nil, err
 	}
 
-	if path == ":memory:" {
-		opts.FS = vfs.NewMem()
-		path = ""
+	pdb, err := Open(path, opts)
+	// database holds its own reference of cache
+	releaseCache(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	pdb, err := Open(path, &opts)
+	s, err := NewStore(pdb, opts.Comparer, opt)
 	if err != nil {
+		_ = pdb.Close()
 		return nil, err
 	}
-
-	return NewStore(pdb, opt), nil
+	return s, nil
 }
 
-// Open a database with a custom comparer.
+// Open a database with a custom comparer,
+// fails with ErrIncompatibleComparer when the database was created with comparer of another name.
 func Open(path string, opts *pebble.Options) (*pebble.DB, error) {
 	if opts == nil {
 		opts = &pebble.Options{}
@@ -48,23 +46,20 @@ func Open(path string, opts *pebble.Options) (*pebble.DB, error) {
 	if opts.Comparer == nil {
 		opts.Comparer = DefaultComparer
 	}
-	return pebble.Open(path, opts)
+	db, err := pebble.Open(path, opts)
+	if err != nil {
+		return nil, wrapComparerError(err)
+	}
+	// undo changes flushed by sessions never committed before last shutdown.
+	if err := recoverRollbackSegments(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
 type DB = pebble.DB
 
-var DefaultComparer = &pebble.Comparer{
-	// This name is part of the C++ Level-DB implementation's default file
-	// format, and should not be changed.
-	Name:           "leveldb.BytewiseComparator",
-	FormatKey:      pebble.DefaultComparer.FormatKey,
-	Separator:      pebble.DefaultComparer.Separator,
-	Compare:        msgp.Compare,
-	Equal:          msgp.Equal,
-	AbbreviatedKey: msgp.AbbreviatedKey,
-	Successor:      msgp.Successor,
-}
-
 func EnsureDirectory(dir string) error {
 	info, err := os.Stat(dir)
 	if os.IsNotExist(err) {
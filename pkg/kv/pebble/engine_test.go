@@ -1,35 +1,955 @@
 package pebble
 
-//func TestCheckpoint(t *testing.T) {
-//	cwd, _ := os.Getwd()
-//	root := path.Join(cwd, ".tmp")
-//
-//	_ = EnsureDirectory(root)
-//
-//	db, _ := Open(root, nil)
-//	t.Cleanup(func() {
-//		db.Close()
-//	})
-//
-//	for i := 0; i < 10; i++ {
-//		_ = db.Set([]byte("hello"), []byte(fmt.Sprintf("%d", i)), nil)
-//	}
-//
-//	t.Run("create checkpoint", func(t *testing.T) {
-//		checkpoint := t.TempDir()
-//		t.Cleanup(func() {
-//			os.RemoveAll(checkpoint)
-//		})
-//
-//		_ = db.Checkpoint(checkpoint)
-//
-//		db2, _ := Open(checkpoint, nil)
-//		t.Cleanup(func() {
-//			db2.Close()
-//		})
-//
-//		data, c, _ := db.Get([]byte("hello"))
-//		fmt.Println(string(data))
-//		c.Close()
-//	})
-//}
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/octohelm/kiwidb/pkg/kv"
+	"github.com/octohelm/kiwidb/pkg/kv/kvtest"
+	. "github.com/octohelm/x/testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	fs := vfs.NewMem()
+
+	pdb, err := Open("db", &pebble.Options{FS: fs})
+	Expect(t, err, Be[error](nil))
+	s, err := NewStore(pdb, nil, kv.Options{MaxBatchSize: 1024})
+	Expect(t, err, Be[error](nil))
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+
+	sess := s.NewBatchSession("test")
+	Expect(t, sess.Put(encodeKey(t, 0), []byte("origin")), Be[error](nil))
+	Expect(t, sess.Commit(), Be[error](nil))
+
+	// flushed but never committed
+	pending := s.NewBatchSession("test")
+	Expect(t, pending.Put(encodeKey(t, 0), []byte("changed")), Be[error](nil))
+	for i := uint64(1); i <= 100; i++ {
+		Expect(t, pending.Put(encodeKey(t, i), bytes.Repeat([]byte("v"), 64)), Be[error](nil))
+	}
+	defer pending.Close()
+
+	Expect(t, s.Checkpoint("checkpoint"), Be[error](nil))
+
+	t.Run("opened with changes committed only", func(t *testing.T) {
+		cdb, err := Open("checkpoint", &pebble.Options{FS: fs})
+		Expect(t, err, Be[error](nil))
+		defer cdb.Close()
+
+		v, err := get(cdb, encodeKey(t, 0))
+		Expect(t, err, Be[error](nil))
+		Expect(t, v, Equal([]byte("origin")))
+
+		ok, err := exists(cdb, encodeKey(t, 1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(false))
+
+		expectNoRollbackSegments(t, cdb)
+	})
+
+	t.Run("dir exists", func(t *testing.T) {
+		Expect(t, s.Checkpoint("checkpoint"), Not(Be[error](nil)))
+	})
+}
+
+func newMemStore(t testing.TB, opts ...kv.Options) kv.Store {
+	pdb, err := Open("", &pebble.Options{FS: vfs.NewMem()})
+	Expect(t, err, Be[error](nil))
+	opt := kv.Options{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	s, err := NewStore(pdb, nil, opt)
+	Expect(t, err, Be[error](nil))
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+	return s
+}
+
+func TestEngine(t *testing.T) {
+	kvtest.RunSuite(t, func(t testing.TB) kv.Store {
+		return newMemStore(t)
+	})
+}
+
+func TestStats(t *testing.T) {
+	s := newMemStore(t)
+
+	engine := s.Stats().Engine
+
+	for _, name := range []string{"compactions_total", "memtable_size_bytes", "l0_files", "read_amplification", "write_amplification", "block_cache_hit_rate"} {
+		_, ok := engine[name]
+		Expect(t, ok, Be(true))
+	}
+}
+
+func TestComparer(t *testing.T) {
+	fs := vfs.NewMem()
+
+	t.Run("refuse store created with other comparer", func(t *testing.T) {
+		db, err := pebble.Open("bytewise", &pebble.Options{FS: fs})
+		Expect(t, err, Be[error](nil))
+		Expect(t, db.Close(), Be[error](nil))
+
+		_, err = Open("bytewise", &pebble.Options{FS: fs})
+		Expect(t, errors.Is(err, ErrIncompatibleComparer), Be(true))
+	})
+
+	t.Run("reopen store created", func(t *testing.T) {
+		db, err := Open("msgp", &pebble.Options{FS: fs})
+		Expect(t, err, Be[error](nil))
+		Expect(t, db.Close(), Be[error](nil))
+
+		db, err = Open("msgp", &pebble.Options{FS: fs})
+		Expect(t, err, Be[error](nil))
+		Expect(t, db.Close(), Be[error](nil))
+
+		t.Run("refused by other comparer", func(t *testing.T) {
+			_, err := Open("msgp", &pebble.Options{FS: fs, Comparer: pebble.DefaultComparer})
+			Expect(t, errors.Is(err, ErrIncompatibleComparer), Be(true))
+		})
+	})
+
+	t.Run("refuse store without OPTIONS by comparer in MANIFEST", func(t *testing.T) {
+		db, err := pebble.Open("manifest", &pebble.Options{FS: fs})
+		Expect(t, err, Be[error](nil))
+		Expect(t, db.Close(), Be[error](nil))
+
+		files, err := fs.List("manifest")
+		Expect(t, err, Be[error](nil))
+		for _, name := range files {
+			if strings.HasPrefix(name, "OPTIONS-") {
+				Expect(t, fs.Remove(fs.PathJoin("manifest", name)), Be[error](nil))
+			}
+		}
+
+		_, err = Open("manifest", &pebble.Options{FS: fs})
+		Expect(t, errors.Is(err, ErrIncompatibleComparer), Be(true))
+	})
+
+	t.Run("conflicts detected in ordering of comparer opened with", func(t *testing.T) {
+		reversed := &pebble.Comparer{
+			Name:      "kiwidb.test.Reversed",
+			FormatKey: pebble.DefaultComparer.FormatKey,
+			Compare: func(a, b []byte) int {
+				return msgp.Compare(b, a)
+			},
+			Equal: func(a, b []byte) bool {
+				return msgp.Compare(a, b) == 0
+			},
+			AbbreviatedKey: func(key []byte) uint64 {
+				return 0
+			},
+			Separator: func(dst, a, b []byte) []byte {
+				return append(dst, a...)
+			},
+			Successor: func(dst, b []byte) []byte {
+				return append(dst, b...)
+			},
+			Split: func(a []byte) int {
+				return len(a)
+			},
+		}
+
+		pdb, err := Open("reversed", &pebble.Options{FS: fs, Comparer: reversed})
+		Expect(t, err, Be[error](nil))
+		s, err := NewStore(pdb, reversed, kv.Options{})
+		Expect(t, err, Be[error](nil))
+		defer s.Shutdown(context.Background())
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		// key 2 is before key 1 in reversed ordering.
+		it := s1.Iterator(nil, encodeKey(t, 1))
+		Expect(t, it.First(), Be(false))
+		Expect(t, it.Close(), Be[error](nil))
+		Expect(t, s1.Put(encodeKey(t, 3), []byte("1")), Be[error](nil))
+
+		Expect(t, s2.Put(encodeKey(t, 2), []byte("1")), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+
+		Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+	})
+}
+
+func TestNewOptions(t *testing.T) {
+	t.Run("tuning", func(t *testing.T) {
+		path, opts, err := NewOptions(map[string]string{
+			ExtraPath:                  "/tmp/db",
+			ExtraCacheSize:             "64MB",
+			ExtraMemTableSize:          "32mb",
+			ExtraL0CompactionThreshold: "8",
+			ExtraL0StopWritesThreshold: "24",
+			ExtraCompression:           "none,snappy,zstd",
+			ExtraBloomFilterBitsPerKey: "10",
+			ExtraMaxOpenFiles:          "500",
+			ExtraWALDir:                "/tmp/wal",
+			ExtraComparer:              LegacyComparerName,
+		})
+		Expect(t, err, Be[error](nil))
+		defer releaseCache(opts)
+
+		Expect(t, path, Be("/tmp/db"))
+		Expect(t, opts.Cache.MaxSize(), Be(int64(64<<20)))
+		Expect(t, opts.MemTableSize, Be(32<<20))
+		Expect(t, opts.L0CompactionThreshold, Be(8))
+		Expect(t, opts.L0StopWritesThreshold, Be(24))
+		Expect(t, opts.MaxOpenFiles, Be(500))
+		Expect(t, opts.WALDir, Be("/tmp/wal"))
+		Expect(t, opts.Comparer, Be(LegacyComparer))
+
+		Expect(t, len(opts.Levels), Be(numLevels))
+		Expect(t, opts.Levels[0].Compression, Be(pebble.NoCompression))
+		Expect(t, opts.Levels[1].Compression, Be(pebble.SnappyCompression))
+		Expect(t, opts.Levels[numLevels-1].Compression, Be(pebble.ZstdCompression))
+		Expect(t, opts.Levels[numLevels-1].FilterPolicy, Not(Be[pebble.FilterPolicy](nil)))
+	})
+
+	t.Run("open with tuning", func(t *testing.T) {
+		s, err := kv.NewStore("pebble", kv.Options{
+			Extra: map[string]string{
+				ExtraPath:                  ":memory:",
+				ExtraCacheSize:             "1MB",
+				ExtraCompression:           "zstd",
+				ExtraBloomFilterBitsPerKey: "10",
+			},
+		})
+		Expect(t, err, Be[error](nil))
+		Expect(t, s.Shutdown(context.Background()), Be[error](nil))
+	})
+
+	invalid := map[string]map[string]string{
+		"path required":         {},
+		"unknown option":        {ExtraPath: ":memory:", "cacheSzie": "1MB"},
+		"invalid size":          {ExtraPath: ":memory:", ExtraCacheSize: "1TB"},
+		"size overflowed":       {ExtraPath: ":memory:", ExtraCacheSize: "9000000000GB"},
+		"memtable too large":    {ExtraPath: ":memory:", ExtraMemTableSize: "4GB"},
+		"memtable overflowed":   {ExtraPath: ":memory:", ExtraMemTableSize: "9000000000GB"},
+		"not positive":          {ExtraPath: ":memory:", ExtraMaxOpenFiles: "0"},
+		"unknown compression":   {ExtraPath: ":memory:", ExtraCompression: "snappy,lz4"},
+		"too many compressions": {ExtraPath: ":memory:", ExtraCompression: "none,none,none,none,none,none,snappy,zstd"},
+		"stop writes too soon":  {ExtraPath: ":memory:", ExtraL0StopWritesThreshold: "2"},
+		"unknown comparer":      {ExtraPath: ":memory:", ExtraComparer: "bytewise"},
+	}
+
+	for name, extra := range invalid {
+		extra := extra
+
+		t.Run(name, func(t *testing.T) {
+			_, err := kv.NewStore("pebble", kv.Options{Extra: extra})
+			Expect(t, err, Not(Be[error](nil)))
+		})
+	}
+}
+
+func TestBatchSessionConflict(t *testing.T) {
+	t.Run("read then written by others", func(t *testing.T) {
+		s := newMemStore(t)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		_, err := s1.Exists(encodeKey(t, 1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, s1.Put(encodeKey(t, 2), []byte("1")), Be[error](nil))
+
+		Expect(t, s2.Put(encodeKey(t, 1), []byte("2")), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+
+		Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+	})
+
+	t.Run("range read then written by others", func(t *testing.T) {
+		s := newMemStore(t)
+
+		start, end := encodeKey(t, 1, 0), encodeKey(t, 2, 0)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		it := s1.Iterator(start, end)
+		for it.First(); it.Valid(); it.Next() {
+		}
+		Expect(t, it.Close(), Be[error](nil))
+		Expect(t, s1.Put(encodeKey(t, 3, 0), []byte("1")), Be[error](nil))
+
+		Expect(t, s2.Insert(encodeKey(t, 1, 1), []byte("2")), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+
+		Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+	})
+
+	t.Run("written by both", func(t *testing.T) {
+		s := newMemStore(t)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		Expect(t, s1.Put(encodeKey(t, 1), []byte("1")), Be[error](nil))
+		Expect(t, s2.Put(encodeKey(t, 1), []byte("2")), Be[error](nil))
+
+		Expect(t, s2.Commit(), Be[error](nil))
+		Expect(t, errors.Is(s1.Commit(), kv.ErrConflict), Be(true))
+	})
+
+	t.Run("touched different keys", func(t *testing.T) {
+		s := newMemStore(t)
+
+		s1 := s.NewBatchSession("test")
+		s2 := s.NewBatchSession("test")
+
+		Expect(t, s1.Insert(encodeKey(t, 1), []byte("1")), Be[error](nil))
+		Expect(t, s2.Insert(encodeKey(t, 2), []byte("2")), Be[error](nil))
+
+		Expect(t, s2.Commit(), Be[error](nil))
+		Expect(t, s1.Commit(), Be[error](nil))
+	})
+
+	t.Run("began after others committed", func(t *testing.T) {
+		s := newMemStore(t)
+
+		s1 := s.NewBatchSession("test")
+		Expect(t, s1.Put(encodeKey(t, 1), []byte("1")), Be[error](nil))
+		Expect(t, s1.Commit(), Be[error](nil))
+
+		s2 := s.NewBatchSession("test")
+		v, err := s2.Get(encodeKey(t, 1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, v, Equal([]byte("1")))
+		Expect(t, s2.Put(encodeKey(t, 1), []byte("2")), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+	})
+}
+
+func TestBatchSessionRollback(t *testing.T) {
+	value := bytes.Repeat([]byte("v"), 64)
+
+	writeLarge := func(t testing.TB, sess kv.Session) {
+		Expect(t, sess.Put(encodeKey(t, 0), []byte("changed")), Be[error](nil))
+		for i := uint64(1); i <= 100; i++ {
+			Expect(t, sess.Put(encodeKey(t, i), value), Be[error](nil))
+		}
+		Expect(t, sess.Delete(encodeKey(t, 101)), Be[error](nil))
+	}
+
+	setup := func(t testing.TB) (kv.Store, *pebble.DB) {
+		s := newMemStore(t, kv.Options{MaxBatchSize: 1024})
+		pdb := s.(*store).db
+
+		sess := s.NewBatchSession("test")
+		Expect(t, sess.Put(encodeKey(t, 0), []byte("origin")), Be[error](nil))
+		Expect(t, sess.Put(encodeKey(t, 101), []byte("origin")), Be[error](nil))
+		Expect(t, sess.Commit(), Be[error](nil))
+
+		return s, pdb
+	}
+
+	expectOrigin := func(t testing.TB, pdb *pebble.DB) {
+		v, err := get(pdb, encodeKey(t, 0))
+		Expect(t, err, Be[error](nil))
+		Expect(t, v, Equal([]byte("origin")))
+
+		v, err = get(pdb, encodeKey(t, 101))
+		Expect(t, err, Be[error](nil))
+		Expect(t, v, Equal([]byte("origin")))
+
+		for i := uint64(1); i <= 100; i++ {
+			ok, err := exists(pdb, encodeKey(t, i))
+			Expect(t, err, Be[error](nil))
+			Expect(t, ok, Be(false))
+		}
+
+		expectNoRollbackSegments(t, pdb)
+	}
+
+	t.Run("rollback changes flushed", func(t *testing.T) {
+		s, pdb := setup(t)
+
+		sess := s.NewBatchSession("test")
+		writeLarge(t, sess)
+
+		// intermediary commits happened
+		ok, err := exists(pdb, encodeKey(t, 1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(true))
+
+		Expect(t, sess.Close(), Be[error](nil))
+
+		expectOrigin(t, pdb)
+	})
+
+	t.Run("rollback range deleted and flushed", func(t *testing.T) {
+		s, pdb := setup(t)
+
+		sess := s.NewBatchSession("test")
+		writeLarge(t, sess)
+		Expect(t, sess.DeleteRange(encodeKey(t, 0), encodeKey(t, 200)), Be[error](nil))
+		for i := uint64(200); i <= 300; i++ {
+			Expect(t, sess.Put(encodeKey(t, i), value), Be[error](nil))
+		}
+
+		// range tombstone flushed
+		ok, err := exists(pdb, encodeKey(t, 0))
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(false))
+
+		Expect(t, sess.Close(), Be[error](nil))
+
+		expectOrigin(t, pdb)
+	})
+
+	t.Run("commit changes flushed", func(t *testing.T) {
+		s, pdb := setup(t)
+
+		sess := s.NewBatchSession("test")
+		writeLarge(t, sess)
+		Expect(t, sess.Commit(), Be[error](nil))
+
+		v, err := get(pdb, encodeKey(t, 0))
+		Expect(t, err, Be[error](nil))
+		Expect(t, v, Equal([]byte("changed")))
+
+		for i := uint64(1); i <= 100; i++ {
+			ok, err := exists(pdb, encodeKey(t, i))
+			Expect(t, err, Be[error](nil))
+			Expect(t, ok, Be(true))
+		}
+
+		ok, err := exists(pdb, encodeKey(t, 101))
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(false))
+
+		expectNoRollbackSegments(t, pdb)
+	})
+
+	t.Run("recover changes flushed before crashed", func(t *testing.T) {
+		s, pdb := setup(t)
+
+		sess := s.NewBatchSession("test")
+		writeLarge(t, sess)
+
+		// as reopen after crashed
+		Expect(t, recoverRollbackSegments(pdb), Be[error](nil))
+
+		expectOrigin(t, pdb)
+
+		// session of the process crashed, released for shutdown only.
+		_ = sess.Close()
+	})
+
+	t.Run("read commits while others flushed", func(t *testing.T) {
+		s, _ := setup(t)
+
+		s1 := s.NewBatchSession("test")
+		writeLarge(t, s1)
+		defer s1.Close()
+
+		s2 := s.NewBatchSession("test")
+		Expect(t, s2.Put(encodeKey(t, 200), []byte("committed")), Be[error](nil))
+		Expect(t, s2.Commit(), Be[error](nil))
+
+		r, err := s.NewSnapshotSessionAt("test", s2.Sequence())
+		Expect(t, err, Be[error](nil))
+		defer r.Close()
+
+		latest := s.NewSnapshotSession("test")
+		Expect(t, latest.Sequence(), Be(s2.Sequence()))
+		Expect(t, latest.Close(), Be[error](nil))
+
+		v, err := r.Get(encodeKey(t, 200))
+		Expect(t, err, Be[error](nil))
+		Expect(t, v, Equal([]byte("committed")))
+
+		v, err = r.Get(encodeKey(t, 0))
+		Expect(t, err, Be[error](nil))
+		Expect(t, v, Equal([]byte("origin")))
+
+		v, err = r.Get(encodeKey(t, 101))
+		Expect(t, err, Be[error](nil))
+		Expect(t, v, Equal([]byte("origin")))
+
+		ok, err := r.Exists(encodeKey(t, 1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, ok, Be(false))
+
+		expected := [][]byte{encodeKey(t, 0), encodeKey(t, 101), encodeKey(t, 200)}
+
+		it := r.Iterator(encodeKey(t, 0), encodeKey(t, 300))
+		Expect(t, kvtest.Collect(it, false), Equal(expected))
+		Expect(t, kvtest.Collect(it, true), Equal([][]byte{expected[2], expected[1], expected[0]}))
+
+		Expect(t, it.SeekGE(encodeKey(t, 1)), Be(true))
+		Expect(t, it.Key(), Equal(encodeKey(t, 101)))
+		Expect(t, it.Value(), Equal([]byte("origin")))
+		Expect(t, it.SeekLT(encodeKey(t, 101)), Be(true))
+		Expect(t, it.Key(), Equal(encodeKey(t, 0)))
+		Expect(t, it.Close(), Be[error](nil))
+	})
+
+	t.Run("others read keys flushed", func(t *testing.T) {
+		s, _ := setup(t)
+
+		s1 := s.NewBatchSession("test")
+		writeLarge(t, s1)
+
+		s2 := s.NewBatchSession("test")
+		_, err := s2.Get(encodeKey(t, 1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, s2.Put(encodeKey(t, 200), []byte("1")), Be[error](nil))
+		Expect(t, errors.Is(s2.Commit(), kv.ErrConflict), Be(true))
+
+		Expect(t, s1.Close(), Be[error](nil))
+	})
+}
+
+func TestSnapshotSessionAt(t *testing.T) {
+	s := newMemStore(t)
+
+	put := func(t testing.TB, v string) uint64 {
+		sess := s.NewBatchSession("test")
+		Expect(t, sess.Put(encodeKey(t, 1), []byte(v)), Be[error](nil))
+		Expect(t, sess.Commit(), Be[error](nil))
+		return sess.Sequence()
+	}
+
+	expectValueAt := func(t testing.TB, seq uint64, v string) {
+		sess, err := s.NewSnapshotSessionAt("test", seq)
+		Expect(t, err, Be[error](nil))
+		defer sess.Close()
+
+		Expect(t, sess.Sequence(), Be(seq))
+
+		value, err := sess.Get(encodeKey(t, 1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, value, Equal([]byte(v)))
+	}
+
+	seq1 := put(t, "1")
+	seq2 := put(t, "2")
+
+	t.Run("sequences increase by commits", func(t *testing.T) {
+		Expect(t, seq2 > seq1, Be(true))
+	})
+
+	t.Run("read pinned to sequences", func(t *testing.T) {
+		expectValueAt(t, seq1, "1")
+		expectValueAt(t, seq2, "2")
+	})
+
+	t.Run("read session sees last commit", func(t *testing.T) {
+		sess := s.NewSnapshotSession("test")
+		defer sess.Close()
+		Expect(t, sess.Sequence(), Be(seq2))
+	})
+
+	t.Run("read not committed sequence", func(t *testing.T) {
+		_, err := s.NewSnapshotSessionAt("test", seq2+1)
+		Expect(t, errors.Is(err, kv.ErrSequenceUnavailable), Be(true))
+	})
+
+	t.Run("read sequence not retained", func(t *testing.T) {
+		sess, err := s.NewSnapshotSessionAt("test", seq1)
+		Expect(t, err, Be[error](nil))
+		defer sess.Close()
+
+		for i := 0; i < kv.DefaultMaxRetainedCommits; i++ {
+			put(t, "x")
+		}
+
+		_, err = s.NewSnapshotSessionAt("test", seq1)
+		Expect(t, errors.Is(err, kv.ErrSequenceUnavailable), Be(true))
+
+		t.Run("opened session still readable", func(t *testing.T) {
+			value, err := sess.Get(encodeKey(t, 1))
+			Expect(t, err, Be[error](nil))
+			Expect(t, value, Equal([]byte("1")))
+		})
+	})
+
+	t.Run("sequences continue after reopened", func(t *testing.T) {
+		fs := vfs.NewMem()
+		opt := kv.Options{MaxBatchSize: 1024}
+
+		pdb, err := Open("db", &pebble.Options{FS: fs})
+		Expect(t, err, Be[error](nil))
+		s, err := NewStore(pdb, nil, opt)
+		Expect(t, err, Be[error](nil))
+
+		sess := s.NewBatchSession("test")
+		Expect(t, sess.Put(encodeKey(t, 1), []byte("1")), Be[error](nil))
+		Expect(t, sess.Commit(), Be[error](nil))
+		seq := sess.Sequence()
+
+		// changes flushed then undone are assigned the sequence too.
+		aborted := s.NewBatchSession("test")
+		for i := uint64(1); i <= 100; i++ {
+			Expect(t, aborted.Put(encodeKey(t, i), bytes.Repeat([]byte("v"), 64)), Be[error](nil))
+		}
+		Expect(t, aborted.Close(), Be[error](nil))
+
+		r := s.NewSnapshotSession("test")
+		last := r.Sequence()
+		Expect(t, r.Close(), Be[error](nil))
+		Expect(t, last > seq, Be(true))
+
+		Expect(t, s.Shutdown(context.Background()), Be[error](nil))
+
+		pdb, err = Open("db", &pebble.Options{FS: fs})
+		Expect(t, err, Be[error](nil))
+		s, err = NewStore(pdb, nil, opt)
+		Expect(t, err, Be[error](nil))
+		defer s.Shutdown(context.Background())
+
+		r = s.NewSnapshotSession("test")
+		Expect(t, r.Sequence(), Be(last))
+		value, err := r.Get(encodeKey(t, 1))
+		Expect(t, err, Be[error](nil))
+		Expect(t, value, Equal([]byte("1")))
+		Expect(t, r.Close(), Be[error](nil))
+
+		_, err = s.NewSnapshotSessionAt("test", seq)
+		Expect(t, errors.Is(err, kv.ErrSequenceUnavailable), Be(true))
+
+		sess = s.NewBatchSession("test")
+		Expect(t, sess.Put(encodeKey(t, 1), []byte("2")), Be[error](nil))
+		Expect(t, sess.Commit(), Be[error](nil))
+		Expect(t, sess.Sequence(), Be(last+1))
+	})
+
+	t.Run("count of commits retained configured", func(t *testing.T) {
+		s := newMemStore(t, kv.Options{MaxRetainedCommits: 2})
+
+		seqs := make([]uint64, 0)
+		for i := 0; i < 3; i++ {
+			sess := s.NewBatchSession("test")
+			Expect(t, sess.Put(encodeKey(t, 1), []byte("1")), Be[error](nil))
+			Expect(t, sess.Commit(), Be[error](nil))
+			seqs = append(seqs, sess.Sequence())
+		}
+
+		_, err := s.NewSnapshotSessionAt("test", seqs[0])
+		Expect(t, errors.Is(err, kv.ErrSequenceUnavailable), Be(true))
+
+		for _, seq := range seqs[1:] {
+			sess, err := s.NewSnapshotSessionAt("test", seq)
+			Expect(t, err, Be[error](nil))
+			Expect(t, sess.Close(), Be[error](nil))
+		}
+	})
+}
+
+// syncBlockingFS blocks syncs of WAL once blocking.
+type syncBlockingFS struct {
+	vfs.FS
+	blocking int32
+	syncing  chan struct{}
+	release  chan struct{}
+}
+
+func (fs *syncBlockingFS) Create(name string) (vfs.File, error) {
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.wrap(name, f), nil
+}
+
+func (fs *syncBlockingFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	f, err := fs.FS.ReuseForWrite(oldname, newname)
+	if err != nil {
+		return nil, err
+	}
+	return fs.wrap(newname, f), nil
+}
+
+func (fs *syncBlockingFS) wrap(name string, f vfs.File) vfs.File {
+	if !strings.HasSuffix(name, ".log") {
+		return f
+	}
+	return &syncBlockingFile{File: f, fs: fs}
+}
+
+type syncBlockingFile struct {
+	vfs.File
+	fs *syncBlockingFS
+}
+
+func (f *syncBlockingFile) Sync() error {
+	if atomic.CompareAndSwapInt32(&f.fs.blocking, 1, 0) {
+		close(f.fs.syncing)
+		<-f.fs.release
+	}
+	return f.File.Sync()
+}
+
+func TestSyncOutOfCommits(t *testing.T) {
+	fs := &syncBlockingFS{
+		FS:      vfs.NewMem(),
+		syncing: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	pdb, err := Open("db", &pebble.Options{FS: fs})
+	Expect(t, err, Be[error](nil))
+	s, err := NewStore(pdb, nil, kv.Options{})
+	Expect(t, err, Be[error](nil))
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+
+	atomic.StoreInt32(&fs.blocking, 1)
+
+	synced := make(chan error, 1)
+	go func() {
+		sess := s.NewBatchSession("test")
+		_ = sess.Put(encodeKey(t, 1), []byte("1"))
+		synced <- sess.Commit()
+	}()
+
+	<-fs.syncing
+
+	t.Run("others commit while syncing", func(t *testing.T) {
+		committed := make(chan error, 1)
+		go func() {
+			sess := s.NewBatchSession("test")
+			_ = sess.Put(encodeKey(t, 2), []byte("2"))
+			committed <- sess.Commit(kv.NoSync)
+		}()
+
+		select {
+		case err := <-committed:
+			Expect(t, err, Be[error](nil))
+		case <-time.After(5 * time.Second):
+			t.Fatal("commit blocked by sync of others")
+		}
+
+		select {
+		case <-synced:
+			t.Fatal("commit returned before synced")
+		default:
+		}
+	})
+
+	close(fs.release)
+	Expect(t, <-synced, Be[error](nil))
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	t.Run("concurrent writers", func(t *testing.T) {
+		s := newMemStore(t)
+
+		counter := encodeKey(t, 1)
+
+		incr := func() error {
+			for {
+				sess := s.NewBatchSession("test")
+
+				n := uint64(0)
+				v, err := sess.Get(counter)
+				if err == nil {
+					n = binary.BigEndian.Uint64(v)
+				} else if !errors.Is(err, kv.ErrKeyNotFound) {
+					_ = sess.Close()
+					return err
+				}
+
+				next := make([]byte, 8)
+				binary.BigEndian.PutUint64(next, n+1)
+
+				if err := sess.Put(counter, next); err != nil {
+					_ = sess.Close()
+					return err
+				}
+
+				err = sess.Commit()
+				if errors.Is(err, kv.ErrConflict) {
+					continue
+				}
+				return err
+			}
+		}
+
+		workers, times := 8, 20
+
+		wg := &sync.WaitGroup{}
+		errs := make(chan error, workers)
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < times; j++ {
+					if err := incr(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			Expect(t, err, Be[error](nil))
+		}
+
+		sess := s.NewSnapshotSession("test")
+		defer sess.Close()
+
+		v, err := sess.Get(counter)
+		Expect(t, err, Be[error](nil))
+		Expect(t, binary.BigEndian.Uint64(v), Be(uint64(workers*times)))
+	})
+
+	t.Run("readers never see changes flushed but not committed", func(t *testing.T) {
+		s := newMemStore(t, kv.Options{MaxBatchSize: 1024})
+
+		value := bytes.Repeat([]byte("v"), 64)
+
+		keys := make([][]byte, 100)
+		for i := range keys {
+			keys[i] = encodeKey(t, uint64(101+i))
+		}
+		start, end := encodeKey(t, 101), encodeKey(t, 201)
+
+		done := make(chan struct{})
+		wg := &sync.WaitGroup{}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done)
+
+			for i := 0; i < 5; i++ {
+				sess := s.NewBatchSession("test")
+				for _, k := range keys {
+					if err := sess.Put(k, value); err != nil {
+						break
+					}
+				}
+				_ = sess.Close()
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				sess := s.NewSnapshotSession("test")
+				it := sess.Iterator(start, end)
+				found := it.First()
+				_ = it.Close()
+				_ = sess.Close()
+
+				if found {
+					t.Error("read changes not committed")
+					return
+				}
+			}
+		}()
+
+		wg.Wait()
+	})
+}
+
+func TestCommitDurability(t *testing.T) {
+	s := newMemStore(t)
+
+	for i, d := range []kv.Durability{kv.DurabilitySync, kv.DurabilityNoSync, kv.DurabilityGroupCommit} {
+		d := d
+		k := encodeKey(t, 1, uint64(i))
+
+		t.Run(string(d), func(t *testing.T) {
+			sess := s.NewBatchSession("test")
+			Expect(t, sess.Put(k, []byte(d)), Be[error](nil))
+			Expect(t, sess.Commit(kv.WithDurability(d)), Be[error](nil))
+
+			r := s.NewSnapshotSession("test")
+			defer r.Close()
+
+			v, err := r.Get(k)
+			Expect(t, err, Be[error](nil))
+			Expect(t, string(v), Be(string(d)))
+		})
+	}
+
+	t.Run("unsupported durability", func(t *testing.T) {
+		sess := s.NewBatchSession("test")
+		Expect(t, sess.Put(encodeKey(t, 2), []byte("v")), Be[error](nil))
+		Expect(t, sess.Commit(kv.WithDurability("unknown")), Not(Be[error](nil)))
+		_ = sess.Close()
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		Expect(t, s.Sync(), Be[error](nil))
+	})
+
+	t.Run("concurrent group commits share syncs", func(t *testing.T) {
+		g := kv.NewGroupSyncer()
+
+		syncs := uint64(0)
+		doSync := func() error {
+			atomic.AddUint64(&syncs, 1)
+			time.Sleep(time.Millisecond)
+			return nil
+		}
+
+		workers := 32
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				Expect(t, g.Sync(doSync), Be[error](nil))
+			}()
+		}
+		wg.Wait()
+
+		n := atomic.LoadUint64(&syncs)
+		Expect(t, n > 0 && n < uint64(workers), Be(true))
+	})
+}
+
+func expectNoRollbackSegments(t testing.TB, pdb *pebble.DB) {
+	start, end, err := rollbackBounds()
+	Expect(t, err, Be[error](nil))
+	it := pdb.NewIter(&pebble.IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+	Expect(t, it.First(), Be(false))
+	Expect(t, it.Close(), Be[error](nil))
+}
+
+func encodeKey(t testing.TB, values ...uint64) []byte {
+	buf := bytes.NewBuffer(nil)
+	enc := msgp.NewEncoder(buf)
+	for _, v := range values {
+		Expect(t, enc.Encode(v), Be[error](nil))
+	}
+	return buf.Bytes()
+}
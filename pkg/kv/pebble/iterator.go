@@ -0,0 +1,286 @@
+package pebble
+
+import (
+	"github.com/cockroachdb/pebble"
+	"github.com/google/btree"
+	"github.com/octohelm/kiwidb/pkg/kv"
+)
+
+// degree of b-trees of original values
+const degree = 32
+
+type item struct {
+	key []byte
+	// nil means the key not exists
+	value []byte
+}
+
+func newOriginals(compare func(a, b []byte) int) *originals {
+	return &originals{
+		compare: compare,
+		tree: btree.NewG(degree, func(a, b item) bool {
+			return compare(a.key, b.key) < 0
+		}),
+	}
+}
+
+// originals are original values of keys flushed by sessions not committed.
+type originals struct {
+	compare func(a, b []byte) int
+	tree    *btree.BTreeG[item]
+}
+
+func (o *originals) Get(k []byte) (item, bool) {
+	if o == nil {
+		return item{}, false
+	}
+	return o.tree.Get(item{key: k})
+}
+
+func (o *originals) ReplaceOrInsert(i item) {
+	o.tree.ReplaceOrInsert(i)
+}
+
+// ceil returns the first item after k, or equals k when inclusive, nil k means from the min.
+func (o *originals) ceil(k []byte, inclusive bool) (found item, ok bool) {
+	fn := func(i item) bool {
+		if !inclusive && o.compare(i.key, k) == 0 {
+			return true
+		}
+		found, ok = i, true
+		return false
+	}
+
+	if k == nil {
+		o.tree.Ascend(fn)
+	} else {
+		o.tree.AscendGreaterOrEqual(item{key: k}, fn)
+	}
+
+	return
+}
+
+// floor returns the last item before k, or equals k when inclusive, nil k means from the max.
+func (o *originals) floor(k []byte, inclusive bool) (found item, ok bool) {
+	fn := func(i item) bool {
+		if !inclusive && o.compare(i.key, k) == 0 {
+			return true
+		}
+		found, ok = i, true
+		return false
+	}
+
+	if k == nil {
+		o.tree.Descend(fn)
+	} else {
+		o.tree.DescendLessOrEqual(item{key: k}, fn)
+	}
+
+	return
+}
+
+var _ kv.Iterator = (*iterator)(nil)
+
+// iterator iterates keys of snapshot with original values of keys flushed by sessions not committed,
+// so changes not committed are never read.
+//
+// Iterator seeks from the current key for each move, so originals and iter could move independently.
+type iterator struct {
+	iter      *pebble.Iterator
+	originals *originals
+	compare   func(a, b []byte) int
+	start     []byte
+	end       []byte
+
+	// copied, as keys and values of iter are changed by moves
+	current item
+	valid   bool
+	err     error
+}
+
+func (it *iterator) First() bool {
+	return it.seekForward(it.start, true)
+}
+
+func (it *iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	return it.seekForward(it.current.key, false)
+}
+
+func (it *iterator) Last() bool {
+	if it.end == nil {
+		return it.seekBackward(nil, true)
+	}
+	return it.seekBackward(it.end, false)
+}
+
+func (it *iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	return it.seekBackward(it.current.key, false)
+}
+
+func (it *iterator) SeekGE(k []byte) bool {
+	if it.start != nil && it.compare(k, it.start) < 0 {
+		k = it.start
+	}
+	return it.seekForward(k, true)
+}
+
+func (it *iterator) SeekLT(k []byte) bool {
+	if it.end != nil && it.compare(k, it.end) > 0 {
+		k = it.end
+	}
+	return it.seekBackward(k, false)
+}
+
+func (it *iterator) seekForward(k []byte, inclusive bool) bool {
+	if it.iter == nil {
+		return false
+	}
+	for {
+		i, ok := it.merge(k, inclusive, true)
+		if !ok || (it.end != nil && it.compare(i.key, it.end) >= 0) {
+			return it.invalidate()
+		}
+		if i.value == nil {
+			// not exists before, skip it
+			k, inclusive = i.key, false
+			continue
+		}
+		return it.at(i)
+	}
+}
+
+func (it *iterator) seekBackward(k []byte, inclusive bool) bool {
+	if it.iter == nil {
+		return false
+	}
+	for {
+		i, ok := it.merge(k, inclusive, false)
+		if !ok || (it.start != nil && it.compare(i.key, it.start) < 0) {
+			return it.invalidate()
+		}
+		if i.value == nil {
+			k, inclusive = i.key, false
+			continue
+		}
+		return it.at(i)
+	}
+}
+
+// merge returns the nearest item of iter and originals in the direction,
+// item of originals wins when both have the same key.
+func (it *iterator) merge(k []byte, inclusive bool, forward bool) (item, bool) {
+	var b, c item
+	var bok, cok bool
+
+	direction := 1
+	if forward {
+		b, bok = it.ceil(k, inclusive)
+		c, cok = it.originals.ceil(k, inclusive)
+	} else {
+		direction = -1
+		b, bok = it.floor(k, inclusive)
+		c, cok = it.originals.floor(k, inclusive)
+	}
+
+	switch {
+	case !cok:
+		return b, bok
+	case !bok:
+		return c, cok
+	}
+
+	if it.compare(b.key, c.key)*direction < 0 {
+		return b, true
+	}
+	return c, true
+}
+
+func (it *iterator) ceil(k []byte, inclusive bool) (item, bool) {
+	var ok bool
+
+	if k == nil {
+		ok = it.iter.First()
+	} else {
+		ok = it.iter.SeekGE(k)
+		if ok && !inclusive && it.compare(it.iter.Key(), k) == 0 {
+			ok = it.iter.Next()
+		}
+	}
+
+	if !ok {
+		return item{}, false
+	}
+	return item{key: it.iter.Key(), value: it.iter.Value()}, true
+}
+
+func (it *iterator) floor(k []byte, inclusive bool) (item, bool) {
+	var ok bool
+
+	switch {
+	case k == nil:
+		ok = it.iter.Last()
+	case inclusive && it.iter.SeekGE(k) && it.compare(it.iter.Key(), k) == 0:
+		ok = true
+	default:
+		ok = it.iter.SeekLT(k)
+	}
+
+	if !ok {
+		return item{}, false
+	}
+	return item{key: it.iter.Key(), value: it.iter.Value()}, true
+}
+
+func (it *iterator) at(i item) bool {
+	it.current = item{
+		key:   append([]byte{}, i.key...),
+		value: append([]byte{}, i.value...),
+	}
+	it.valid = true
+	return true
+}
+
+func (it *iterator) invalidate() bool {
+	it.current = item{}
+	it.valid = false
+	return false
+}
+
+func (it *iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *iterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.iter != nil {
+		return it.iter.Error()
+	}
+	return nil
+}
+
+func (it *iterator) Key() []byte {
+	return it.current.key
+}
+
+// Value returns value of current key, which is valid until next move.
+func (it *iterator) Value() []byte {
+	return it.current.value
+}
+
+func (it *iterator) Close() error {
+	it.invalidate()
+	if it.iter == nil {
+		return nil
+	}
+	iter := it.iter
+	it.iter = nil
+	return iter.Close()
+}
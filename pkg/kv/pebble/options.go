@@ -0,0 +1,225 @@
+package pebble
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/pkg/errors"
+)
+
+// Keys of kv.Options.Extra for engine pebble, sizes are bytes, or with unit KB, MB or GB, like 64MB.
+const (
+	// ExtraPath is the directory of database, or ":memory:" to keep all in memory.
+	ExtraPath = "path"
+	// ExtraCacheSize is the size of block cache, 8MB by default.
+	ExtraCacheSize = "cacheSize"
+	// ExtraMemTableSize is the size of each memtable, 4MB by default, must be less than 4GB.
+	ExtraMemTableSize = "memTableSize"
+	// ExtraL0CompactionThreshold is the count of L0 read-amplification to trigger compaction, 4 by default.
+	ExtraL0CompactionThreshold = "l0CompactionThreshold"
+	// ExtraL0StopWritesThreshold is the count of L0 read-amplification to stop writes, 12 by default,
+	// must not be less than l0CompactionThreshold.
+	ExtraL0StopWritesThreshold = "l0StopWritesThreshold"
+	// ExtraCompression is the compression of levels from L0 separated by comma, the last one is used by levels left,
+	// like "none,snappy,zstd", could be none, snappy or zstd, snappy by default, at most one for each of 7 levels.
+	ExtraCompression = "compression"
+	// ExtraBloomFilterBitsPerKey enables bloom filters of all levels with bits per key, like 10.
+	ExtraBloomFilterBitsPerKey = "bloomFilterBitsPerKey"
+	// ExtraMaxOpenFiles is the soft limit of files opened, 1000 by default.
+	ExtraMaxOpenFiles = "maxOpenFiles"
+	// ExtraWALDir is the directory of WAL, the directory of database by default.
+	ExtraWALDir = "walDir"
+	// ExtraComparer is the name of comparer, ComparerName by default,
+	// LegacyComparerName only to migrate stores created before.
+	ExtraComparer = "comparer"
+)
+
+// count of levels of pebble
+const numLevels = 7
+
+// memtable must be less than 4GB
+const maxMemTableSize = 4 << 30
+
+// defaults of pebble
+const (
+	defaultL0CompactionThreshold = 4
+	defaultL0StopWritesThreshold = 12
+)
+
+var compressions = map[string]pebble.Compression{
+	"none":   pebble.NoCompression,
+	"snappy": pebble.SnappyCompression,
+	"zstd":   pebble.ZstdCompression,
+}
+
+// NewOptions creates pebble.Options from kv.Options.Extra, and returns the path of database.
+// When block cache created, callers should Unref it once database opened.
+func NewOptions(extra map[string]string) (string, *pebble.Options, error) {
+	opts := &pebble.Options{}
+
+	path, ok := extra[ExtraPath]
+	if !ok || path == "" {
+		return "", nil, errors.New("engine pebble need `path`")
+	}
+
+	if path == ":memory:" {
+		opts.FS = vfs.NewMem()
+		path = ""
+	}
+
+	for key, value := range extra {
+		var err error
+
+		switch key {
+		case ExtraPath:
+		case ExtraCacheSize:
+			var size int64
+			if size, err = parseSize(value); err == nil {
+				opts.Cache = pebble.NewCache(size)
+			}
+		case ExtraMemTableSize:
+			var size int64
+			if size, err = parseSize(value); err == nil {
+				if size >= maxMemTableSize {
+					err = errors.New("must be less than 4GB")
+				}
+				opts.MemTableSize = int(size)
+			}
+		case ExtraL0CompactionThreshold:
+			opts.L0CompactionThreshold, err = parsePositiveInt(value)
+		case ExtraL0StopWritesThreshold:
+			opts.L0StopWritesThreshold, err = parsePositiveInt(value)
+		case ExtraMaxOpenFiles:
+			opts.MaxOpenFiles, err = parsePositiveInt(value)
+		case ExtraWALDir:
+			opts.WALDir = value
+		case ExtraComparer:
+			c, ok := comparers[value]
+			if !ok {
+				err = errors.New("unknown comparer")
+			}
+			opts.Comparer = c
+		case ExtraCompression:
+			err = setLevels(opts, value, func(l *pebble.LevelOptions, v string) error {
+				c, ok := compressions[strings.TrimSpace(v)]
+				if !ok {
+					return errors.Errorf("unsupported compression %q", v)
+				}
+				l.Compression = c
+				return nil
+			})
+		case ExtraBloomFilterBitsPerKey:
+			var bits int
+			if bits, err = parsePositiveInt(value); err == nil {
+				err = setLevels(opts, "", func(l *pebble.LevelOptions, v string) error {
+					l.FilterPolicy = bloom.FilterPolicy(bits)
+					return nil
+				})
+			}
+		default:
+			err = errors.New("unknown option")
+		}
+
+		if err != nil {
+			releaseCache(opts)
+			return "", nil, errors.Wrapf(err, "invalid %s=%q of engine pebble", key, value)
+		}
+	}
+
+	compactionThreshold, stopWritesThreshold := opts.L0CompactionThreshold, opts.L0StopWritesThreshold
+	if compactionThreshold == 0 {
+		compactionThreshold = defaultL0CompactionThreshold
+	}
+	if stopWritesThreshold == 0 {
+		stopWritesThreshold = defaultL0StopWritesThreshold
+	}
+	if stopWritesThreshold < compactionThreshold {
+		releaseCache(opts)
+		return "", nil, errors.Errorf("%s (%d) of engine pebble must not be less than %s (%d)", ExtraL0StopWritesThreshold, stopWritesThreshold, ExtraL0CompactionThreshold, compactionThreshold)
+	}
+
+	return path, opts, nil
+}
+
+func releaseCache(opts *pebble.Options) {
+	if opts.Cache != nil {
+		opts.Cache.Unref()
+		opts.Cache = nil
+	}
+}
+
+// setLevels sets options of all levels by values separated by comma, the last value is used by levels left.
+func setLevels(opts *pebble.Options, values string, set func(l *pebble.LevelOptions, v string) error) error {
+	list := strings.Split(values, ",")
+	if len(list) > numLevels {
+		return errors.Errorf("more than %d levels", numLevels)
+	}
+
+	if opts.Levels == nil {
+		opts.Levels = make([]pebble.LevelOptions, numLevels)
+	}
+
+	for i := range opts.Levels {
+		v := list[len(list)-1]
+		if i < len(list) {
+			v = list[i]
+		}
+		if err := set(&opts.Levels[i], v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parsePositiveInt(s string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if i <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return i, nil
+}
+
+var units = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func parseSize(s string) (int64, error) {
+	size := int64(1)
+
+	s = strings.TrimSpace(strings.ToUpper(s))
+
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			size = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	if n > math.MaxInt64/size {
+		return 0, errors.New("too large")
+	}
+
+	return n * size, nil
+}
@@ -0,0 +1,241 @@
+package pebble
+
+import (
+	"bytes"
+	"math"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/pkg/errors"
+)
+
+// namespace reserved for rollback segments.
+// keys of rollback segments are [rollbackNamespace, segmentID, key], segmentID starts from 1.
+const rollbackNamespace uint64 = math.MaxUint64
+
+const (
+	// marks the key not exists before the session
+	rollbackOpDel byte = iota
+	// marks the key exists with value before the session
+	rollbackOpSet
+)
+
+func newRollbackSegment(id uint64) *rollbackSegment {
+	return &rollbackSegment{
+		id:      id,
+		pending: map[string]struct{}{},
+		saved:   map[string]struct{}{},
+	}
+}
+
+// rollbackSegment keeps original values of keys changed by a batch session,
+// before changes of the batch flushed in the middle of the session.
+//
+// Original values are written with the flushed changes in the same batch,
+// so Rollback could restore them even after the process crashed.
+type rollbackSegment struct {
+	id uint64
+	// keys changed after last flush
+	pending map[string]struct{}
+	// ranges deleted after last flush
+	pendingRanges [][2][]byte
+	// keys with original values saved
+	saved map[string]struct{}
+	// whether any changes flushed
+	flushed bool
+}
+
+func (s *rollbackSegment) EnqueueOp(k []byte) {
+	s.pending[string(k)] = struct{}{}
+}
+
+// EnqueueRange marks keys in [start, end) changed, end is required.
+func (s *rollbackSegment) EnqueueRange(start []byte, end []byte) {
+	s.pendingRanges = append(s.pendingRanges, [2][]byte{
+		append([]byte(nil), start...),
+		append([]byte(nil), end...),
+	})
+}
+
+// Apply writes original values of pending keys into the batch,
+// returns all keys pending, with keys existing in pending ranges.
+func (s *rollbackSegment) Apply(db *pebble.DB, b *pebble.Batch) ([][]byte, error) {
+	// original values of keys in ranges deleted are required for rollback,
+	// so they are saved one by one, only when changes flushed.
+	for _, r := range s.pendingRanges {
+		if err := s.enqueueExisting(db, r[0], r[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([][]byte, 0, len(s.pending))
+
+	for k := range s.pending {
+		keys = append(keys, []byte(k))
+
+		if _, ok := s.saved[k]; ok {
+			continue
+		}
+
+		v, closer, err := db.Get([]byte(k))
+		if err != nil {
+			if !errors.Is(err, pebble.ErrNotFound) {
+				return nil, err
+			}
+			if err := b.Set(s.keyOf([]byte(k)), []byte{rollbackOpDel}, nil); err != nil {
+				return nil, err
+			}
+		} else {
+			err := b.Set(s.keyOf([]byte(k)), append([]byte{rollbackOpSet}, v...), nil)
+			_ = closer.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		s.saved[k] = struct{}{}
+	}
+
+	return keys, nil
+}
+
+func (s *rollbackSegment) enqueueExisting(db *pebble.DB, start []byte, end []byte) error {
+	it := db.NewIter(&pebble.IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+
+	for it.First(); it.Valid(); it.Next() {
+		s.EnqueueOp(it.Key())
+	}
+
+	return it.Close()
+}
+
+// Done marks pending keys flushed.
+func (s *rollbackSegment) Done() {
+	s.pending = map[string]struct{}{}
+	s.pendingRanges = nil
+	s.flushed = true
+}
+
+// Clear deletes the segment in the batch.
+func (s *rollbackSegment) Clear(b *pebble.Batch) error {
+	if !s.flushed {
+		return nil
+	}
+	start, end := s.bounds()
+	return b.DeleteRange(start, end, nil)
+}
+
+// Rollback restores original values of keys flushed into the batch, and clear the segment.
+func (s *rollbackSegment) Rollback(db *pebble.DB, b *pebble.Batch) error {
+	if !s.flushed {
+		return nil
+	}
+	start, end := s.bounds()
+	_, err := rollback(db, b, start, end)
+	return err
+}
+
+func (s *rollbackSegment) keyOf(k []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	enc := msgp.NewEncoder(buf)
+	_ = enc.Encode(rollbackNamespace)
+	_ = enc.Encode(s.id)
+	_ = enc.Encode(string(k))
+	return buf.Bytes()
+}
+
+func (s *rollbackSegment) bounds() ([]byte, []byte) {
+	buf := bytes.NewBuffer(nil)
+	enc := msgp.NewEncoder(buf)
+	_ = enc.Encode(rollbackNamespace)
+	_ = enc.Encode(s.id)
+	start := buf.Bytes()
+	return start, append(append([]byte(nil), start...), 0xFF)
+}
+
+// recoverRollbackSegments rollbacks all segments left,
+// which means the process crashed before sessions committed or rolled back.
+func recoverRollbackSegments(db *pebble.DB) error {
+	start, end, err := rollbackBounds()
+	if err != nil {
+		return err
+	}
+
+	b := db.NewBatch()
+	defer b.Close()
+
+	n, err := rollback(db, b, start, end)
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	return b.Commit(pebble.Sync)
+}
+
+// rollback writes original values in rollback segments of [start, end) into the batch,
+// and returns count of keys restored.
+func rollback(r pebble.Reader, b *pebble.Batch, start []byte, end []byte) (int, error) {
+	n, err := walkRollback(r, start, end, func(k []byte, v []byte, exists bool) error {
+		if !exists {
+			return b.Delete(k, nil)
+		}
+		return b.Set(k, v, nil)
+	})
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	return n, b.DeleteRange(start, end, nil)
+}
+
+// walkRollback calls fn with original values in rollback segments of [start, end),
+// exists is false when the key not exists before, and returns count of keys walked.
+func walkRollback(r pebble.Reader, start []byte, end []byte, fn func(k []byte, v []byte, exists bool) error) (int, error) {
+	// [rollbackNamespace, segmentID] are both uint64, 9 bytes for each.
+	prefixLen := 2 * 9
+
+	it := r.NewIter(&pebble.IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+
+	n := 0
+
+	for it.First(); it.Valid(); it.Next() {
+		k := ""
+		if err := msgp.Unmarshal(it.Key()[prefixLen:], &k); err != nil {
+			_ = it.Close()
+			return 0, errors.Wrap(err, "invalid key of rollback segment")
+		}
+
+		v := it.Value()
+		if len(v) == 0 {
+			_ = it.Close()
+			return 0, errors.New("invalid value of rollback segment")
+		}
+
+		if err := fn([]byte(k), v[1:], v[0] != rollbackOpDel); err != nil {
+			_ = it.Close()
+			return 0, err
+		}
+		n++
+	}
+
+	if err := it.Close(); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// rollbackBounds returns bounds of all rollback segments, excluding sequenceKey.
+func rollbackBounds() ([]byte, []byte, error) {
+	start := reservedKey(rollbackNamespace, 1)
+	return start, append(reservedKey(rollbackNamespace), 0xFF), nil
+}
@@ -0,0 +1,58 @@
+package pebble
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+	"github.com/pkg/errors"
+)
+
+var (
+	// keys from it are reserved, hidden from iterators of sessions.
+	reservedKeyStart = reservedKey(rollbackNamespace)
+	// sequence of last commit is kept as segment 0, which is never used by rollback segments.
+	sequenceKey = reservedKey(rollbackNamespace, 0)
+)
+
+func reservedKey(values ...uint64) []byte {
+	buf := bytes.NewBuffer(nil)
+	enc := msgp.NewEncoder(buf)
+	for _, v := range values {
+		_ = enc.Encode(v)
+	}
+	return buf.Bytes()
+}
+
+// upperBound limits unbounded iterations before keys reserved.
+func upperBound(end []byte) []byte {
+	if end == nil {
+		return reservedKeyStart
+	}
+	return end
+}
+
+// readSequence returns the sequence persisted by commits before, 0 for new db.
+func readSequence(r pebble.Reader) (uint64, error) {
+	v, closer, err := r.Get(sequenceKey)
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer closer.Close()
+
+	if len(v) != 8 {
+		return 0, errors.New("invalid sequence persisted")
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+// writeSequence persists the sequence with changes of the batch.
+func writeSequence(b *pebble.Batch, seq uint64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, seq)
+	return b.Set(sequenceKey, v, nil)
+}
@@ -1,6 +1,7 @@
 package pebble
 
 import (
+	"sync"
 	"sync/atomic"
 
 	"github.com/cockroachdb/pebble"
@@ -11,6 +12,40 @@ import (
 type snapshot struct {
 	refCount int64
 	snapshot *pebble.Snapshot
+	compare  func(a, b []byte) int
+	// whether changes flushed by sessions not committed in the snapshot
+	dirty bool
+
+	once      sync.Once
+	originals *originals
+	err       error
+}
+
+// Originals returns original values of keys flushed by sessions not committed in the snapshot,
+// which are loaded from rollback segments in the snapshot once first read, nil when not dirty.
+func (s *snapshot) Originals() (*originals, error) {
+	if !s.dirty {
+		return nil, nil
+	}
+	s.once.Do(func() {
+		start, end, err := rollbackBounds()
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		o := newOriginals(s.compare)
+		_, s.err = walkRollback(s.snapshot, start, end, func(k []byte, v []byte, exists bool) error {
+			i := item{key: k}
+			if exists {
+				i.value = append([]byte{}, v...)
+			}
+			o.ReplaceOrInsert(i)
+			return nil
+		})
+		s.originals = o
+	})
+	return s.originals, s.err
 }
 
 func (s *snapshot) Incr() {
@@ -30,6 +65,7 @@ func (s *snapshot) Done() error {
 type SnapshotSession struct {
 	store    *store
 	Snapshot *snapshot
+	seq      uint64
 	closed   bool
 }
 
@@ -44,9 +80,15 @@ func (s *SnapshotSession) Close() error {
 		return errors.New("already closed")
 	}
 	s.closed = true
+	s.store.metrics.SnapshotSessionClosed()
+	defer s.store.gate.Leave()
 	return s.Snapshot.Done()
 }
 
+func (s *SnapshotSession) Sequence() uint64 {
+	return s.seq
+}
+
 func (s *SnapshotSession) Insert(k, v []byte) error {
 	return errors.New("cannot insert in read-only mode")
 }
@@ -57,11 +99,28 @@ func (s *SnapshotSession) Put(k, v []byte) error {
 
 // Get returns a value associated with the given key. If not found, returns ErrKeyNotFound.
 func (s *SnapshotSession) Get(k []byte) ([]byte, error) {
+	o, err := s.Snapshot.Originals()
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := o.Get(k); ok {
+		if i.value == nil {
+			return nil, errors.WithStack(kv.ErrKeyNotFound)
+		}
+		return append([]byte{}, i.value...), nil
+	}
 	return get(s.Snapshot.snapshot, k)
 }
 
 // Exists returns whether a key exists and is visible by the current session.
 func (s *SnapshotSession) Exists(k []byte) (bool, error) {
+	o, err := s.Snapshot.Originals()
+	if err != nil {
+		return false, err
+	}
+	if i, ok := o.Get(k); ok {
+		return i.value != nil, nil
+	}
 	return exists(s.Snapshot.snapshot, k)
 }
 
@@ -70,9 +129,31 @@ func (s *SnapshotSession) Delete(k []byte) error {
 	return errors.New("cannot delete in read-only mode")
 }
 
+func (s *SnapshotSession) DeleteRange(start []byte, end []byte) error {
+	return errors.New("cannot delete in read-only mode")
+}
+
 func (s *SnapshotSession) Iterator(start []byte, end []byte) kv.Iterator {
-	return s.Snapshot.snapshot.NewIter(&pebble.IterOptions{
+	end = upperBound(end)
+
+	it := s.Snapshot.snapshot.NewIter(&pebble.IterOptions{
 		LowerBound: start,
 		UpperBound: end,
 	})
+
+	o, err := s.Snapshot.Originals()
+	if err != nil {
+		_ = it.Close()
+		return &iterator{err: err}
+	}
+	if o == nil {
+		return it
+	}
+	return &iterator{
+		iter:      it,
+		originals: o,
+		compare:   s.store.compare,
+		start:     start,
+		end:       end,
+	}
 }
@@ -3,6 +3,7 @@ package pebble
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
@@ -11,107 +12,248 @@ import (
 	"github.com/octohelm/kiwidb/pkg/kv"
 )
 
+var _ kv.Locker = (*store)(nil)
+
 type store struct {
 	db   *pebble.DB
 	opts kv.Options
+	// compare of the comparer db opened with
+	compare func(a, b []byte) int
+	oracle  *kv.Oracle
+	locks   *kv.LockTable
+	syncer  *kv.GroupSyncer
+	// metrics of sessions
+	metrics *kv.SessionMetrics
+	// open sessions waited on shutdown
+	gate *kv.SessionGate
+
+	// id of last rollback segment of batch sessions
+	segmentID uint64
 
-	// holds the shared snapshot read by all the read sessions
-	// when a write session is open.
-	// when no write session is open, the snapshot is nil
-	// and every read session will use db.NewSnapshot()
-	sharedSnapshot struct {
-		sync.RWMutex
+	// snapshots of committed state retained for read sessions.
+	// snapshots are taken right after every commit, changes flushed by write sessions not committed yet
+	// are hidden by original values in rollback segments of the snapshot, so read sessions never see them.
+	// write sessions could run concurrently, conflicts between them are detected by the oracle.
+	retained struct {
+		sync.Mutex
 
-		snapshot *snapshot
+		// sequence of last snapshot retained
+		seq       uint64
+		seqs      []uint64
+		snapshots map[uint64]*snapshot
 	}
 }
 
+// Shutdown rejects new sessions, waits for open sessions closed, then flushes and closes db.
 func (s *store) Shutdown(ctx context.Context) error {
-	defer func() {
-		if err := s.db.Close(); err != nil {
-			logr.FromContextOrDiscard(ctx).Error(err, "Close")
+	return s.gate.Close(ctx, func() error {
+		// snapshots must be released before db closed
+		s.releaseRetained()
+
+		defer func() {
+			if err := s.db.Close(); err != nil {
+				logr.FromContextOrDiscard(ctx).Error(err, "Close")
+			}
+		}()
+
+		// To make sure mem data write to disk
+		f, err := s.db.AsyncFlush()
+		if err != nil {
+			return errors.Wrap(err, "AsyncFlush")
 		}
-	}()
 
-	// To make sure mem data write to disk
-	f, err := s.db.AsyncFlush()
-	if err != nil {
-		return errors.Wrap(err, "AsyncFlush")
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-f:
+				logr.FromContextOrDiscard(ctx).Info("Flushed")
+				return nil
+			}
+		}
+	})
+}
+
+// NewStore creates kv.Store of db, sequences continue from the one persisted by commits before.
+// comparer should be the one db opened with, DefaultComparer when nil.
+func NewStore(db *pebble.DB, comparer *pebble.Comparer, opts kv.Options) (kv.Store, error) {
+	if comparer == nil {
+		comparer = DefaultComparer
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-f:
-			logr.FromContextOrDiscard(ctx).Info("Flushed")
-			return nil
-		}
+	seq, err := readSequence(db)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func NewStore(db *pebble.DB, opts kv.Options) kv.Store {
 	if opts.MaxBatchSize <= 0 {
 		opts.MaxBatchSize = defaultMaxBatchSize
 	}
-	return &store{
-		db:   db,
-		opts: opts,
+	if opts.MaxRetainedCommits <= 0 {
+		opts.MaxRetainedCommits = kv.DefaultMaxRetainedCommits
 	}
+	st := &store{
+		db:      db,
+		opts:    opts,
+		compare: comparer.Compare,
+		oracle:  kv.NewOracleAt(comparer.Compare, seq),
+		locks:   kv.NewLockTable(),
+		syncer:  kv.NewGroupSyncer(),
+
+		metrics: kv.NewSessionMetrics(),
+		gate:    kv.NewSessionGate(),
+	}
+	st.retained.snapshots = map[uint64]*snapshot{}
+	// state of last commit before opened
+	st.retain(seq, true)
+	st.oracle.Observe(func(seq uint64, clean bool) {
+		// changes flushed by others not committed in the state are hidden by original values when read.
+		st.retain(seq, clean)
+	})
+	return st, nil
 }
 
-func (s *store) NewSnapshotSession(dbName string) kv.Session {
-	var sn *snapshot
+// Sync persists WAL, so all changes committed are durable.
+func (s *store) Sync() error {
+	return s.db.LogData(nil, pebble.Sync)
+}
 
-	// if there is a shared snapshot, use it.
-	s.sharedSnapshot.RLock()
-	sn = s.sharedSnapshot.snapshot
+// Checkpoint writes files of db into dir, on the file system of db, with hard links when possible.
+// Changes flushed by sessions not committed are undone once the checkpoint opened.
+func (s *store) Checkpoint(dir string) error {
+	return s.db.Checkpoint(dir, pebble.WithFlushedWAL())
+}
 
-	// if there is no shared snapshot, create one.
-	if sn == nil {
-		sn = &snapshot{
-			snapshot: s.db.NewSnapshot(),
-			refCount: 1,
-		}
-	} else {
-		// if there is a shared snapshot, increment the ref count.
-		sn.Incr()
+// Stats returns metrics of sessions and pebble.
+func (s *store) Stats() kv.Stats {
+	stats := s.metrics.Stats()
+
+	m := s.db.Metrics()
+	total := m.Total()
+
+	hitRate := float64(0)
+	if lookups := m.BlockCache.Hits + m.BlockCache.Misses; lookups > 0 {
+		hitRate = float64(m.BlockCache.Hits) / float64(lookups)
+	}
+
+	stats.Engine = map[string]float64{
+		"compactions_total":               float64(m.Compact.Count),
+		"compactions_in_progress":         float64(m.Compact.NumInProgress),
+		"compaction_estimated_debt_bytes": float64(m.Compact.EstimatedDebt),
+		"flushes_total":                   float64(m.Flush.Count),
+		"memtable_size_bytes":             float64(m.MemTable.Size),
+		"memtables":                       float64(m.MemTable.Count),
+		"l0_files":                        float64(m.Levels[0].NumFiles),
+		"l0_sublevels":                    float64(m.Levels[0].Sublevels),
+		"read_amplification":              float64(m.ReadAmp()),
+		"write_amplification":             total.WriteAmp(),
+		"block_cache_size_bytes":          float64(m.BlockCache.Size),
+		"block_cache_hits_total":          float64(m.BlockCache.Hits),
+		"block_cache_misses_total":        float64(m.BlockCache.Misses),
+		"block_cache_hit_rate":            hitRate,
+		"wal_size_bytes":                  float64(m.WAL.Size),
+		"disk_usage_bytes":                float64(m.DiskSpaceUsage()),
+	}
+
+	return stats
+}
+
+func (s *store) Locks() *kv.LockTable {
+	return s.locks
+}
+
+// retain takes snapshot for the commit sequence,
+// should be called right after the commit applied, before any other changes applied.
+func (s *store) retain(seq uint64, clean bool) {
+	s.retained.Lock()
+	defer s.retained.Unlock()
+
+	s.retained.seq = seq
+	s.retained.seqs = append(s.retained.seqs, seq)
+	s.retained.snapshots[seq] = &snapshot{
+		snapshot: s.db.NewSnapshot(),
+		compare:  s.compare,
+		refCount: 1,
+		dirty:    !clean,
 	}
 
-	s.sharedSnapshot.RUnlock()
+	for len(s.retained.seqs) > s.opts.MaxRetainedCommits {
+		oldest := s.retained.seqs[0]
+		s.retained.seqs = s.retained.seqs[1:]
+		_ = s.retained.snapshots[oldest].Done()
+		delete(s.retained.snapshots, oldest)
+	}
+}
+
+func (s *store) releaseRetained() {
+	s.retained.Lock()
+	defer s.retained.Unlock()
+
+	for seq, sn := range s.retained.snapshots {
+		_ = sn.Done()
+		delete(s.retained.snapshots, seq)
+	}
+	s.retained.seqs = nil
+}
+
+func (s *store) NewSnapshotSessionAt(dbName string, seq uint64) (kv.Session, error) {
+	if err := s.gate.Enter(); err != nil {
+		return nil, err
+	}
+
+	s.retained.Lock()
+	defer s.retained.Unlock()
+
+	sn, ok := s.retained.snapshots[seq]
+	if !ok {
+		s.gate.Leave()
+		return nil, errors.Wrapf(kv.ErrSequenceUnavailable, "read at %d", seq)
+	}
+	sn.Incr()
+	s.metrics.SnapshotSessionOpened()
 
 	return &SnapshotSession{
 		store:    s,
 		Snapshot: sn,
-	}
+		seq:      seq,
+	}, nil
 }
 
-func (s *store) NewBatchSession(dbName string) kv.Session {
-	// before creating a batch session, create a shared snapshot
-	// at this point-in-time.
-	s.lockSharedSnapshot()
-	b := s.db.NewIndexedBatch()
+// NewSnapshotSession creates read session of the last snapshot retained.
+func (s *store) NewSnapshotSession(dbName string) kv.Session {
+	if err := s.gate.Enter(); err != nil {
+		return kv.RejectedSession(err)
+	}
 
-	return &BatchSession{
-		store:        s,
-		DB:           s.db,
-		Batch:        b,
-		maxBatchSize: s.opts.MaxBatchSize,
+	s.retained.Lock()
+	defer s.retained.Unlock()
+
+	seq := s.retained.seq
+	sn := s.retained.snapshots[seq]
+	sn.Incr()
+	s.metrics.SnapshotSessionOpened()
+
+	return &SnapshotSession{
+		store:    s,
+		Snapshot: sn,
+		seq:      seq,
 	}
 }
 
-func (s *store) lockSharedSnapshot() {
-	s.sharedSnapshot.Lock()
-	s.sharedSnapshot.snapshot = &snapshot{
-		snapshot: s.db.NewSnapshot(),
-		refCount: 1,
+func (s *store) NewBatchSession(dbName string) kv.Session {
+	if err := s.gate.Enter(); err != nil {
+		return kv.RejectedSession(err)
 	}
-	s.sharedSnapshot.Unlock()
-}
 
-func (s *store) unlockSharedSnapshot() {
-	s.sharedSnapshot.Lock()
-	s.sharedSnapshot.snapshot.Done()
-	s.sharedSnapshot.snapshot = nil
-	s.sharedSnapshot.Unlock()
+	b := s.db.NewIndexedBatch()
+	s.metrics.BatchSessionOpened()
+
+	return &BatchSession{
+		store:           s,
+		DB:              s.db,
+		Batch:           b,
+		txn:             s.oracle.Begin(),
+		rollbackSegment: newRollbackSegment(atomic.AddUint64(&s.segmentID, 1)),
+		maxBatchSize:    s.opts.MaxBatchSize,
+	}
 }
@@ -2,12 +2,41 @@ package kv
 
 type CommitOptionFunc = func(opt *CommitOption)
 
-var NoSync = func(opt *CommitOption) {
-	opt.NoSync = true
+var NoSync = WithDurability(DurabilityNoSync)
+
+func WithDurability(d Durability) CommitOptionFunc {
+	return func(opt *CommitOption) {
+		opt.Durability = d
+	}
 }
 
 type CommitOption struct {
-	NoSync bool
+	Durability Durability
+}
+
+// Durability controls when changes committed are persisted.
+type Durability string
+
+const (
+	// DurabilitySync persists changes before commit returns by a sync of its own, as default.
+	// Engines could sync after changes applied, out of serialized commits, like pebble,
+	// then changes could be read by others before persisted, as DurabilityGroupCommit.
+	DurabilitySync Durability = "sync"
+	// DurabilityNoSync returns once changes applied, changes could be lost when the process crashed,
+	// until persisted by Store.Sync or commits after.
+	DurabilityNoSync Durability = "no-sync"
+	// DurabilityGroupCommit persists changes before commit returns,
+	// but syncs are shared between concurrent commits.
+	// Changes could be read by others before persisted.
+	DurabilityGroupCommit Durability = "group-commit"
+)
+
+func (d Durability) IsValid() bool {
+	switch d {
+	case DurabilitySync, DurabilityNoSync, DurabilityGroupCommit:
+		return true
+	}
+	return false
 }
 
 type Session interface {
@@ -23,10 +52,28 @@ type Session interface {
 	Close() error
 	// Exists returns whether a key exists and is visible by the current session.
 	Exists(k []byte) (bool, error)
-	// Delete a record by key. If not found, returns ErrKeyNotFound.
+	// Delete a record by key. If the key doesn't exist, it doesn't do anything.
 	Delete(k []byte) error
+	// DeleteRange deletes keys in [start, end), nil start means unbounded, end is required.
+	// Keys written by the session in the range before are deleted too.
+	DeleteRange(start []byte, end []byte) error
 
+	// Iterator iterates keys in [start, end), nil means unbounded.
 	Iterator(start []byte, end []byte) Iterator
+
+	// Sequence returns the commit sequence of the session.
+	// For write session, it is the sequence assigned once committed, 0 before committed,
+	// for read session, it is the sequence of the last commit visible.
+	// Sequences of persistent stores are persisted with changes, so they continue after reopened.
+	Sequence() uint64
+}
+
+// Restamper is implemented by sessions which detect conflicts of keys read.
+type Restamper interface {
+	// Restamp treats the key as read again at the last commit,
+	// so changes of it committed before never conflict, even read by ranges,
+	// like once locked, changes of others before the lock acquired are read again.
+	Restamp(k []byte)
 }
 
 type Iterator interface {
@@ -36,6 +83,11 @@ type Iterator interface {
 	Last() bool // reverse
 	Prev() bool
 
+	// SeekGE moves to the first key greater than or equal to k, bounded by the range of the iterator.
+	SeekGE(k []byte) bool
+	// SeekLT moves to the last key less than k, bounded by the range of the iterator.
+	SeekLT(k []byte) bool
+
 	Valid() bool
 	Error() error
 
@@ -0,0 +1,157 @@
+package kv
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats of store, metrics of sessions are common for all engines, others are engine specific.
+type Stats struct {
+	// OpenSnapshotSessions is count of read sessions not closed.
+	OpenSnapshotSessions int64
+	// OpenBatchSessions is count of write sessions not closed.
+	OpenBatchSessions int64
+	// Commits is count of write sessions committed.
+	Commits uint64
+	// Conflicts is count of commits failed with ErrConflict.
+	Conflicts uint64
+	// CommitLatency of commits in seconds, including commits failed.
+	CommitLatency HistogramStats
+	// BatchSize of commits in bytes of keys and values written.
+	BatchSize HistogramStats
+	// Engine metrics in snake_case, like compactions_total of pebble,
+	// counters end with _total, others are gauges.
+	Engine map[string]float64
+}
+
+// HistogramStats is cumulative as Prometheus histograms.
+type HistogramStats struct {
+	Buckets []Bucket
+	Count   uint64
+	Sum     float64
+}
+
+type Bucket struct {
+	UpperBound float64
+	// Count of observations less than or equal to UpperBound
+	Count uint64
+}
+
+var (
+	commitLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+	batchSizeBuckets     = []float64{1 << 8, 1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26}
+)
+
+// NewSessionMetrics creates SessionMetrics for stores to record metrics of sessions.
+func NewSessionMetrics() *SessionMetrics {
+	return &SessionMetrics{
+		commitLatency: newHistogram(commitLatencyBuckets),
+		batchSize:     newHistogram(batchSizeBuckets),
+	}
+}
+
+// SessionMetrics records metrics of sessions, safe for concurrent use.
+type SessionMetrics struct {
+	openSnapshotSessions int64
+	openBatchSessions    int64
+	commits              uint64
+	conflicts            uint64
+	commitLatency        *histogram
+	batchSize            *histogram
+}
+
+func (m *SessionMetrics) SnapshotSessionOpened() {
+	atomic.AddInt64(&m.openSnapshotSessions, 1)
+}
+
+func (m *SessionMetrics) SnapshotSessionClosed() {
+	atomic.AddInt64(&m.openSnapshotSessions, -1)
+}
+
+func (m *SessionMetrics) BatchSessionOpened() {
+	atomic.AddInt64(&m.openBatchSessions, 1)
+}
+
+func (m *SessionMetrics) BatchSessionClosed() {
+	atomic.AddInt64(&m.openBatchSessions, -1)
+}
+
+// ObserveCommit records the commit started at startedAt with bytes written.
+func (m *SessionMetrics) ObserveCommit(startedAt time.Time, size int, err error) {
+	m.commitLatency.Observe(time.Since(startedAt).Seconds())
+
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			atomic.AddUint64(&m.conflicts, 1)
+		}
+		return
+	}
+
+	atomic.AddUint64(&m.commits, 1)
+	m.batchSize.Observe(float64(size))
+}
+
+// Stats returns Stats of sessions, Engine should be filled by stores.
+func (m *SessionMetrics) Stats() Stats {
+	return Stats{
+		OpenSnapshotSessions: atomic.LoadInt64(&m.openSnapshotSessions),
+		OpenBatchSessions:    atomic.LoadInt64(&m.openBatchSessions),
+		Commits:              atomic.LoadUint64(&m.commits),
+		Conflicts:            atomic.LoadUint64(&m.conflicts),
+		CommitLatency:        m.commitLatency.Stats(),
+		BatchSize:            m.batchSize.Stats(),
+	}
+}
+
+func newHistogram(upperBounds []float64) *histogram {
+	return &histogram{
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)),
+	}
+}
+
+type histogram struct {
+	upperBounds []float64
+
+	mu sync.Mutex
+	// count of observations of each bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upperBound := range h.upperBounds {
+		if v <= upperBound {
+			h.counts[i]++
+			break
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) Stats() HistogramStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := HistogramStats{
+		Buckets: make([]Bucket, len(h.upperBounds)),
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+
+	cumulative := uint64(0)
+	for i := range h.upperBounds {
+		cumulative += h.counts[i]
+		s.Buckets[i] = Bucket{UpperBound: h.upperBounds[i], Count: cumulative}
+	}
+
+	return s
+}
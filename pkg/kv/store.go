@@ -3,7 +3,23 @@ package kv
 import "context"
 
 type Store interface {
+	// NewSnapshotSession creates read session of the last commit.
+	// Snapshot of the session is retained until closed, unless engines bound resources retained,
+	// like bbolt drops undo logs over its budget, then reads of the session fail with ErrSequenceUnavailable.
 	NewSnapshotSession(dbName string) Session
+	// NewSnapshotSessionAt creates read session pinned to the commit sequence,
+	// returns ErrSequenceUnavailable if snapshot of the sequence not retained.
+	// Snapshot of the session is retained as NewSnapshotSession.
+	NewSnapshotSessionAt(dbName string, seq uint64) (Session, error)
 	NewBatchSession(dbName string) Session
+	// Sync persists all changes committed, including ones committed with DurabilityNoSync.
+	Sync() error
+	// Stats returns metrics of sessions and the engine.
+	Stats() Stats
+	// Checkpoint writes a consistent copy of all changes committed into dir,
+	// which could be opened as a store of the same engine, dir must not exist.
+	Checkpoint(dir string) error
+	// Shutdown rejects new sessions with ErrStoreClosed, waits until open sessions closed or ctx done,
+	// then flushes and closes the store. Returns ErrStoreClosed if already closed.
 	Shutdown(ctx context.Context) error
 }
@@ -0,0 +1,59 @@
+package kv
+
+import "sync"
+
+// NewGroupSyncer creates GroupSyncer for stores supports group commit.
+func NewGroupSyncer() *GroupSyncer {
+	g := &GroupSyncer{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// GroupSyncer shares one sync between callers requested concurrently.
+type GroupSyncer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// count of requests
+	requested uint64
+	// requests covered by syncs finished
+	synced  uint64
+	syncing bool
+}
+
+// Sync returns once a sync started after the request finished,
+// only one of concurrent callers calls sync, others wait for it.
+func (g *GroupSyncer) Sync(sync func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.requested++
+	ticket := g.requested
+
+	for g.synced < ticket {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncing = true
+		// changes of all requests now are applied before the sync.
+		target := g.requested
+
+		g.mu.Unlock()
+		err := sync()
+		g.mu.Lock()
+
+		g.syncing = false
+		g.cond.Broadcast()
+
+		if err != nil {
+			return err
+		}
+
+		if target > g.synced {
+			g.synced = target
+		}
+	}
+
+	return nil
+}
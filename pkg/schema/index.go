@@ -19,8 +19,13 @@ const (
 type IndexSchema struct {
 	PKey
 	Owner     SFID      `msgp:"owner"`
+	Name      string    `msgp:"name"`
 	IndexType IndexType `msgp:"type"`
 	Paths     []KeyPath `msgp:"paths"`
+	// Exprs computes values of Paths at same position before indexing, empty means raw value.
+	Exprs []IndexExpr `msgp:"exprs"`
+	// Where conditions of partial index
+	Where []IndexCondition `msgp:"where"`
 }
 
 func (s *IndexSchema) Indexes() map[string]IndexType {
@@ -28,3 +33,42 @@ func (s *IndexSchema) Indexes() map[string]IndexType {
 		"owner": Index,
 	}
 }
+
+// IsMultikey returns whether index emits entries for each element of array.
+func (s *IndexSchema) IsMultikey() bool {
+	for i := range s.Paths {
+		if _, _, each := s.Paths[i].Each(); each {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEqual returns whether other defines the same index as s, ids are ignored.
+func (s *IndexSchema) IsEqual(other *IndexSchema) bool {
+	if s.Name != other.Name || s.IndexType != other.IndexType || len(s.Paths) != len(other.Paths) {
+		return false
+	}
+	for i := range s.Paths {
+		if !s.Paths[i].IsEqual(other.Paths[i]) || s.Expr(i) != other.Expr(i) {
+			return false
+		}
+	}
+	if len(s.Where) != len(other.Where) {
+		return false
+	}
+	for i := range s.Where {
+		if !s.Where[i].IsEqual(other.Where[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Expr returns expr of path at i.
+func (s *IndexSchema) Expr(i int) IndexExpr {
+	if i < len(s.Exprs) {
+		return s.Exprs[i]
+	}
+	return ""
+}
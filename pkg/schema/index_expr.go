@@ -0,0 +1,177 @@
+package schema
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/octohelm/kiwidb/pkg/encoding/msgp"
+)
+
+// IndexExpr computes the indexed value from value of key path.
+type IndexExpr string
+
+const (
+	ExprLower      IndexExpr = "lower"
+	ExprUpper      IndexExpr = "upper"
+	ExprTruncHour  IndexExpr = "trunc_hour"
+	ExprTruncDay   IndexExpr = "trunc_day"
+	ExprTruncMonth IndexExpr = "trunc_month"
+	ExprTruncYear  IndexExpr = "trunc_year"
+)
+
+// ParseIndexPath parses one part of index name, like `name` or `lower(name)`.
+func ParseIndexPath(s string) (KeyPath, IndexExpr, error) {
+	s = strings.TrimSpace(s)
+
+	var expr IndexExpr
+
+	if i := strings.Index(s, "("); i > 0 && strings.HasSuffix(s, ")") {
+		expr = IndexExpr(s[0:i])
+		if !expr.IsValid() {
+			return nil, "", fmt.Errorf("unsupported index expr %q", expr)
+		}
+		s = s[i+1 : len(s)-1]
+	}
+
+	p, err := ParseKeyPath(s)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return p, expr, nil
+}
+
+func (e IndexExpr) IsValid() bool {
+	switch e {
+	case ExprLower, ExprUpper, ExprTruncHour, ExprTruncDay, ExprTruncMonth, ExprTruncYear:
+		return true
+	}
+	return false
+}
+
+// Apply computes value by expr.
+// Lower and upper work on string,
+// truncations work on unix seconds or RFC3339 string.
+func (e IndexExpr) Apply(v any) (any, error) {
+	if e == "" || v == nil {
+		return v, nil
+	}
+
+	switch e {
+	case ExprLower:
+		if s, ok := v.(string); ok {
+			return strings.ToLower(s), nil
+		}
+	case ExprUpper:
+		if s, ok := v.(string); ok {
+			return strings.ToUpper(s), nil
+		}
+	case ExprTruncHour, ExprTruncDay, ExprTruncMonth, ExprTruncYear:
+		switch x := v.(type) {
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, x)
+			if err != nil {
+				return nil, err
+			}
+			return e.trunc(t).Format(time.RFC3339Nano), nil
+		case int64:
+			return e.trunc(time.Unix(x, 0).UTC()).Unix(), nil
+		case uint64:
+			return uint64(e.trunc(time.Unix(int64(x), 0).UTC()).Unix()), nil
+		case int32:
+			return int32(e.trunc(time.Unix(int64(x), 0).UTC()).Unix()), nil
+		case uint32:
+			return uint32(e.trunc(time.Unix(int64(x), 0).UTC()).Unix()), nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported index expr %q", e)
+	}
+
+	return nil, fmt.Errorf("index expr %s could not apply on %T", e, v)
+}
+
+func (e IndexExpr) trunc(t time.Time) time.Time {
+	switch e {
+	case ExprTruncHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case ExprTruncDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case ExprTruncMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	case ExprTruncYear:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	return t
+}
+
+// CanIndexConditions declares conditions of partial indexes.
+// Only documents matched all conditions would be written into the index.
+type CanIndexConditions interface {
+	IndexConditions() map[string][]IndexCondition
+}
+
+type ConditionOp string
+
+const (
+	OpEq     ConditionOp = "="
+	OpNeq    ConditionOp = "!="
+	OpLt     ConditionOp = "<"
+	OpLte    ConditionOp = "<="
+	OpGt     ConditionOp = ">"
+	OpGte    ConditionOp = ">="
+	OpExists ConditionOp = "exists"
+)
+
+// Match returns whether result of comparing field value with condition value matches the op.
+func (op ConditionOp) Match(cmp int) bool {
+	switch op {
+	case OpEq:
+		return cmp == 0
+	case OpNeq:
+		return cmp != 0
+	case OpLt:
+		return cmp < 0
+	case OpLte:
+		return cmp <= 0
+	case OpGt:
+		return cmp > 0
+	case OpGte:
+		return cmp >= 0
+	case OpExists:
+		return true
+	}
+	return false
+}
+
+// IndexCondition compares value of key path with Value,
+// values are compared in msgp ordering, so the type of Value should be same as the field.
+type IndexCondition struct {
+	Path  KeyPath     `msgp:"path"`
+	Op    ConditionOp `msgp:"op"`
+	Value any         `msgp:"value"`
+}
+
+func (c IndexCondition) IsEqual(other IndexCondition) bool {
+	if c.Op != other.Op || !c.Path.IsEqual(other.Path) {
+		return false
+	}
+	// values could be different go types after decoding, so compare them encoded.
+	a, _ := msgp.Marshal(c.Value)
+	b, _ := msgp.Marshal(other.Value)
+	return bytes.Equal(a, b)
+}
+
+// Where creates IndexCondition.
+func Where(path string, op ConditionOp, value any) IndexCondition {
+	p, err := ParseKeyPath(path)
+	if err != nil {
+		panic(err)
+	}
+	return IndexCondition{
+		Path:  p,
+		Op:    op,
+		Value: value,
+	}
+}
@@ -30,15 +30,22 @@ func ParseKeyPath(s string) (KeyPath, error) {
 
 		switch b {
 		case '[':
-			// skip
+			if buf.Len() > 0 {
+				_ = appendPath(nil)
+			}
 		case ']':
 			if err := appendPath(func(v string) (any, error) {
+				if v == "" {
+					return KeyPathEach, nil
+				}
 				return strconv.ParseInt(v, 10, 64)
 			}); err != nil {
 				return nil, err
 			}
 		case '.':
-			_ = appendPath(nil)
+			if buf.Len() > 0 {
+				_ = appendPath(nil)
+			}
 		default:
 			buf.WriteByte(b)
 		}
@@ -51,6 +58,9 @@ func ParseKeyPath(s string) (KeyPath, error) {
 	return p, nil
 }
 
+// KeyPathEach in KeyPath, written as `[]`, means the rest of path applies to each element of the array.
+const KeyPathEach int64 = -1
+
 type KeyPath []any
 
 func (p KeyPath) String() string {
@@ -65,6 +75,12 @@ func (p KeyPath) String() string {
 			b.WriteString(x)
 		case int:
 			b.WriteString("[" + strconv.Itoa(x) + "]")
+		case int64:
+			if x == KeyPathEach {
+				b.WriteString("[]")
+				continue
+			}
+			b.WriteString("[" + strconv.FormatInt(x, 10) + "]")
 		}
 	}
 
@@ -85,3 +101,13 @@ func (p KeyPath) IsEqual(other KeyPath) bool {
 
 	return true
 }
+
+// Each splits p at the first KeyPathEach.
+func (p KeyPath) Each() (KeyPath, KeyPath, bool) {
+	for i := range p {
+		if v, ok := p[i].(int64); ok && v == KeyPathEach {
+			return p[0:i], p[i+1:], true
+		}
+	}
+	return p, nil, false
+}
@@ -64,18 +64,32 @@ func (s *TableSchema) Init() error {
 
 		for name, indexType := range canIndexes.Indexes() {
 			is := &IndexSchema{
+				Name:      name,
 				IndexType: indexType,
 			}
 
 			parts := strings.Split(name, ",")
 
 			is.Paths = make([]KeyPath, len(parts))
+			exprs := make([]IndexExpr, len(parts))
+			withExpr := false
+
 			for i := range is.Paths {
-				keyPath, err := ParseKeyPath(parts[i])
+				keyPath, expr, err := ParseIndexPath(parts[i])
 				if err != nil {
 					return err
 				}
 				is.Paths[i] = keyPath
+				exprs[i] = expr
+				withExpr = withExpr || expr != ""
+			}
+
+			if withExpr {
+				is.Exprs = exprs
+			}
+
+			if canIndexConditions, ok := m.(CanIndexConditions); ok {
+				is.Where = canIndexConditions.IndexConditions()[name]
 			}
 
 			s.IndexSchemas[name] = is